@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/storage"
+)
+
+const (
+	exportUsage = "usage: go-split-api [-config-path path] export [file]"
+	importUsage = "usage: go-split-api [-config-path path] import [file]"
+)
+
+// runExport dumps the database to file, or to stdout without one.
+func runExport(db *storage.Storage, args []string) error {
+	if len(args) > 1 {
+		return errors.New(exportUsage)
+	}
+
+	var w io.Writer = os.Stdout
+	if len(args) == 1 {
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return db.Export(context.Background(), w)
+}
+
+// runImport loads a dump from file, or from stdin without one, into a
+// database migrated to the current schema.
+func runImport(db *storage.Storage, args []string) error {
+	if len(args) > 1 {
+		return errors.New(importUsage)
+	}
+
+	ctx := context.Background()
+	if err := db.CheckSchema(ctx); err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if len(args) == 1 {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	return db.Import(ctx, r)
+}
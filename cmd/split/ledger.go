@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/storage"
+)
+
+const ledgerUsage = "usage: go-split-api [-config-path path] ledger check"
+
+// runLedger checks the ledger against the bills and transactions; it fails
+// when any inconsistency is found, so it can gate a deploy or a cron job.
+func runLedger(db *storage.Storage, args []string) error {
+	if len(args) != 1 || args[0] != "check" {
+		return errors.New(ledgerUsage)
+	}
+
+	ctx := context.Background()
+	if err := db.CheckSchema(ctx); err != nil {
+		return err
+	}
+	issues, err := db.CheckLedger(ctx)
+	if err != nil {
+		return err
+	}
+	if len(issues) == 0 {
+		fmt.Println("ledger consistent")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "BILL\tENTRY\tTX\tPROBLEM")
+	for _, issue := range issues {
+		entry, tx := "-", "-"
+		if issue.EntryID != "" {
+			entry = issue.EntryID
+		}
+		if issue.TxID != nil {
+			tx = issue.TxID.String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", issue.BillID, entry, tx, issue.Problem)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return fmt.Errorf("ledger: %d issues found", len(issues))
+}
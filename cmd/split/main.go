@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 
@@ -39,7 +40,48 @@ func main() {
 		log.Fatal(err)
 	}
 
+	switch flag.Arg(0) {
+	case "migrate":
+		if err := runMigrate(db, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "export":
+		if err := runExport(db, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "import":
+		if err := runImport(db, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "ledger":
+		if err := runLedger(db, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if configuration.MigrateOnStart {
+		if err := db.MigrateUp(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := db.CheckSchema(context.Background()); err != nil {
+		logger.WithError(err).Error("refusing to start, run `migrate up` or set migrate_on_start")
+		log.Fatal(err)
+	}
+
 	pool := liteclient.NewConnectionPool()
+	if err := pool.AddConnectionsFromConfigUrl(context.Background(), configuration.TonConfigURL); err != nil {
+		if configuration.FinalityDepth > 0 {
+			// nothing would ever leave CONFIRMING
+			logger.WithError(err).Error("liteclient: no liteservers reachable, finality checks are impossible; set finality_depth = 0 to run without them")
+			log.Fatal(err)
+		}
+		logger.WithError(err).Warn("liteclient: no liteservers, finality_depth = 0 so confirmations do not wait for them")
+	}
 	api := ton.NewAPIClient(pool)
 	server := split.NewServer(configuration, logger, db, api)
 	if err := server.Start(); err != nil {
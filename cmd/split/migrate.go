@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/storage"
+)
+
+const migrateUsage = "usage: go-split-api [-config-path path] migrate up|down|status"
+
+func runMigrate(db *storage.Storage, args []string) error {
+	if len(args) != 1 {
+		return errors.New(migrateUsage)
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		return db.MigrateUp(ctx)
+	case "down":
+		return db.MigrateDown(ctx)
+	case "status":
+		states, err := db.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tMIGRATION\tAPPLIED AT")
+		for _, st := range states {
+			applied := "pending"
+			if st.Applied {
+				applied = st.AppliedAt.UTC().Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", st.Version, st.Name, applied)
+		}
+		return w.Flush()
+	default:
+		return errors.New(migrateUsage)
+	}
+}
@@ -0,0 +1,10 @@
+// Package db ships the SQL migrations inside the binary.
+package db
+
+import "embed"
+
+// Migrations holds the goose migrations, one directory per storage driver
+// under migrations/.
+//
+//go:embed migrations/postgres/*.sql migrations/sqlite/*.sql
+var Migrations embed.FS
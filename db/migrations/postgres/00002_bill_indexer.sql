@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE bills
+    ADD COLUMN IF NOT EXISTS indexed_lt bigint not null default 0;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE bills
+    DROP COLUMN IF EXISTS indexed_lt;
+-- +goose StatementEnd
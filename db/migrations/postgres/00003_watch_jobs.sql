@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS watch_jobs
+(
+    tx_id      uuid PRIMARY KEY REFERENCES transactions (id) ON DELETE CASCADE,
+    bill_id    uuid      not null REFERENCES bills (id),
+    deadline   timestamp not null,
+    attempts   integer   not null default 0,
+    last_lt    bigint    not null default 0,
+    created_at timestamp not null default now(),
+    updated_at timestamp not null default now()
+);
+
+CREATE INDEX IF NOT EXISTS watch_jobs_deadline_idx ON watch_jobs (deadline);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE watch_jobs;
+-- +goose StatementEnd
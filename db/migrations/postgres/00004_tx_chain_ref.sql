@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE transactions
+    ADD COLUMN IF NOT EXISTS tx_hash      varchar(64),
+    ADD COLUMN IF NOT EXISTS lt           bigint,
+    ADD COLUMN IF NOT EXISTS raw_amount   bigint,
+    ADD COLUMN IF NOT EXISTS confirmed_at timestamp;
+
+CREATE UNIQUE INDEX IF NOT EXISTS transactions_chain_tx_uidx ON transactions (tx_hash, lt);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS transactions_chain_tx_uidx;
+
+ALTER TABLE transactions
+    DROP COLUMN IF EXISTS confirmed_at,
+    DROP COLUMN IF EXISTS raw_amount,
+    DROP COLUMN IF EXISTS lt,
+    DROP COLUMN IF EXISTS tx_hash;
+-- +goose StatementEnd
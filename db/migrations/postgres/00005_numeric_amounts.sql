@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE bills
+    ALTER COLUMN goal TYPE numeric(78, 0),
+    ALTER COLUMN collected TYPE numeric(78, 0);
+
+ALTER TABLE transactions
+    ALTER COLUMN amount TYPE numeric(78, 0),
+    ALTER COLUMN raw_amount TYPE numeric(78, 0);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE transactions
+    ALTER COLUMN raw_amount TYPE bigint,
+    ALTER COLUMN amount TYPE bigint;
+
+ALTER TABLE bills
+    ALTER COLUMN collected TYPE bigint,
+    ALTER COLUMN goal TYPE bigint;
+-- +goose StatementEnd
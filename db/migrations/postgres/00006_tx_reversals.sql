@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+INSERT INTO tx_statuses(name)
+values ('BOUNCED'),
+       ('RETURNED')
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE transactions
+    ADD COLUMN IF NOT EXISTS reversal_tx_hash varchar(64),
+    ADD COLUMN IF NOT EXISTS reversal_lt      bigint,
+    ADD COLUMN IF NOT EXISTS reversed_at      timestamp;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE transactions
+    DROP COLUMN IF EXISTS reversed_at,
+    DROP COLUMN IF EXISTS reversal_lt,
+    DROP COLUMN IF EXISTS reversal_tx_hash;
+
+DELETE FROM tx_statuses WHERE name IN ('BOUNCED', 'RETURNED');
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+INSERT INTO tx_statuses(name)
+values ('CONFIRMING')
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE transactions
+    ADD COLUMN IF NOT EXISTS mc_seqno bigint;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE transactions
+    DROP COLUMN IF EXISTS mc_seqno;
+
+DELETE FROM tx_statuses WHERE name = 'CONFIRMING';
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS idempotency_keys
+(
+    scope       varchar     not null,
+    key         varchar     not null,
+    fingerprint varchar(64) not null,
+    status_code integer     not null default 0,
+    response    bytea,
+    created_at  timestamp   not null default now(),
+    expires_at  timestamp   not null,
+    PRIMARY KEY (scope, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_idx ON idempotency_keys (expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE idempotency_keys;
+-- +goose StatementEnd
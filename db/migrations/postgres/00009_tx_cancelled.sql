@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+INSERT INTO tx_statuses(name)
+values ('CANCELLED')
+ON CONFLICT DO NOTHING;
+
+CREATE INDEX IF NOT EXISTS transactions_bill_created_idx ON transactions (bill_id, created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS transactions_bill_created_idx;
+
+DELETE FROM tx_statuses WHERE name = 'CANCELLED';
+-- +goose StatementEnd
@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE bills
+    ADD COLUMN IF NOT EXISTS event_seq bigint not null default 0;
+
+CREATE TABLE IF NOT EXISTS bill_events
+(
+    bill_id    uuid        not null references bills (id) on delete cascade,
+    seq        bigint      not null,
+    type       varchar(32) not null,
+    version    integer     not null,
+    payload    jsonb       not null,
+    created_at timestamp   not null default now(),
+    PRIMARY KEY (bill_id, seq)
+);
+
+CREATE INDEX IF NOT EXISTS bill_events_created_idx ON bill_events (created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE bill_events;
+
+ALTER TABLE bills
+    DROP COLUMN IF EXISTS event_seq;
+-- +goose StatementEnd
@@ -0,0 +1,53 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE bills
+    ADD COLUMN IF NOT EXISTS api_key_id varchar(64);
+
+CREATE INDEX IF NOT EXISTS bills_api_key_idx ON bills (api_key_id);
+
+CREATE TABLE IF NOT EXISTS webhooks
+(
+    id         uuid primary key default gen_random_uuid(),
+    api_key_id varchar(64),
+    bill_id    uuid references bills (id) on delete cascade,
+    url        text        not null,
+    secret     varchar(64) not null,
+    events     varchar     not null default '',
+    created_at timestamp   not null default now(),
+    CHECK (api_key_id IS NOT NULL OR bill_id IS NOT NULL)
+);
+
+CREATE INDEX IF NOT EXISTS webhooks_api_key_idx ON webhooks (api_key_id);
+CREATE INDEX IF NOT EXISTS webhooks_bill_idx ON webhooks (bill_id);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries
+(
+    id               uuid primary key default gen_random_uuid(),
+    webhook_id       uuid        not null references webhooks (id) on delete cascade,
+    bill_id          uuid        not null,
+    event_seq        bigint      not null,
+    event_type       varchar(32) not null,
+    payload          jsonb       not null,
+    status           varchar(16) not null,
+    attempts         integer     not null default 0,
+    next_attempt_at  timestamp   not null default now(),
+    last_status_code integer,
+    last_error       text,
+    delivered_at     timestamp,
+    created_at       timestamp   not null default now(),
+    updated_at       timestamp   not null default now(),
+    UNIQUE (webhook_id, bill_id, event_seq)
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (status, next_attempt_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE webhook_deliveries;
+DROP TABLE webhooks;
+
+DROP INDEX IF EXISTS bills_api_key_idx;
+ALTER TABLE bills
+    DROP COLUMN IF EXISTS api_key_id;
+-- +goose StatementEnd
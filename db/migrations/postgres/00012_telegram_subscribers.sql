@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS telegram_subscribers
+(
+    wallet     varchar primary key,
+    chat_id    bigint    not null,
+    opted_out  boolean   not null default false,
+    created_at timestamp not null default now(),
+    updated_at timestamp not null default now()
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE telegram_subscribers;
+-- +goose StatementEnd
@@ -0,0 +1,35 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE bills
+    ALTER COLUMN status TYPE varchar(16),
+    ALTER COLUMN status SET NOT NULL;
+
+ALTER TABLE transactions
+    ALTER COLUMN status TYPE varchar(32),
+    ALTER COLUMN status SET NOT NULL,
+    ALTER COLUMN op_type TYPE varchar(32),
+    ALTER COLUMN op_type SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS transactions_sender_idx ON transactions (sender_address);
+-- bootstrap only looks for transactions still in flight
+CREATE INDEX IF NOT EXISTS transactions_open_status_idx ON transactions (status)
+    WHERE status IN ('PENDING', 'CONFIRMING');
+CREATE INDEX IF NOT EXISTS bills_creator_idx ON bills (creator_address);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS bills_creator_idx;
+DROP INDEX IF EXISTS transactions_open_status_idx;
+DROP INDEX IF EXISTS transactions_sender_idx;
+
+ALTER TABLE transactions
+    ALTER COLUMN op_type DROP NOT NULL,
+    ALTER COLUMN op_type TYPE varchar,
+    ALTER COLUMN status DROP NOT NULL,
+    ALTER COLUMN status TYPE varchar;
+
+ALTER TABLE bills
+    ALTER COLUMN status DROP NOT NULL,
+    ALTER COLUMN status TYPE varchar;
+-- +goose StatementEnd
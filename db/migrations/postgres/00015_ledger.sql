@@ -0,0 +1,80 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS ledger_entries
+(
+    id         varchar(160) PRIMARY KEY,
+    bill_id    uuid         not null references bills (id) on delete cascade,
+    kind       varchar(16)  not null,
+    tx_id      uuid references transactions (id) on delete cascade,
+    created_at timestamp    not null default now()
+);
+
+CREATE INDEX IF NOT EXISTS ledger_entries_bill_idx ON ledger_entries (bill_id, created_at);
+CREATE INDEX IF NOT EXISTS ledger_entries_tx_idx ON ledger_entries (tx_id);
+
+CREATE TABLE IF NOT EXISTS ledger_postings
+(
+    entry_id varchar(160) not null references ledger_entries (id) on delete cascade,
+    account  varchar      not null,
+    amount   numeric      not null,
+    PRIMARY KEY (entry_id, account)
+);
+
+CREATE INDEX IF NOT EXISTS ledger_postings_account_idx ON ledger_postings (account);
+
+-- Journal what the bills already hold: counted transactions and their
+-- reversals, then project collected from it. Contributions confirmed before
+-- 00004 have no confirmed_at, they are known by their status; a BOUNCED one
+-- without confirmed_at bounced while pending and was never counted.
+CREATE TEMPORARY TABLE ledger_backfill AS
+SELECT id,
+       bill_id,
+       op_type,
+       sender_address,
+       COALESCE(raw_amount, amount)       AS amount,
+       COALESCE(confirmed_at, created_at) AS confirmed_at,
+       reversed_at
+FROM transactions
+WHERE bill_id IS NOT NULL
+  AND (confirmed_at IS NOT NULL OR status IN ('SUCCESS', 'RETURNED'));
+
+INSERT INTO ledger_entries (id, bill_id, kind, tx_id, created_at)
+SELECT 'confirm:' || id, bill_id, CASE op_type WHEN 'CONTRIBUTE' THEN 'CONTRIBUTION' ELSE 'DEPOSIT' END, id, confirmed_at
+FROM ledger_backfill;
+
+INSERT INTO ledger_entries (id, bill_id, kind, tx_id, created_at)
+SELECT 'reverse:' || id, bill_id, CASE op_type WHEN 'CONTRIBUTE' THEN 'REVERSAL' ELSE 'REFUND' END, id, reversed_at
+FROM ledger_backfill
+WHERE reversed_at IS NOT NULL;
+
+INSERT INTO ledger_postings (entry_id, account, amount)
+SELECT 'confirm:' || id, 'escrow:' || bill_id, amount
+FROM ledger_backfill
+UNION ALL
+SELECT 'confirm:' || id, 'contributor:' || sender_address, -amount
+FROM ledger_backfill
+UNION ALL
+SELECT 'reverse:' || id, 'contributor:' || sender_address, amount
+FROM ledger_backfill
+WHERE reversed_at IS NOT NULL
+UNION ALL
+SELECT 'reverse:' || id, 'escrow:' || bill_id, -amount
+FROM ledger_backfill
+WHERE reversed_at IS NOT NULL;
+
+DROP TABLE ledger_backfill;
+
+UPDATE bills
+SET collected = COALESCE((SELECT SUM(p.amount)
+                          FROM ledger_postings p
+                                   JOIN ledger_entries e ON e.id = p.entry_id
+                          WHERE e.bill_id = bills.id
+                            AND e.kind IN ('CONTRIBUTION', 'REVERSAL')
+                            AND p.account = 'escrow:' || bills.id), 0);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE ledger_postings;
+DROP TABLE ledger_entries;
+-- +goose StatementEnd
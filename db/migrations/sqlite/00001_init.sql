@@ -0,0 +1,188 @@
+-- The schema of postgres/ up to 00013 in one step. Amounts are text, SQLite
+-- numeric would turn values beyond int64 into REAL; queries compare them
+-- through CAST(... AS NUMERIC).
+-- Times are written by the application as UTC text and compared as text.
+
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS bill_statuses
+(
+    name varchar PRIMARY KEY
+);
+
+INSERT INTO bill_statuses(name)
+values ('ACTIVE'),
+       ('TIMEOUT'),
+       ('DONE'),
+       ('REFUNDED');
+
+CREATE TABLE IF NOT EXISTS tx_statuses
+(
+    name varchar PRIMARY KEY
+);
+
+INSERT INTO tx_statuses(name)
+values ('SUCCESS'),
+       ('PENDING'),
+       ('FAILED'),
+       ('BOUNCED'),
+       ('RETURNED'),
+       ('CONFIRMING'),
+       ('CANCELLED');
+
+CREATE TABLE IF NOT EXISTS op_type
+(
+    name varchar PRIMARY KEY,
+    code bigint  not null unique
+);
+
+INSERT INTO op_type(name, code)
+values ('CONTRIBUTE', 254956341),
+       ('TRANSFER', 1878668480),
+       ('REFUND', 3234946288);
+
+CREATE TABLE IF NOT EXISTS bills
+(
+    id                  text PRIMARY KEY,
+    goal                text        not null,
+    collected           text        not null default '0',
+    creator_address     varchar     not null,
+    destination_address varchar     not null,
+    created_at          timestamp   not null default CURRENT_TIMESTAMP,
+    ended_at            timestamp   not null default (datetime('now', '+10 minutes')),
+    status              varchar(16) not null REFERENCES bill_statuses (name),
+    proxy_wallet        varchar     not null,
+    state_init_hash     varchar     not null,
+    indexed_lt          bigint      not null default 0,
+    event_seq           bigint      not null default 0,
+    api_key_id          varchar(64)
+);
+
+CREATE INDEX IF NOT EXISTS bills_creator_idx ON bills (creator_address);
+CREATE INDEX IF NOT EXISTS bills_api_key_idx ON bills (api_key_id);
+
+CREATE TABLE IF NOT EXISTS transactions
+(
+    id               text PRIMARY KEY,
+    bill_id          text REFERENCES bills (id),
+    amount           text        not null,
+    sender_address   varchar     not null,
+    created_at       timestamp   not null default CURRENT_TIMESTAMP,
+    op_type          varchar(32) not null REFERENCES op_type (name),
+    status           varchar(32) not null REFERENCES tx_statuses (name),
+    tx_hash          varchar(64),
+    lt               bigint,
+    raw_amount       text,
+    confirmed_at     timestamp,
+    reversal_tx_hash varchar(64),
+    reversal_lt      bigint,
+    reversed_at      timestamp,
+    mc_seqno         bigint
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS transactions_chain_tx_uidx ON transactions (tx_hash, lt);
+CREATE INDEX IF NOT EXISTS transactions_bill_created_idx ON transactions (bill_id, created_at);
+CREATE INDEX IF NOT EXISTS transactions_sender_idx ON transactions (sender_address);
+CREATE INDEX IF NOT EXISTS transactions_open_status_idx ON transactions (status)
+    WHERE status IN ('PENDING', 'CONFIRMING');
+
+CREATE TABLE IF NOT EXISTS watch_jobs
+(
+    tx_id      text PRIMARY KEY REFERENCES transactions (id) ON DELETE CASCADE,
+    bill_id    text      not null REFERENCES bills (id),
+    deadline   timestamp not null,
+    attempts   integer   not null default 0,
+    last_lt    bigint    not null default 0,
+    created_at timestamp not null default CURRENT_TIMESTAMP,
+    updated_at timestamp not null default CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS watch_jobs_deadline_idx ON watch_jobs (deadline);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys
+(
+    scope       varchar     not null,
+    key         varchar     not null,
+    fingerprint varchar(64) not null,
+    status_code integer     not null default 0,
+    response    blob,
+    created_at  timestamp   not null default CURRENT_TIMESTAMP,
+    expires_at  timestamp   not null,
+    PRIMARY KEY (scope, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_idx ON idempotency_keys (expires_at);
+
+CREATE TABLE IF NOT EXISTS bill_events
+(
+    bill_id    text        not null REFERENCES bills (id) ON DELETE CASCADE,
+    seq        bigint      not null,
+    type       varchar(32) not null,
+    version    integer     not null,
+    payload    blob        not null,
+    created_at timestamp   not null default CURRENT_TIMESTAMP,
+    PRIMARY KEY (bill_id, seq)
+);
+
+CREATE INDEX IF NOT EXISTS bill_events_created_idx ON bill_events (created_at);
+
+CREATE TABLE IF NOT EXISTS webhooks
+(
+    id         text PRIMARY KEY,
+    api_key_id varchar(64),
+    bill_id    text REFERENCES bills (id) ON DELETE CASCADE,
+    url        text        not null,
+    secret     varchar(64) not null,
+    events     varchar     not null default '',
+    created_at timestamp   not null default CURRENT_TIMESTAMP,
+    CHECK (api_key_id IS NOT NULL OR bill_id IS NOT NULL)
+);
+
+CREATE INDEX IF NOT EXISTS webhooks_api_key_idx ON webhooks (api_key_id);
+CREATE INDEX IF NOT EXISTS webhooks_bill_idx ON webhooks (bill_id);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries
+(
+    id               text PRIMARY KEY,
+    webhook_id       text        not null REFERENCES webhooks (id) ON DELETE CASCADE,
+    bill_id          text        not null,
+    event_seq        bigint      not null,
+    event_type       varchar(32) not null,
+    payload          blob        not null,
+    status           varchar(16) not null,
+    attempts         integer     not null default 0,
+    next_attempt_at  timestamp   not null default CURRENT_TIMESTAMP,
+    last_status_code integer,
+    last_error       text,
+    delivered_at     timestamp,
+    created_at       timestamp   not null default CURRENT_TIMESTAMP,
+    updated_at       timestamp   not null default CURRENT_TIMESTAMP,
+    UNIQUE (webhook_id, bill_id, event_seq)
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (status, next_attempt_at);
+
+CREATE TABLE IF NOT EXISTS telegram_subscribers
+(
+    wallet     varchar PRIMARY KEY,
+    chat_id    bigint    not null,
+    opted_out  boolean   not null default false,
+    created_at timestamp not null default CURRENT_TIMESTAMP,
+    updated_at timestamp not null default CURRENT_TIMESTAMP
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE telegram_subscribers;
+DROP TABLE webhook_deliveries;
+DROP TABLE webhooks;
+DROP TABLE bill_events;
+DROP TABLE idempotency_keys;
+DROP TABLE watch_jobs;
+DROP TABLE transactions;
+DROP TABLE bills;
+DROP TABLE op_type;
+DROP TABLE tx_statuses;
+DROP TABLE bill_statuses;
+-- +goose StatementEnd
@@ -0,0 +1,39 @@
+package chain
+
+import (
+	"context"
+
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/ton"
+)
+
+// Finality uses the liteserver API to tell at which masterchain block an
+// account transaction became part of the committed state.
+type Finality struct {
+	api *ton.APIClient
+}
+
+func NewFinality(api *ton.APIClient) *Finality {
+	return &Finality{api: api}
+}
+
+// Head returns the latest masterchain block known to the liteservers.
+func (f *Finality) Head(ctx context.Context) (*ton.BlockIDExt, error) {
+	return f.api.GetMasterchainInfo(ctx)
+}
+
+// Included reports whether the account state committed by master already
+// contains the transaction with the given lt. The first master it holds for
+// is an upper bound of the block that included the transaction, not that
+// block: finality counted from it waits at least the configured depth.
+func (f *Finality) Included(ctx context.Context, master *ton.BlockIDExt, addr string, lt uint64) (bool, error) {
+	a, err := address.ParseAddr(addr)
+	if err != nil {
+		return false, err
+	}
+	acc, err := f.api.GetAccount(ctx, master, a)
+	if err != nil {
+		return false, err
+	}
+	return acc.LastTxLT >= lt, nil
+}
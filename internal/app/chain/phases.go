@@ -0,0 +1,75 @@
+package chain
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/xssnick/tonutils-go/tlb"
+	"github.com/xssnick/tonutils-go/tvm/cell"
+)
+
+// TxPhases is the outcome of an ordinary transaction as recorded on chain,
+// as opposed to what the inbound message asked for.
+type TxPhases struct {
+	ComputeSkipped bool
+	ComputeSuccess bool
+	ExitCode       int32
+	ActionSuccess  bool
+	ResultCode     int32
+	Aborted        bool
+	// BounceSent is set when the bounce phase produced a bounce message.
+	BounceSent bool
+}
+
+// Failed reports whether the transaction did not accept the inbound value:
+// compute or action phase failed, or the transaction was aborted.
+func (p TxPhases) Failed() bool {
+	return p.Aborted || p.ComputeSkipped || !p.ComputeSuccess || !p.ActionSuccess
+}
+
+var errNotOrdinary = errors.New("not an ordinary transaction")
+
+// ParseTxPhases decodes a transaction BOC in base64, as returned in the
+// toncenter "data" field.
+func ParseTxPhases(data string) (TxPhases, error) {
+	var out TxPhases
+
+	boc, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return out, fmt.Errorf("decode tx boc: %w", err)
+	}
+	root, err := cell.FromBOC(boc)
+	if err != nil {
+		return out, fmt.Errorf("parse tx boc: %w", err)
+	}
+
+	var tx tlb.Transaction
+	if err := tlb.LoadFromCell(&tx, root.BeginParse()); err != nil {
+		return out, fmt.Errorf("load tx: %w", err)
+	}
+
+	desc, ok := tx.Description.(tlb.TransactionDescriptionOrdinary)
+	if !ok {
+		return out, errNotOrdinary
+	}
+
+	out.Aborted = desc.Aborted
+	switch ph := desc.ComputePhase.Phase.(type) {
+	case tlb.ComputePhaseVM:
+		out.ComputeSuccess = ph.Success
+		out.ExitCode = ph.Details.ExitCode
+	case tlb.ComputePhaseSkipped:
+		out.ComputeSkipped = true
+	}
+	// no action phase means there was nothing to do, which is a success
+	out.ActionSuccess = desc.ActionPhase == nil || desc.ActionPhase.Success
+	if desc.ActionPhase != nil {
+		out.ResultCode = desc.ActionPhase.ResultCode
+	}
+	if desc.BouncePhase != nil {
+		_, out.BounceSent = desc.BouncePhase.Phase.(tlb.BouncePhaseOk)
+	}
+
+	return out, nil
+}
@@ -3,6 +3,8 @@ package chain
 import (
 	"encoding/base64"
 	"encoding/hex"
+	"fmt"
+	"math/big"
 	"math/rand/v2"
 	"time"
 
@@ -16,7 +18,10 @@ type ContractInfo struct {
 	StateInitHash string `json:"state_init_hash"`
 }
 
-func GenerateContractInfo(codeHex, receiverAddr, creatorAddr, feeCollectorAddr string, total int64) (*ContractInfo, error) {
+// MaxCoins is the largest amount a Coins field (VarUInteger 16) holds.
+var MaxCoins = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 120), big.NewInt(1))
+
+func GenerateContractInfo(codeHex, receiverAddr, creatorAddr, feeCollectorAddr string, total *big.Int) (*ContractInfo, error) {
 	codeBOC, err := hex.DecodeString(codeHex)
 	if err != nil {
 		return nil, err
@@ -28,15 +33,25 @@ func GenerateContractInfo(codeHex, receiverAddr, creatorAddr, feeCollectorAddr s
 
 	rnd := rand.Int64N(time.Now().UnixNano())
 	id := uint64(rnd % 10_000)
-	goal := uint64(total)
 
-	receiver := address.MustParseAddr(receiverAddr)
-	creator := address.MustParseAddr(creatorAddr)
-	feeCollector := address.MustParseAddr(feeCollectorAddr)
+	receiver, err := address.ParseAddr(receiverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("receiver address: %w", err)
+	}
+	creator, err := address.ParseAddr(creatorAddr)
+	if err != nil {
+		return nil, fmt.Errorf("creator address: %w", err)
+	}
+	feeCollector, err := address.ParseAddr(feeCollectorAddr)
+	if err != nil {
+		return nil, fmt.Errorf("fee collector address: %w", err)
+	}
 
-	dataCell := cell.BeginCell().
-		MustStoreUInt(id, 32).
-		MustStoreCoins(goal).
+	data := cell.BeginCell().MustStoreUInt(id, 32)
+	if err := data.StoreBigCoins(total); err != nil {
+		return nil, fmt.Errorf("goal: %w", err)
+	}
+	dataCell := data.
 		MustStoreAddr(receiver).
 		MustStoreAddr(creator).
 		MustStoreAddr(feeCollector).
@@ -0,0 +1,305 @@
+package chain
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	tcRequestTimeout   = 7 * time.Second
+	tcBackoffBase      = 300 * time.Millisecond
+	tcBackoffMax       = 5 * time.Second
+	tcRetryAfterMax    = 30 * time.Second
+	tcBreakerThreshold = 5
+	tcBreakerCooldown  = 15 * time.Second
+	tcMaxBodyBytes     = 8 << 20
+)
+
+var ErrTonCenterUnavailable = errors.New("toncenter: circuit open")
+
+// TonCenterError is a failed toncenter call, either a non-2xx HTTP status or
+// an "ok": false envelope.
+type TonCenterError struct {
+	Status  int
+	Message string
+}
+
+func (e *TonCenterError) Error() string {
+	return fmt.Sprintf("toncenter: status %d: %s", e.Status, e.Message)
+}
+
+func (e *TonCenterError) retryable() bool {
+	return e.Status == http.StatusTooManyRequests || e.Status >= 500
+}
+
+type TonCenterOptions struct {
+	BaseURL    string
+	APIKey     string
+	RPS        float64
+	MaxRetries int
+}
+
+// TonCenterClient is shared by every watcher and indexer: it owns one
+// transport, one request budget and one circuit breaker.
+type TonCenterClient struct {
+	log        *logrus.Logger
+	baseURL    string
+	apiKey     string
+	maxRetries int
+	http       *http.Client
+	limiter    *rateLimiter
+	breaker    *circuitBreaker
+}
+
+type tcEnvelope struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	Code  int    `json:"code,omitempty"`
+}
+
+func NewTonCenterClient(log *logrus.Logger, opts TonCenterOptions) *TonCenterClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 32
+	transport.MaxIdleConnsPerHost = 16
+	transport.IdleConnTimeout = 90 * time.Second
+
+	if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	}
+
+	return &TonCenterClient{
+		log:        log,
+		baseURL:    strings.TrimRight(opts.BaseURL, "/"),
+		apiKey:     strings.TrimSpace(opts.APIKey),
+		maxRetries: opts.MaxRetries,
+		http:       &http.Client{Timeout: tcRequestTimeout, Transport: transport},
+		limiter:    newRateLimiter(opts.RPS),
+		breaker:    newCircuitBreaker(tcBreakerThreshold, tcBreakerCooldown),
+	}
+}
+
+// Call performs GET {baseURL}/{method}?{params} and decodes the whole JSON
+// body into out. Throttling, 5xx and transport errors are retried with jittered
+// backoff, honouring Retry-After.
+func (c *TonCenterClient) Call(ctx context.Context, method string, params url.Values, out any) error {
+	var lastErr error
+	for attempt := 0; attempt <= c.maxRetries; attempt++ {
+		if !c.breaker.allow() {
+			return ErrTonCenterUnavailable
+		}
+		if err := c.limiter.wait(ctx); err != nil {
+			return err
+		}
+
+		start := time.Now()
+		retryAfter, err := c.do(ctx, method, params, out)
+		c.breaker.record(err == nil || !isRetryable(err))
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+
+		fields := logrus.Fields{
+			"method":  method,
+			"attempt": attempt + 1,
+			"ms":      time.Since(start).Milliseconds(),
+		}
+		if !isRetryable(err) || attempt == c.maxRetries {
+			c.log.WithError(err).WithFields(fields).Warn("toncenter: request failed")
+			return err
+		}
+
+		delay := backoff(attempt)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		c.log.WithError(err).WithFields(fields).WithField("retry_in", delay).Debug("toncenter: retrying")
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return lastErr
+}
+
+func (c *TonCenterClient) do(ctx context.Context, method string, params url.Values, out any) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/"+method+"?"+params.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, tcMaxBodyBytes))
+	if err != nil {
+		return 0, err
+	}
+	retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+
+	var env tcEnvelope
+	_ = json.Unmarshal(body, &env)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := env.Error
+		if msg == "" {
+			msg = http.StatusText(resp.StatusCode)
+		}
+		return retryAfter, &TonCenterError{Status: resp.StatusCode, Message: msg}
+	}
+	if !env.Ok {
+		status := env.Code
+		if status == 0 {
+			status = resp.StatusCode
+		}
+		return retryAfter, &TonCenterError{Status: status, Message: "ok=false: " + env.Error}
+	}
+
+	return 0, json.Unmarshal(body, out)
+}
+
+func isRetryable(err error) bool {
+	var tcErr *TonCenterError
+	if errors.As(err, &tcErr) {
+		return tcErr.retryable()
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func backoff(attempt int) time.Duration {
+	d := tcBackoffBase << attempt
+	if d > tcBackoffMax || d <= 0 {
+		d = tcBackoffMax
+	}
+	// full jitter
+	return time.Duration(rand.Int64N(int64(d)) + 1)
+}
+
+func parseRetryAfter(v string) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if at, err := http.ParseTime(v); err == nil {
+		d = time.Until(at)
+	}
+	if d < 0 {
+		return 0
+	}
+	if d > tcRetryAfterMax {
+		return tcRetryAfterMax
+	}
+	return d
+}
+
+// rateLimiter spaces requests evenly to stay within rps across all callers.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(rps float64) *rateLimiter {
+	l := &rateLimiter{}
+	if rps > 0 {
+		l.interval = time.Duration(float64(time.Second) / rps)
+	}
+	return l
+}
+
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l.interval == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	d := time.Until(at)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// circuitBreaker opens after threshold consecutive failures and lets a single
+// probe through once cooldown has passed.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if ok {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
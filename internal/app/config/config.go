@@ -1,33 +1,84 @@
 package config
 
 type Configuration struct {
-	BindAddress string `toml:"bind_address"`
-	LogLevel    string `toml:"log_level"`
+	BindAddress        string `toml:"bind_address"`
+	MetricsBindAddress string `toml:"metrics_bind_address"`
+	LogLevel           string `toml:"log_level"`
 	// db
-	DbHost string `toml:"db_host"`
-	DbPort int    `toml:"db_port"`
-	DbName string `toml:"db_name"`
-	DbUser string `toml:"db_user"`
-	DbPass string `toml:"db_pass"`
+	DbDriver       string `toml:"db_driver"`
+	DbPath         string `toml:"db_path"`
+	DbHost         string `toml:"db_host"`
+	DbPort         int    `toml:"db_port"`
+	DbName         string `toml:"db_name"`
+	DbUser         string `toml:"db_user"`
+	DbPass         string `toml:"db_pass"`
+	MigrateOnStart bool   `toml:"migrate_on_start"`
 	// chain
-	SmartContractHex    string `toml:"smart_contract_hex"`
-	TonApiToken         string `toml:"ton_api_token"`
-	TonCenterApiKey     string `toml:"ton_center_api_key"`
-	FeeCollectorAddress string `toml:"fee_collector_address"`
+	SmartContractHex    string  `toml:"smart_contract_hex"`
+	TonApiToken         string  `toml:"ton_api_token"`
+	TonCenterURL        string  `toml:"ton_center_url"`
+	TonCenterApiKey     string  `toml:"ton_center_api_key"`
+	TonCenterRPS        float64 `toml:"ton_center_rps"`
+	TonCenterMaxRetries int     `toml:"ton_center_max_retries"`
+	TonCenterPageBudget int     `toml:"ton_center_page_budget"`
+	FeeCollectorAddress string  `toml:"fee_collector_address"`
+	TonConfigURL        string  `toml:"ton_config_url"`
+	FinalityDepth       int     `toml:"finality_depth"`
+	ExplorerTxURL       string  `toml:"explorer_tx_url"`
+	// realtime
+	EventRetentionHours int    `toml:"event_retention_hours"`
+	EventFanout         string `toml:"event_fanout"`
+	// websocket and event stream access
+	WsAllowedOrigins        []string `toml:"ws_allowed_origins"`
+	WsTokenSecret           string   `toml:"ws_token_secret"`
+	WsTokenTTLSeconds       int      `toml:"ws_token_ttl_seconds"`
+	WsMaxConnsPerIP         int      `toml:"ws_max_conns_per_ip"`
+	WsMaxSubscribersPerBill int      `toml:"ws_max_subscribers_per_bill"`
+	TrustForwardedFor       bool     `toml:"trust_forwarded_for"`
+	// wallet proofs
+	TonProofDomain        string `toml:"ton_proof_domain"`
+	WalletTokenTTLSeconds int    `toml:"wallet_token_ttl_seconds"`
+	// merchants
+	ApiKeys               []string `toml:"api_keys"`
+	WebhookMaxAttempts    int      `toml:"webhook_max_attempts"`
+	WebhookTimeoutSeconds int      `toml:"webhook_timeout_seconds"`
+	// notifications
+	TelegramBotToken      string `toml:"telegram_bot_token"`
+	TelegramBotUsername   string `toml:"telegram_bot_username"`
+	TelegramWebhookSecret string `toml:"telegram_webhook_secret"`
+	TelegramAPIURL        string `toml:"telegram_api_url"`
 }
 
 func NewConfiguration() *Configuration {
 	return &Configuration{
-		BindAddress:         ":8081",
-		LogLevel:            "debug",
-		DbHost:              "localhost",
-		DbPort:              5432,
-		DbName:              "database",
-		DbUser:              "username",
-		DbPass:              "password",
-		SmartContractHex:    "0xdead",
-		TonApiToken:         "token",
-		TonCenterApiKey:     "api_key",
-		FeeCollectorAddress: "UQ...rW",
+		BindAddress:             ":8081",
+		LogLevel:                "debug",
+		DbDriver:                "postgres",
+		DbPath:                  "split.db",
+		DbHost:                  "localhost",
+		DbPort:                  5432,
+		DbName:                  "database",
+		DbUser:                  "username",
+		DbPass:                  "password",
+		SmartContractHex:        "0xdead",
+		TonApiToken:             "token",
+		TonCenterURL:            "https://toncenter.com/api/v2",
+		TonCenterApiKey:         "api_key",
+		TonCenterRPS:            8,
+		TonCenterMaxRetries:     3,
+		TonCenterPageBudget:     10,
+		FeeCollectorAddress:     "UQ...rW",
+		TonConfigURL:            "https://ton-blockchain.github.io/global.config.json",
+		FinalityDepth:           3,
+		ExplorerTxURL:           "https://tonviewer.com/transaction/",
+		EventRetentionHours:     72,
+		EventFanout:             "local",
+		WsTokenTTLSeconds:       60,
+		WsMaxConnsPerIP:         20,
+		WsMaxSubscribersPerBill: 200,
+		WalletTokenTTLSeconds:   3600,
+		WebhookMaxAttempts:      8,
+		WebhookTimeoutSeconds:   10,
+		TelegramAPIURL:          "https://api.telegram.org",
 	}
 }
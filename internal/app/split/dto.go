@@ -5,17 +5,20 @@ import (
 
 	"github.com/Hackathon-Apps/go-split-api/internal/app/storage"
 	"github.com/google/uuid"
+	"github.com/xssnick/tonutils-go/ton/wallet"
 )
 
+// Amounts in requests are nanoton unless they carry a decimal point, then
+// TON: "1" or 1 is 1 nanoton, "1.0" is 1 TON. Responses are always nanoton.
 type createBillRequest struct {
-	Goal               int64  `json:"goal"`
-	DestinationAddress string `json:"destination_address"`
+	Goal               storage.Amount `json:"goal"`
+	DestinationAddress string         `json:"destination_address"`
 }
 
 type billResponse struct {
 	ID                 uuid.UUID             `json:"id"`
-	Goal               int64                 `json:"goal"`
-	Collected          int64                 `json:"collected"`
+	Goal               storage.Amount        `json:"goal"`
+	Collected          storage.Amount        `json:"collected"`
 	CreatorAddress     string                `json:"creator_address"`
 	DestinationAddress string                `json:"destination_address"`
 	Status             storage.BillStatus    `json:"status"`
@@ -26,20 +29,58 @@ type billResponse struct {
 	StateInitHash      string                `json:"state_init_hash"`
 }
 
+type createWebhookRequest struct {
+	URL    string     `json:"url"`
+	BillID *uuid.UUID `json:"bill_id,omitempty"`
+	// event types to deliver, all when empty
+	Events []string `json:"events,omitempty"`
+}
+
+// webhookCreatedResponse is the only place the signing secret is shown.
+type webhookCreatedResponse struct {
+	storage.Webhook
+	Secret string `json:"secret"`
+}
+
+type tonProofPayloadResponse struct {
+	Payload   string    `json:"payload"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// tonProofRequest carries a TON Connect ton_proof signed over a payload
+// from /api/auth/ton-proof; state_init is the wallet's, base64 BoC.
+type tonProofRequest struct {
+	Address   string                 `json:"address"`
+	Proof     wallet.TonConnectProof `json:"proof"`
+	StateInit []byte                 `json:"state_init"`
+}
+
+type walletTokenResponse struct {
+	Token     string    `json:"token"`
+	Wallet    string    `json:"wallet"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type telegramLinkResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
 type createTxRequest struct {
-	Amount string           `json:"amount"`
+	Amount storage.Amount   `json:"amount"`
 	OpType string           `json:"op_type"`
 	Status storage.TxStatus `json:"status"`
 }
 
 type OnChainTx struct {
-	LT      uint64 `json:"lt"`
-	Amount  int64  `json:"amount"`
-	From    string `json:"from"`
-	To      string `json:"to"`
-	Bounced bool   `json:"bounced"`
-	Payload string `json:"payload"`
-	Matched bool   `json:"matched"`
+	LT      uint64         `json:"lt"`
+	Hash    string         `json:"hash"`
+	Amount  storage.Amount `json:"amount"`
+	From    string         `json:"from"`
+	To      string         `json:"to"`
+	Bounced bool           `json:"bounced"`
+	Payload string         `json:"payload"`
+	Matched bool           `json:"matched"`
 }
 
 type tcMsgData struct {
@@ -48,7 +89,7 @@ type tcMsgData struct {
 	Body string `json:"body,omitempty"`
 }
 
-type tcInMsg struct {
+type tcMessage struct {
 	Source      string    `json:"source"`
 	Destination string    `json:"destination"`
 	Value       string    `json:"value"`
@@ -65,8 +106,11 @@ type tcTxID struct {
 }
 
 type tcTransaction struct {
-	TransactionID tcTxID  `json:"transaction_id"`
-	InMsg         tcInMsg `json:"in_msg"`
+	TransactionID tcTxID      `json:"transaction_id"`
+	Utime         int64       `json:"utime"`
+	Data          string      `json:"data,omitempty"`
+	InMsg         tcMessage   `json:"in_msg"`
+	OutMsgs       []tcMessage `json:"out_msgs"`
 }
 
 type tcPrev struct {
@@ -79,3 +123,67 @@ type tcGetTxResp struct {
 	Result              []tcTransaction `json:"result"`
 	PreviousTransaction *tcPrev         `json:"previous_transaction,omitempty"`
 }
+
+const wsSchemaVersion = 1
+
+type wsEventType string
+
+const (
+	evBillSnapshot      wsEventType = "bill.snapshot"
+	evTxPending         wsEventType = "tx.pending"
+	evTxConfirmed       wsEventType = "tx.confirmed"
+	evTxFailed          wsEventType = "tx.failed"
+	evBillStatusChanged wsEventType = "bill.status_changed"
+)
+
+// wsEnvelope wraps every websocket message. Seq grows by one per event of a
+// bill; a snapshot carries the seq of the last event it already reflects.
+type wsEnvelope struct {
+	Type      wsEventType `json:"type"`
+	Version   int         `json:"version"`
+	BillID    uuid.UUID   `json:"bill_id"`
+	Seq       uint64      `json:"seq"`
+	Timestamp time.Time   `json:"ts"`
+	Data      any         `json:"data"`
+}
+
+// wsClientMessage is what a user channel client sends to change the set of
+// bills it follows.
+type wsClientMessage struct {
+	Action string  `json:"action"`
+	BillID string  `json:"bill_id"`
+	Since  *uint64 `json:"since,omitempty"`
+	// Token is a bill subscription token, needed for bills the wallet has no
+	// part in
+	Token string `json:"token,omitempty"`
+}
+
+type wsTokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type wsControlReply struct {
+	Type   string `json:"type"`
+	BillID string `json:"bill_id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type billSnapshotEvent struct {
+	Bill *storage.Bill `json:"bill"`
+}
+
+type txEvent struct {
+	Transaction storage.Transaction `json:"transaction"`
+	Collected   storage.Amount      `json:"collected"`
+	Goal        storage.Amount      `json:"goal"`
+	BillStatus  storage.BillStatus  `json:"bill_status"`
+}
+
+type billStatusEvent struct {
+	From      storage.BillStatus `json:"from"`
+	To        storage.BillStatus `json:"to"`
+	Collected storage.Amount     `json:"collected"`
+	Goal      storage.Amount     `json:"goal"`
+	EndedAt   time.Time          `json:"ended_at"`
+}
@@ -0,0 +1,207 @@
+package split
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/storage"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// replay larger than this is replaced by a snapshot
+const wsReplayLimit = 500
+
+// publish appends the event to the bill log and delivers it to subscribers.
+// Callers invoke it once the change it describes is committed.
+func (s *Server) publish(ctx context.Context, billID uuid.UUID, typ wsEventType, data any) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		s.logger.WithError(err).WithField("bill_id", billID.String()).Warn("ws: marshal event failed")
+		return
+	}
+
+	ev, err := s.db.AppendBillEvent(ctx, billID, string(typ), wsSchemaVersion, payload)
+	if err != nil {
+		s.logger.WithError(err).WithFields(logrus.Fields{
+			"bill_id": billID.String(),
+			"type":    typ,
+		}).Warn("ws: persist event failed")
+		return
+	}
+
+	s.deliver(*ev)
+	s.announceEvent(ctx, *ev)
+	s.enqueueWebhooks(ctx, *ev)
+	s.notifyEvent(ctx, billID, data)
+}
+
+// deliver hands a stored event to local subscribers. The sender of a tx
+// event starts following the bill on their user channels.
+func (s *Server) deliver(ev storage.BillEvent) {
+	billID := ev.BillID.String()
+	switch wsEventType(ev.Type) {
+	case evTxPending, evTxConfirmed, evTxFailed:
+		var p struct {
+			Transaction struct {
+				SenderAddress string `json:"sender_address"`
+			} `json:"transaction"`
+		}
+		if err := json.Unmarshal(ev.Payload, &p); err == nil && p.Transaction.SenderAddress != "" {
+			s.ws.follow(p.Transaction.SenderAddress, billID)
+		}
+	}
+
+	s.ws.broadcast(billID, envelopeFromEvent(ev))
+}
+
+func envelopeFromEvent(ev storage.BillEvent) wsEnvelope {
+	return wsEnvelope{
+		Type:      wsEventType(ev.Type),
+		Version:   ev.Version,
+		BillID:    ev.BillID,
+		Seq:       ev.Seq,
+		Timestamp: ev.CreatedAt.UTC(),
+		Data:      ev.Payload,
+	}
+}
+
+// wsBacklog is what a new subscriber gets before live events: the events
+// after since when they are all still stored, a snapshot otherwise.
+func (s *Server) wsBacklog(ctx context.Context, billID uuid.UUID, since *uint64) ([]wsEnvelope, error) {
+	bill, err := s.db.GetBillWithSuccessTransactions(ctx, billID)
+	if err != nil {
+		return nil, err
+	}
+
+	if since != nil {
+		if *since >= bill.EventSeq {
+			return nil, nil
+		}
+		events, err := s.db.ListBillEvents(ctx, billID, *since, wsReplayLimit+1)
+		if err != nil {
+			return nil, err
+		}
+		if len(events) > 0 && len(events) <= wsReplayLimit && events[0].Seq == *since+1 {
+			out := make([]wsEnvelope, 0, len(events))
+			for _, ev := range events {
+				out = append(out, envelopeFromEvent(ev))
+			}
+			return out, nil
+		}
+		s.logger.WithFields(logrus.Fields{
+			"bill_id": billID.String(),
+			"since":   *since,
+		}).Debug("ws: replay unavailable, sending snapshot")
+	}
+
+	return []wsEnvelope{{
+		Type:      evBillSnapshot,
+		Version:   wsSchemaVersion,
+		BillID:    billID,
+		Seq:       bill.EventSeq,
+		Timestamp: time.Now().UTC(),
+		Data:      billSnapshotEvent{Bill: bill},
+	}}, nil
+}
+
+func (s *Server) runEventPruner() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		retention := time.Duration(s.configuration.EventRetentionHours) * time.Hour
+		n, err := s.db.PruneBillEvents(context.Background(), time.Now().UTC().Add(-retention))
+		if err != nil {
+			s.logger.WithError(err).Warn("ws: prune events failed")
+			continue
+		}
+		if n > 0 {
+			s.logger.WithField("pruned", n).Debug("ws: old bill events pruned")
+		}
+	}
+}
+
+// txEventType maps a transaction status onto the event clients see: matched
+// but not yet final is still pending, every way of not being counted is a
+// failure.
+func txEventType(status storage.TxStatus) wsEventType {
+	switch status {
+	case storage.StatusSuccess:
+		return evTxConfirmed
+	case storage.StatusPending, storage.StatusConfirming:
+		return evTxPending
+	default:
+		return evTxFailed
+	}
+}
+
+// publishTx sends the committed state of tx together with the bill totals.
+func (s *Server) publishTx(ctx context.Context, tx storage.Transaction) {
+	bill, err := s.db.GetBill(ctx, tx.BillID)
+	if err != nil {
+		s.logger.WithError(err).WithField("bill_id", tx.BillID.String()).Warn("ws: load bill for event failed")
+		return
+	}
+
+	s.publishTxOf(ctx, *bill, tx)
+}
+
+func (s *Server) publishTxOf(ctx context.Context, bill storage.Bill, tx storage.Transaction) {
+	s.publish(ctx, tx.BillID, txEventType(tx.Status), txEvent{
+		Transaction: tx,
+		Collected:   bill.Collected,
+		Goal:        bill.Goal,
+		BillStatus:  bill.Status,
+	})
+}
+
+// publishConfirmation announces a credited contribution from the state
+// ConfirmContribution committed, without reading it back.
+func (s *Server) publishConfirmation(ctx context.Context, c *storage.Confirmation) {
+	s.publishTxOf(ctx, c.Bill, c.Transaction)
+	s.publishStatusChange(ctx, c.Bill, c.PrevStatus)
+}
+
+// publishTxByID is publishTx for callers that only hold the id of a tx that
+// has just been updated.
+func (s *Server) publishTxByID(ctx context.Context, txID uuid.UUID) {
+	tx, err := s.db.GetTransaction(ctx, txID)
+	if err != nil {
+		s.logger.WithError(err).WithField("tx_id", txID.String()).Warn("ws: load tx for event failed")
+		return
+	}
+	s.publishTx(ctx, *tx)
+}
+
+// publishBillStatus reloads the bill and announces its status if it is no
+// longer from.
+func (s *Server) publishBillStatus(ctx context.Context, billID uuid.UUID, from storage.BillStatus) {
+	bill, err := s.db.GetBill(ctx, billID)
+	if err != nil {
+		s.logger.WithError(err).WithField("bill_id", billID.String()).Warn("ws: load bill for event failed")
+		return
+	}
+	s.publishStatusChange(ctx, *bill, from)
+}
+
+func (s *Server) publishStatusChange(ctx context.Context, bill storage.Bill, from storage.BillStatus) {
+	if bill.Status == from {
+		return
+	}
+
+	billID := bill.ID
+	s.publish(ctx, billID, evBillStatusChanged, billStatusEvent{
+		From:      from,
+		To:        bill.Status,
+		Collected: bill.Collected,
+		Goal:      bill.Goal,
+		EndedAt:   bill.EndedAt,
+	})
+	s.logger.WithFields(logrus.Fields{
+		"bill_id": billID.String(),
+		"from":    from,
+		"to":      bill.Status,
+	}).Debug("ws: bill status event sent")
+}
@@ -0,0 +1,75 @@
+package split
+
+import (
+	"context"
+	"time"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/storage"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	fanoutLocal    = "local"
+	fanoutPostgres = "postgres"
+
+	fanoutRetryDelay = 5 * time.Second
+)
+
+func (s *Server) clusterFanout() bool {
+	return s.bus != nil
+}
+
+// announceEvent tells the other instances about an event this one stored and
+// already delivered to its own subscribers.
+func (s *Server) announceEvent(ctx context.Context, ev storage.BillEvent) {
+	if !s.clusterFanout() {
+		return
+	}
+	err := s.bus.NotifyBillEvent(ctx, storage.BillEventNotice{
+		Instance: s.instanceID,
+		BillID:   ev.BillID,
+		Seq:      ev.Seq,
+	})
+	if err != nil {
+		s.logger.WithError(err).WithFields(logrus.Fields{
+			"bill_id": ev.BillID.String(),
+			"seq":     ev.Seq,
+		}).Warn("fanout: notify failed")
+	}
+}
+
+// runFanout delivers events stored by other instances to local subscribers.
+// While the listener is down delivery is local only; clients catch up on the
+// gap with ?since= when they notice it.
+func (s *Server) runFanout() {
+	if !s.clusterFanout() {
+		s.logger.Info("fanout: local delivery only")
+		return
+	}
+
+	for {
+		s.logger.Info("fanout: listening for bill events")
+		err := s.bus.ListenBillEvents(context.Background(), s.deliverRemoteEvent)
+		s.logger.WithError(err).Warn("fanout: listener stopped, retrying")
+		time.Sleep(fanoutRetryDelay)
+	}
+}
+
+func (s *Server) deliverRemoteEvent(n storage.BillEventNotice) {
+	if n.Instance == s.instanceID {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ev, err := s.db.GetBillEvent(ctx, n.BillID, n.Seq)
+	if err != nil {
+		s.logger.WithError(err).WithFields(logrus.Fields{
+			"bill_id": n.BillID.String(),
+			"seq":     n.Seq,
+		}).Warn("fanout: load event failed")
+		return
+	}
+
+	s.deliver(*ev)
+}
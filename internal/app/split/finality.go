@@ -0,0 +1,125 @@
+package split
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/storage"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	finalityPollInterval = 5 * time.Second
+	finalityCallTimeout  = 30 * time.Second
+)
+
+// runFinality promotes CONFIRMING transactions to SUCCESS once the masterchain
+// block that first committed them is FinalityDepth blocks deep. All state
+// lives in the DB, so this resumes by itself after a restart.
+func (s *Server) runFinality() {
+	ticker := time.NewTicker(finalityPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.advanceFinality()
+	}
+}
+
+func (s *Server) advanceFinality() {
+	ctx, cancel := context.WithTimeout(context.Background(), finalityCallTimeout)
+	defer cancel()
+
+	txs, err := s.db.ListTransactionsByStatus(ctx, storage.StatusConfirming)
+	if err != nil {
+		s.logger.WithError(err).Warn("finality: list confirming failed")
+		return
+	}
+	if len(txs) == 0 {
+		return
+	}
+
+	depth := s.configuration.FinalityDepth
+	if depth <= 0 {
+		for _, tx := range txs {
+			s.finalizeTransaction(ctx, tx)
+		}
+		return
+	}
+
+	head, err := s.finality.Head(ctx)
+	if err != nil {
+		s.logger.WithError(err).Warn("finality: masterchain head unavailable")
+		return
+	}
+
+	proxies := make(map[uuid.UUID]string)
+	for _, tx := range txs {
+		if tx.LT == nil {
+			continue
+		}
+
+		if tx.McSeqno == nil {
+			proxy, ok := proxies[tx.BillID]
+			if !ok {
+				bill, err := s.db.GetBill(ctx, tx.BillID)
+				if err != nil {
+					continue
+				}
+				proxy = bill.ProxyWallet
+				proxies[tx.BillID] = proxy
+			}
+
+			included, err := s.finality.Included(ctx, head, proxy, *tx.LT)
+			if err != nil {
+				s.logger.WithError(err).WithField("tx_id", tx.ID.String()).Debug("finality: account lookup failed")
+				continue
+			}
+			if !included {
+				continue
+			}
+			// an upper bound of the inclusion block, see chain.Finality.Included
+			if err := s.db.SetTransactionMcSeqno(ctx, tx.ID, head.SeqNo); err != nil {
+				s.logger.WithError(err).WithField("tx_id", tx.ID.String()).Warn("finality: persist mc seqno failed")
+				continue
+			}
+			seqno := head.SeqNo
+			tx.McSeqno = &seqno
+
+			s.logger.WithFields(logrus.Fields{
+				"bill_id":  tx.BillID.String(),
+				"tx_id":    tx.ID.String(),
+				"mc_seqno": seqno,
+			}).Debug("finality: tx committed to masterchain")
+		}
+
+		if head.SeqNo >= *tx.McSeqno+uint32(depth) {
+			s.finalizeTransaction(ctx, tx)
+		}
+	}
+}
+
+// finalizeTransaction makes a CONFIRMING contribution final, credits the bill
+// and tells websocket clients about it.
+func (s *Server) finalizeTransaction(ctx context.Context, tx storage.Transaction) bool {
+	confirmed, err := s.db.ConfirmContribution(ctx, tx.ID)
+	if errors.Is(err, storage.ErrTxNotConfirming) {
+		return false
+	}
+	if err != nil {
+		s.logger.WithError(err).WithField("tx_id", tx.ID.String()).Warn("finality: confirm contribution failed")
+		return false
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"bill_id":   tx.BillID.String(),
+		"tx_id":     tx.ID.String(),
+		"amount":    confirmed.Transaction.Credited(),
+		"collected": confirmed.Bill.Collected,
+		"status":    confirmed.Bill.Status,
+	}).Info("tx: final -> SUCCESS")
+
+	s.publishConfirmation(ctx, confirmed)
+	return true
+}
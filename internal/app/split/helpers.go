@@ -32,8 +32,15 @@ func parseOpType(s string) (storage.OpType, error) {
 	}
 }
 
-func parseInt64(s string) (int64, error) {
-	return strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+func parseTxStatus(s string) (storage.TxStatus, error) {
+	st := storage.TxStatus(strings.ToUpper(strings.TrimSpace(s)))
+	switch st {
+	case storage.StatusPending, storage.StatusFailed, storage.StatusConfirming, storage.StatusSuccess,
+		storage.StatusBounced, storage.StatusReturned, storage.StatusCancelled:
+		return st, nil
+	default:
+		return "", errors.New("invalid status: use PENDING|CONFIRMING|SUCCESS|FAILED|BOUNCED|RETURNED|CANCELLED")
+	}
 }
 
 func renderJSON(w http.ResponseWriter, v interface{}) {
@@ -52,11 +59,44 @@ func renderErr(w http.ResponseWriter, code int, msg string) {
 	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
 }
 
+// billETag is the entity tag of a bill: its version, which every change of
+// status or collected amount bumps.
+func billETag(bill *storage.Bill) string {
+	return `"` + strconv.FormatUint(bill.Version, 10) + `"`
+}
+
+// ifMatch reports whether r may modify bill: it has no If-Match header or one
+// that lists the bill's current ETag.
+func ifMatch(r *http.Request, bill *storage.Bill) bool {
+	h := strings.TrimSpace(r.Header.Get("If-Match"))
+	if h == "" || h == "*" {
+		return true
+	}
+	etag := billETag(bill)
+	for _, tag := range strings.Split(h, ",") {
+		if strings.TrimSpace(tag) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// renderBillChanged answers a write that lost against a newer bill version:
+// 412 for a client that sent If-Match, 409 otherwise.
+func renderBillChanged(w http.ResponseWriter, r *http.Request) {
+	code := http.StatusConflict
+	if r.Header.Get("If-Match") != "" {
+		code = http.StatusPreconditionFailed
+	}
+	renderErr(w, code, "bill has changed, reload it and retry")
+}
+
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Sender-Address")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Sender-Address, Idempotency-Key, If-Match, Last-Event-ID, X-API-Key, X-Wallet-Token")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, Idempotent-Replayed")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
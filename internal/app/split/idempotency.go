@@ -0,0 +1,143 @@
+package split
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	idempotencyTTL       = 24 * time.Hour
+	idempotencyMaxKeyLen = 255
+	idempotencyMaxBody   = 1 << 20
+	idempotencyPurgeTick = time.Hour
+)
+
+// idemRecorder passes the response through and keeps a copy for replay.
+type idemRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *idemRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *idemRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(p)
+	return r.ResponseWriter.Write(p)
+}
+
+// idempotent makes a POST handler safe to retry: the first response for an
+// Idempotency-Key is stored and replayed for repeats of the same request,
+// while reusing the key for a different request is rejected. Requests
+// without the header are passed through untouched.
+func (s *Server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimSpace(r.Header.Get(idempotencyKeyHeader))
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > idempotencyMaxKeyLen {
+			renderErr(w, http.StatusBadRequest, "idempotency key too long")
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, idempotencyMaxBody+1))
+		if err != nil {
+			renderErr(w, http.StatusBadRequest, "cannot read body")
+			return
+		}
+		if len(body) > idempotencyMaxBody {
+			renderErr(w, http.StatusRequestEntityTooLarge, "body too large")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// keys are namespaced by the caller so two wallets cannot collide
+		scope := strings.TrimSpace(r.Header.Get("Sender-Address"))
+		fingerprint := requestFingerprint(r, body)
+		ctx := r.Context()
+
+		rec, created, err := s.db.ReserveIdempotencyKey(ctx, scope, key, fingerprint, idempotencyTTL)
+		if err != nil {
+			s.logger.WithError(err).WithField("key", key).Error("idempotency: reserve failed")
+			renderErr(w, http.StatusInternalServerError, "db error")
+			return
+		}
+
+		if !created {
+			switch {
+			case rec.Fingerprint != fingerprint:
+				renderErr(w, http.StatusUnprocessableEntity, "idempotency key reused with a different request")
+			case rec.StatusCode == 0:
+				w.Header().Set("Retry-After", "1")
+				renderErr(w, http.StatusConflict, "request with this idempotency key is in progress")
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(rec.StatusCode)
+				_, _ = w.Write(rec.Response)
+			}
+			return
+		}
+
+		recorder := &idemRecorder{ResponseWriter: w}
+		next(recorder, r)
+
+		// the request did not go through on our side, let the client retry it
+		// with the same key
+		bg := context.Background()
+		if recorder.status == 0 || recorder.status >= http.StatusInternalServerError {
+			if err := s.db.ReleaseIdempotencyKey(bg, scope, key); err != nil {
+				s.logger.WithError(err).WithField("key", key).Warn("idempotency: release failed")
+			}
+			return
+		}
+		if err := s.db.CompleteIdempotencyKey(bg, scope, key, recorder.status, recorder.body.Bytes()); err != nil {
+			s.logger.WithError(err).WithField("key", key).Warn("idempotency: store response failed")
+		}
+	}
+}
+
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method))
+	h.Write([]byte{0})
+	h.Write([]byte(r.URL.Path))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (s *Server) runIdempotencyJanitor() {
+	ticker := time.NewTicker(idempotencyPurgeTick)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := s.db.PurgeExpiredIdempotencyKeys(context.Background())
+		if err != nil {
+			s.logger.WithError(err).Warn("idempotency: purge failed")
+			continue
+		}
+		if n > 0 {
+			s.logger.WithFields(logrus.Fields{"purged": n}).Debug("idempotency: expired keys purged")
+		}
+	}
+}
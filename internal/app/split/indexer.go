@@ -0,0 +1,249 @@
+package split
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/storage"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/xssnick/tonutils-go/address"
+)
+
+const (
+	indexerPollInterval = 15 * time.Second
+	// deposits younger than this are left to pending-tx watchers first
+	indexerGracePeriod = 30 * time.Second
+)
+
+func (s *Server) bootstrapBillIndexers() {
+	bills, err := s.db.ListBillsByStatus(context.Background(), storage.StatusActive, storage.StatusDone, storage.StatusTimeout, storage.StatusRefunded)
+	if err != nil {
+		s.logger.WithError(err).Warn("indexer: bootstrap failed")
+		return
+	}
+	for _, bill := range bills {
+		if bill.Status != storage.StatusActive && time.Since(bill.EndedAt) > reconcileWindow {
+			continue
+		}
+		s.startBillIndexer(bill.ID, bill.ProxyWallet)
+	}
+}
+
+func (s *Server) startBillIndexer(billID uuid.UUID, proxyAddr string) {
+	if proxyAddr == "" {
+		return
+	}
+
+	s.indexMu.Lock()
+	if _, ok := s.indexers[billID]; ok {
+		s.indexMu.Unlock()
+		return
+	}
+	s.indexers[billID] = struct{}{}
+	s.indexMu.Unlock()
+
+	go s.runBillIndexer(billID, proxyAddr)
+}
+
+func (s *Server) runBillIndexer(billID uuid.UUID, proxyAddr string) {
+	defer func() {
+		s.indexMu.Lock()
+		delete(s.indexers, billID)
+		s.indexMu.Unlock()
+	}()
+
+	rawAddr := address.MustParseAddr(proxyAddr).StringRaw()
+	eventCh, cancel := s.tonStream.RegisterListener(rawAddr)
+	defer func() { cancel() }()
+	if err := s.tonStream.Subscribe(rawAddr); err != nil {
+		s.logger.WithError(err).WithField("bill_id", billID.String()).Warn("indexer: stream subscribe failed, polling only")
+	}
+
+	ticker := time.NewTicker(indexerPollInterval)
+	defer ticker.Stop()
+	kick := make(chan struct{}, 1)
+	// set while a gap the page budget left above the bill cursor is walked
+	var resume *tcPrev
+
+	s.logger.WithFields(logrus.Fields{
+		"bill_id": billID.String(),
+		"address": proxyAddr,
+	}).Info("indexer: started")
+
+	for {
+		select {
+		case _, ok := <-eventCh:
+			if !ok {
+				cancel()
+				eventCh, cancel = s.tonStream.RegisterListener(rawAddr)
+				_ = s.tonStream.Subscribe(rawAddr)
+				continue
+			}
+			// give pending watchers a head start on fresh deposits
+			time.AfterFunc(indexerGracePeriod, func() {
+				select {
+				case kick <- struct{}{}:
+				default:
+				}
+			})
+		case <-kick:
+		case <-ticker.C:
+		}
+
+		active, err := s.indexBill(billID, &resume)
+		if err != nil {
+			s.logger.WithError(err).WithField("bill_id", billID.String()).Warn("indexer: scan failed")
+			continue
+		}
+		if !active {
+			s.logger.WithField("bill_id", billID.String()).Info("indexer: nothing left to follow, stopped")
+			return
+		}
+	}
+}
+
+// indexBill walks proxy transactions above the bill cursor: it attributes
+// deposits no pending transaction accounts for and reverses contributions the
+// proxy bounced or returned. It reports whether the bill still needs indexing.
+//
+// The cursor only moves over transactions that are done with: not past a
+// deposit a pending transaction may still claim, and not while older ones
+// are left unscanned. When the page budget runs out before the cursor,
+// resume is set to where the walk stopped and the next scan continues
+// there, down to the cursor; everything seen is processed either way, the
+// handling of a transaction is idempotent.
+func (s *Server) indexBill(billID uuid.UUID, resume **tcPrev) (bool, error) {
+	ctx := context.Background()
+	bill, err := s.db.GetBillWithTransactions(ctx, billID)
+	if err != nil {
+		return true, err
+	}
+	if !s.billNeedsIndexing(ctx, bill) {
+		return false, nil
+	}
+
+	var txs []tcTransaction
+	lts := make(map[string]uint64)
+	it := s.iterateTransactions(bill.ProxyWallet, txLowerBound{LT: bill.IndexedLT, Since: bill.CreatedAt}).From(*resume)
+	for {
+		tx, lt, ok := it.Next()
+		if !ok {
+			break
+		}
+		lts[tx.TransactionID.LT] = lt
+		txs = append(txs, tx)
+	}
+	gap := false
+	switch err := it.Err(); {
+	case errors.Is(err, errPageBudgetExhausted):
+		gap, *resume = true, it.Cursor()
+		s.logger.WithFields(logrus.Fields{
+			"bill_id":    billID.String(),
+			"indexed_lt": bill.IndexedLT,
+			"scanned":    len(txs),
+		}).Warn("indexer: page budget exhausted, older transactions follow on the next scan")
+	case err != nil:
+		return true, err
+	default:
+		*resume = nil
+	}
+	sort.Slice(txs, func(i, j int) bool {
+		return lts[txs[i].TransactionID.LT] < lts[txs[j].TransactionID.LT]
+	})
+
+	cutoff := time.Now().Add(-indexerGracePeriod).Unix()
+	changed, hold := false, gap
+	for _, tx := range txs {
+		if tx.Utime > cutoff {
+			break
+		}
+		lt := lts[tx.TransactionID.LT]
+
+		if s.reconcileOutgoing(ctx, bill, tx, lt) {
+			changed = true
+		}
+		if bill.Status == storage.StatusActive {
+			attributed, retry := s.attributeDeposit(ctx, bill, tx, lt)
+			changed = changed || attributed
+			hold = hold || retry
+		}
+		if hold {
+			continue
+		}
+		if err := s.db.SetBillIndexedLT(ctx, bill.ID, lt); err != nil {
+			return true, err
+		}
+		bill.IndexedLT = lt
+	}
+
+	if changed {
+		if updated, err := s.db.GetBillWithTransactions(ctx, bill.ID); err == nil {
+			return s.billNeedsIndexing(ctx, updated), nil
+		}
+	}
+	return true, nil
+}
+
+// attributeDeposit books a deposit no transaction accounts for as a
+// contribution. hold reports a deposit to look at again: left to a pending
+// transaction of the same sender, which may yet match it, or not booked
+// because of an error.
+func (s *Server) attributeDeposit(ctx context.Context, bill *storage.Bill, tx tcTransaction, lt uint64) (attributed, hold bool) {
+	in := tx.InMsg
+	if in.Source == "" || in.Bounced || depositBounced(tx) {
+		return false, false
+	}
+	amount, err := storage.ParseNano(in.Value)
+	if err != nil || amount.Sign() <= 0 {
+		return false, false
+	}
+	from, err := address.ParseAddr(in.Source)
+	if err != nil {
+		return false, false
+	}
+	hash := tx.TransactionID.Hash
+	used, err := s.db.ChainTxUsed(ctx, hash, lt)
+	if err != nil || used {
+		return false, err != nil
+	}
+
+	pending, err := s.db.ListPendingTransactions(ctx, bill.ID)
+	if err != nil {
+		s.logger.WithError(err).WithField("bill_id", bill.ID.String()).Warn("indexer: list pending failed")
+		return false, true
+	}
+	for _, p := range pending {
+		pAddr, err := address.ParseAddr(p.SenderAddress)
+		if err == nil && pAddr.StringRaw() == from.StringRaw() && amount.Cmp(p.Amount) >= 0 {
+			// the pending watcher owns this deposit
+			return false, true
+		}
+	}
+
+	created, err := s.db.AddConfirmingTransaction(ctx, bill.ID, in.Source, storage.OpContribute, storage.ChainRef{Hash: hash, LT: lt, Amount: amount})
+	if errors.Is(err, storage.ErrChainTxReused) {
+		return false, false
+	}
+	if err != nil {
+		s.logger.WithError(err).WithField("bill_id", bill.ID.String()).Warn("indexer: create contribution failed")
+		return false, true
+	}
+	if s.configuration.FinalityDepth <= 0 {
+		s.finalizeTransaction(ctx, *created)
+	} else {
+		s.publishTx(ctx, *created)
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"bill_id": bill.ID.String(),
+		"tx_id":   created.ID.String(),
+		"lt":      lt,
+		"tx_hash": hash,
+		"amount":  amount,
+		"from":    in.Source,
+	}).Info("indexer: unsolicited deposit -> CONFIRMING")
+	return true, false
+}
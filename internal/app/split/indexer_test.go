@@ -0,0 +1,131 @@
+package split
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/config"
+	"github.com/Hackathon-Apps/go-split-api/internal/app/storage"
+	"github.com/google/uuid"
+)
+
+// fakeChain serves getTransactions over txs, newest first.
+func fakeChain(t *testing.T, txs []tcTransaction) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		limit, _ := strconv.Atoi(q.Get("limit"))
+		start := 0
+		if lt := q.Get("lt"); lt != "" {
+			for start < len(txs) && txs[start].TransactionID.LT != lt {
+				start++
+			}
+		}
+		end := min(start+limit, len(txs))
+		_ = json.NewEncoder(w).Encode(tcGetTxResp{Ok: true, Result: txs[start:end]})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// chainTxs builds n proxy transactions with LTs n..1; deposits maps an LT to
+// its sender and value.
+func chainTxs(n int, deposits map[int][2]string) []tcTransaction {
+	txs := make([]tcTransaction, 0, n)
+	for lt := n; lt >= 1; lt-- {
+		tx := tcTransaction{TransactionID: tcTxID{LT: strconv.Itoa(lt), Hash: "h" + strconv.Itoa(lt)}}
+		if d, ok := deposits[lt]; ok {
+			tx.InMsg = tcMessage{Source: d[0], Value: d[1]}
+		}
+		txs = append(txs, tx)
+	}
+	return txs
+}
+
+func newIndexerServer(t *testing.T, chain *httptest.Server, pageBudget int) (*Server, storage.Repository) {
+	cfg := config.NewConfiguration()
+	cfg.TonCenterURL = chain.URL
+	cfg.TonCenterPageBudget = pageBudget
+	cfg.TonCenterRPS = 1000
+	db := storage.NewMemory()
+	return newTestServer(cfg, db), db
+}
+
+func newIndexedBill(t *testing.T, db storage.Repository) *storage.Bill {
+	bill, err := db.CreateBill(context.Background(), storage.NewAmount(1000), randomWallet(), randomWallet(), randomWallet(), uuid.NewString(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bill
+}
+
+func indexedLT(t *testing.T, db storage.Repository, billID uuid.UUID) uint64 {
+	bill, err := db.GetBill(context.Background(), billID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bill.IndexedLT
+}
+
+// Running out of page budget never moves the cursor over unscanned LTs; the
+// gap is walked on the following scans.
+func TestIndexBillResumesAtGap(t *testing.T) {
+	sender := randomWallet()
+	chain := fakeChain(t, chainTxs(120, map[int][2]string{5: {sender, "100"}}))
+	s, db := newIndexerServer(t, chain, 1)
+	bill := newIndexedBill(t, db)
+	ctx := context.Background()
+
+	// pages overlap on their cursor transaction
+	var resume *tcPrev
+	for scan, want := range []uint64{0, 0, 22, 22, 71, 120} {
+		if _, err := s.indexBill(bill.ID, &resume); err != nil {
+			t.Fatal(err)
+		}
+		if got := indexedLT(t, db, bill.ID); got != want {
+			t.Fatalf("scan %d: indexed lt %d, want %d", scan, got, want)
+		}
+		used, _ := db.ChainTxUsed(ctx, "h5", 5)
+		if used != (scan >= 2) {
+			t.Fatalf("scan %d: deposit at lt 5 counted = %v", scan, used)
+		}
+	}
+}
+
+// A deposit a pending transaction may claim holds the cursor until that
+// transaction ends, then it is counted.
+func TestIndexBillHoldsClaimedDeposit(t *testing.T) {
+	sender := randomWallet()
+	chain := fakeChain(t, chainTxs(3, map[int][2]string{2: {sender, "100"}}))
+	s, db := newIndexerServer(t, chain, 10)
+	bill := newIndexedBill(t, db)
+	ctx := context.Background()
+
+	pending, err := db.AddTransaction(ctx, bill.ID, storage.NewAmount(50), sender, storage.OpContribute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resume *tcPrev
+	if _, err := s.indexBill(bill.ID, &resume); err != nil {
+		t.Fatal(err)
+	}
+	if got := indexedLT(t, db, bill.ID); got != 1 {
+		t.Fatalf("indexed lt %d while the deposit is claimed, want 1", got)
+	}
+
+	if err := db.FailTransaction(ctx, pending.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.indexBill(bill.ID, &resume); err != nil {
+		t.Fatal(err)
+	}
+	if used, _ := db.ChainTxUsed(ctx, "h2", 2); !used {
+		t.Fatal("deposit not counted after the pending transaction failed")
+	}
+	if got := indexedLT(t, db, bill.ID); got != 3 {
+		t.Fatalf("indexed lt %d, want 3", got)
+	}
+}
@@ -0,0 +1,127 @@
+package split
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/storage"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/xssnick/tonutils-go/address"
+)
+
+const ledgerCheckInterval = time.Hour
+
+// recordPayouts journals the value tx moved out of the bill escrow to the
+// destination, the fee collector or back to the depositor. Entries are keyed
+// by the out message, so rescanning a transaction records nothing new.
+func (s *Server) recordPayouts(ctx context.Context, bill *storage.Bill, tx tcTransaction, lt uint64) {
+	raw := func(a string) string {
+		if parsed, err := address.ParseAddr(a); err == nil {
+			return parsed.StringRaw()
+		}
+		return ""
+	}
+	destination, feeCollector, source := raw(bill.DestinationAddress), raw(feeCollectorAddr), raw(tx.InMsg.Source)
+
+	for i, out := range tx.OutMsgs {
+		if out.Bounced {
+			continue
+		}
+		value, err := storage.ParseNano(out.Value)
+		if err != nil || value.Sign() <= 0 {
+			continue
+		}
+
+		id := fmt.Sprintf("out:%s:%d:%d", tx.TransactionID.Hash, lt, i)
+		from := storage.EscrowAccount(bill.ID)
+		var entry storage.LedgerEntry
+		switch dst := raw(out.Destination); {
+		case dst == "":
+			continue
+		case dst == destination:
+			entry = storage.NewTransferEntry(storage.EntryPayout, id, bill.ID, nil, from, storage.DestinationAccount(bill.DestinationAddress), value)
+		case dst == feeCollector:
+			entry = storage.NewTransferEntry(storage.EntryFee, id, bill.ID, nil, from, storage.FeeCollectorAccount(feeCollectorAddr), value)
+		case dst == source && !depositBounced(tx):
+			// change on a deposit goes back to the account it was credited from
+			wallet, txID := tx.InMsg.Source, (*uuid.UUID)(nil)
+			if deposit, err := s.db.GetTransactionByChainRef(ctx, tx.TransactionID.Hash, lt); err == nil && deposit.BillID == bill.ID {
+				wallet, txID = deposit.SenderAddress, &deposit.ID
+			}
+			entry = storage.NewTransferEntry(storage.EntryRefund, id, bill.ID, txID, from, storage.ContributorAccount(wallet), value)
+		default:
+			continue
+		}
+
+		inserted, err := s.db.PostLedgerEntry(ctx, entry)
+		if err != nil {
+			s.logger.WithError(err).WithFields(logrus.Fields{
+				"bill_id": bill.ID.String(),
+				"entry":   id,
+			}).Warn("ledger: record payout failed")
+			continue
+		}
+		if inserted {
+			s.logger.WithFields(logrus.Fields{
+				"bill_id": bill.ID.String(),
+				"entry":   id,
+				"kind":    entry.Kind,
+				"amount":  value,
+			}).Info("ledger: payout recorded")
+		}
+	}
+}
+
+func (s *Server) runLedgerChecker() {
+	ticker := time.NewTicker(ledgerCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		issues, err := s.db.CheckLedger(context.Background())
+		if err != nil {
+			s.logger.WithError(err).Warn("ledger: check failed")
+			continue
+		}
+		ledgerIssues.Set(int64(len(issues)))
+		ledgerLastCheck.Set(time.Now().Unix())
+		for _, issue := range issues {
+			fields := logrus.Fields{"bill_id": issue.BillID.String(), "problem": issue.Problem}
+			if issue.EntryID != "" {
+				fields["entry"] = issue.EntryID
+			}
+			if issue.TxID != nil {
+				fields["tx_id"] = issue.TxID.String()
+			}
+			s.logger.WithFields(fields).Warn("ledger: inconsistency")
+		}
+	}
+}
+
+func (s *Server) handleBillLedger() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		billID, err := uuidFromVars(mux.Vars(r), "id")
+		if err != nil {
+			renderErr(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if _, ok := s.billForParticipant(w, r, billID); !ok {
+			return
+		}
+
+		entries, err := s.db.ListLedgerEntries(r.Context(), billID)
+		if err != nil {
+			renderErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if entries == nil {
+			entries = []storage.LedgerEntry{}
+		}
+
+		renderJSON(w, entries)
+	}
+}
@@ -0,0 +1,54 @@
+package split
+
+import (
+	"expvar"
+)
+
+// realtime delivery counters, served with the rest of expvar on /debug/vars
+// of the metrics listener
+var (
+	wsMetrics         = expvar.NewMap("ws")
+	wsConnections     = new(expvar.Int)
+	wsSent            = new(expvar.Int)
+	wsDropped         = new(expvar.Int)
+	wsSlowDisconnects = new(expvar.Int)
+)
+
+// results of the last ledger consistency check
+var (
+	ledgerMetrics   = expvar.NewMap("ledger")
+	ledgerIssues    = new(expvar.Int)
+	ledgerLastCheck = new(expvar.Int)
+)
+
+func init() {
+	wsMetrics.Set("connections", wsConnections)
+	wsMetrics.Set("sent", wsSent)
+	wsMetrics.Set("dropped", wsDropped)
+	wsMetrics.Set("slow_disconnects", wsSlowDisconnects)
+
+	ledgerMetrics.Set("issues", ledgerIssues)
+	ledgerMetrics.Set("last_check", ledgerLastCheck)
+}
+
+// registerHubMetrics exposes the queue depth of h's subscribers.
+func registerHubMetrics(h *WsHub) {
+	wsMetrics.Set("queue_depth", expvar.Func(func() any {
+		total, peak := h.queueDepth()
+		return map[string]int{"total": total, "max": peak}
+	}))
+}
+
+func (h *WsHub) queueDepth() (total, peak int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sink := range h.sinks {
+		n := sink.queued()
+		total += n
+		if n > peak {
+			peak = n
+		}
+	}
+	return total, peak
+}
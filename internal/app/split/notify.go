@@ -0,0 +1,157 @@
+package split
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/storage"
+	"github.com/Hackathon-Apps/go-split-api/internal/app/telegram"
+	"github.com/google/uuid"
+)
+
+const (
+	notifyQueueSize = 256
+	// how long before the auto-timeout the creator is warned
+	billTimeoutWarning = 2 * time.Minute
+)
+
+// notification is one message for one wallet.
+type notification struct {
+	wallet string
+	text   string
+}
+
+func (s *Server) notifierEnabled() bool {
+	return s.telegram != nil
+}
+
+// enqueueNotification never blocks the caller; when the queue is full the
+// message is dropped.
+func (s *Server) enqueueNotification(n notification) {
+	select {
+	case s.notifyCh <- n:
+	default:
+		s.logger.WithField("wallet", n.wallet).Warn("notify: queue full, message dropped")
+	}
+}
+
+// notifyEvent turns a committed bill event into Telegram messages for the
+// people it concerns.
+func (s *Server) notifyEvent(ctx context.Context, billID uuid.UUID, data any) {
+	if !s.notifierEnabled() {
+		return
+	}
+
+	bill, err := s.db.GetBillWithSuccessTransactions(ctx, billID)
+	if err != nil {
+		s.logger.WithError(err).WithField("bill_id", billID.String()).Warn("notify: load bill failed")
+		return
+	}
+	short := billID.String()[:8]
+
+	switch ev := data.(type) {
+	case txEvent:
+		tx := ev.Transaction
+		if tx.Status != storage.StatusSuccess || tx.OpType != storage.OpContribute {
+			return
+		}
+		s.enqueueNotification(notification{
+			wallet: bill.CreatorAddress,
+			text: fmt.Sprintf("New contribution to your bill %s: %s TON from %s. Collected %s of %s TON.",
+				short, tonString(tx.Credited()), tx.SenderAddress, tonString(bill.Collected), tonString(bill.Goal)),
+		})
+
+	case billStatusEvent:
+		switch ev.To {
+		case storage.StatusDone:
+			if bill.Collected.Cmp(bill.Goal) < 0 {
+				// closed by the creator, not funded
+				return
+			}
+			s.enqueueNotification(notification{
+				wallet: bill.CreatorAddress,
+				text:   fmt.Sprintf("Your bill %s reached its goal of %s TON.", short, tonString(bill.Goal)),
+			})
+		case storage.StatusTimeout:
+			s.enqueueNotification(notification{
+				wallet: bill.CreatorAddress,
+				text: fmt.Sprintf("Your bill %s timed out with %s of %s TON collected.",
+					short, tonString(bill.Collected), tonString(bill.Goal)),
+			})
+		case storage.StatusRefunded:
+			contributed := map[string]storage.Amount{}
+			for _, tx := range bill.Transactions {
+				if tx.OpType == storage.OpContribute {
+					contributed[tx.SenderAddress] = contributed[tx.SenderAddress].Add(tx.Credited())
+				}
+			}
+			for wallet, amount := range contributed {
+				s.enqueueNotification(notification{
+					wallet: wallet,
+					text: fmt.Sprintf("Bill %s was refunded, your contribution of %s TON is on its way back.",
+						short, tonString(amount)),
+				})
+			}
+		}
+	}
+}
+
+// notifyTimeoutSoon warns the creator of an active bill that has not reached
+// its goal yet.
+func (s *Server) notifyTimeoutSoon(billID uuid.UUID) {
+	bill, err := s.db.GetBill(context.Background(), billID)
+	if err != nil || bill.Status != storage.StatusActive || bill.Collected.Cmp(bill.Goal) >= 0 {
+		return
+	}
+	left := time.Until(bill.CreatedAt.Add(billAutoTimeoutTTL)).Round(time.Minute)
+	s.enqueueNotification(notification{
+		wallet: bill.CreatorAddress,
+		text: fmt.Sprintf("Your bill %s times out in %s: %s of %s TON collected.",
+			billID.String()[:8], left, tonString(bill.Collected), tonString(bill.Goal)),
+	})
+}
+
+func (s *Server) runNotifier() {
+	if !s.notifierEnabled() {
+		return
+	}
+
+	for n := range s.notifyCh {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		s.sendNotification(ctx, n)
+		cancel()
+	}
+}
+
+func (s *Server) sendNotification(ctx context.Context, n notification) {
+	log := s.logger.WithField("wallet", n.wallet)
+
+	subs, err := s.db.ListTelegramChats(ctx, []string{walletKey(n.wallet)})
+	if err != nil {
+		log.WithError(err).Warn("notify: load subscriber failed")
+		return
+	}
+
+	for _, sub := range subs {
+		err := s.telegram.SendMessage(ctx, sub.ChatID, n.text)
+		var tgErr *telegram.Error
+		if errors.As(err, &tgErr) && tgErr.RetryAfter > 0 {
+			select {
+			case <-time.After(tgErr.RetryAfter):
+				err = s.telegram.SendMessage(ctx, sub.ChatID, n.text)
+			case <-ctx.Done():
+			}
+		}
+		if err != nil {
+			log.WithError(err).WithField("chat_id", sub.ChatID).Warn("notify: telegram send failed")
+			continue
+		}
+		log.WithField("chat_id", sub.ChatID).Debug("notify: telegram message sent")
+	}
+}
+
+func tonString(a storage.Amount) string {
+	return a.Decimal(storage.TonDecimals)
+}
@@ -0,0 +1,228 @@
+package split
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/chain"
+	"github.com/Hackathon-Apps/go-split-api/internal/app/storage"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/xssnick/tonutils-go/address"
+)
+
+// how long after a bill has ended we keep watching its proxy for returns
+const reconcileWindow = 24 * time.Hour
+
+// depositBounced reports whether the proxy rejected the inbound value of tx
+// and sent it back. The in_msg bounce flag is only the sender's preference,
+// so the decision is based on the transaction phases and its out messages.
+func depositBounced(tx tcTransaction) bool {
+	src, err := address.ParseAddr(tx.InMsg.Source)
+	if err != nil {
+		return false
+	}
+	for _, out := range tx.OutMsgs {
+		if !out.Bounced {
+			continue
+		}
+		if dst, err := address.ParseAddr(out.Destination); err == nil && dst.StringRaw() == src.StringRaw() {
+			return true
+		}
+	}
+
+	if tx.Data == "" {
+		return false
+	}
+	phases, err := chain.ParseTxPhases(tx.Data)
+	if err != nil {
+		return false
+	}
+	return phases.Failed() && (phases.BounceSent || tx.InMsg.Bounce)
+}
+
+// billNeedsIndexing decides whether the indexer keeps following a bill: active
+// bills for deposits, ended ones for returns while contributions remain and
+// done ones for payouts while their escrow holds value.
+func (s *Server) billNeedsIndexing(ctx context.Context, bill *storage.Bill) bool {
+	switch bill.Status {
+	case storage.StatusActive:
+		return true
+	case storage.StatusDone:
+		if time.Since(bill.EndedAt) > reconcileWindow {
+			return false
+		}
+		balance, err := s.db.AccountBalance(ctx, storage.EscrowAccount(bill.ID))
+		return err != nil || balance.Sign() > 0
+	case storage.StatusTimeout, storage.StatusRefunded:
+		if time.Since(bill.EndedAt) > reconcileWindow {
+			return false
+		}
+		for _, tx := range bill.Transactions {
+			if tx.Status == storage.StatusSuccess && tx.OpType == storage.OpContribute {
+				return true
+			}
+		}
+		return false
+	default:
+		return false
+	}
+}
+
+// reconcileOutgoing looks at value leaving the proxy in tx: a bounce of a
+// counted deposit turns it BOUNCED, value sent to a contributor (other than
+// the payout to the destination or the fee collector) returns one of that
+// contributor's confirmed contributions it covers. Whatever no contribution
+// accounts for is journaled as a refund. Payouts go to the ledger.
+func (s *Server) reconcileOutgoing(ctx context.Context, bill *storage.Bill, tx tcTransaction, lt uint64) bool {
+	ref := storage.ChainRef{Hash: tx.TransactionID.Hash, LT: lt}
+	changed := false
+	s.recordPayouts(ctx, bill, tx, lt)
+
+	if depositBounced(tx) {
+		counted, err := s.db.GetTransactionByChainRef(ctx, ref.Hash, ref.LT)
+		if err == nil && counted.Status == storage.StatusSuccess {
+			if s.reverseContribution(ctx, bill, counted.ID, storage.StatusBounced, ref) {
+				changed = true
+			}
+		}
+	}
+
+	// excess handed back to the depositor in the same transaction is change,
+	// not a return
+	payees := map[string]struct{}{}
+	for _, a := range []string{bill.DestinationAddress, feeCollectorAddr, tx.InMsg.Source} {
+		if parsed, err := address.ParseAddr(a); err == nil {
+			payees[parsed.StringRaw()] = struct{}{}
+		}
+	}
+
+	matched := map[uuid.UUID]struct{}{}
+	for i, out := range tx.OutMsgs {
+		if out.Bounced {
+			continue
+		}
+		dst, err := address.ParseAddr(out.Destination)
+		if err != nil {
+			continue
+		}
+		if _, ok := payees[dst.StringRaw()]; ok {
+			continue
+		}
+
+		value, err := storage.ParseNano(out.Value)
+		if err != nil || value.Sign() <= 0 {
+			continue
+		}
+
+		rest, wallet := value, contributorWallet(bill, dst)
+		if c, reversed := matchReturn(bill, dst, value, ref, matched); c != nil {
+			matched[c.ID] = struct{}{}
+			rest = value.Sub(c.Credited())
+			if !reversed && s.reverseContribution(ctx, bill, c.ID, storage.StatusReturned, ref) {
+				changed = true
+			}
+		}
+		if rest.Sign() > 0 && wallet != "" {
+			s.recordReturnRefund(ctx, bill, fmt.Sprintf("out:%s:%d:%d", ref.Hash, lt, i), wallet, rest)
+		}
+	}
+
+	return changed
+}
+
+// matchReturn picks the confirmed contribution of dst that value sent back
+// in full: the one it equals, else the largest below it. A contribution this
+// chain tx already returned (a rescan) is reported as reversed so it is not
+// taken for a new return.
+func matchReturn(bill *storage.Bill, dst *address.Address, value storage.Amount, ref storage.ChainRef, matched map[uuid.UUID]struct{}) (*storage.Transaction, bool) {
+	var best *storage.Transaction
+	for i := range bill.Transactions {
+		c := &bill.Transactions[i]
+		if c.OpType != storage.OpContribute {
+			continue
+		}
+		if _, ok := matched[c.ID]; ok {
+			continue
+		}
+		from, err := address.ParseAddr(c.SenderAddress)
+		if err != nil || from.StringRaw() != dst.StringRaw() {
+			continue
+		}
+		if c.Status == storage.StatusReturned && c.ReversalTxHash != nil && *c.ReversalTxHash == ref.Hash &&
+			c.ReversalLT != nil && *c.ReversalLT == ref.LT {
+			return c, true
+		}
+		if c.Status != storage.StatusSuccess || c.Credited().Cmp(value) > 0 {
+			continue
+		}
+		if best == nil || c.Credited().Cmp(best.Credited()) > 0 {
+			best = c
+		}
+	}
+	return best, false
+}
+
+// contributorWallet is the address dst contributed to bill from, as stored;
+// empty when dst never contributed.
+func contributorWallet(bill *storage.Bill, dst *address.Address) string {
+	for _, c := range bill.Transactions {
+		if from, err := address.ParseAddr(c.SenderAddress); err == nil && from.StringRaw() == dst.StringRaw() {
+			return c.SenderAddress
+		}
+	}
+	return ""
+}
+
+// recordReturnRefund journals value sent to a contributor that returns no
+// contribution; Collected is left alone.
+func (s *Server) recordReturnRefund(ctx context.Context, bill *storage.Bill, id, wallet string, value storage.Amount) {
+	entry := storage.NewTransferEntry(storage.EntryRefund, id, bill.ID, nil,
+		storage.EscrowAccount(bill.ID), storage.ContributorAccount(wallet), value)
+	inserted, err := s.db.PostLedgerEntry(ctx, entry)
+	log := s.logger.WithFields(logrus.Fields{
+		"bill_id": bill.ID.String(),
+		"entry":   id,
+		"amount":  value,
+	})
+	if err != nil {
+		log.WithError(err).Warn("reconcile: record refund failed")
+		return
+	}
+	if inserted {
+		log.Info("reconcile: value sent back without a matching contribution")
+	}
+}
+
+func (s *Server) reverseContribution(ctx context.Context, bill *storage.Bill, txID uuid.UUID, status storage.TxStatus, ref storage.ChainRef) bool {
+	reversed, err := s.db.ReverseContribution(ctx, txID, status, ref)
+	if errors.Is(err, storage.ErrTxNotSuccess) {
+		return false
+	}
+	if err != nil {
+		s.logger.WithError(err).WithFields(logrus.Fields{
+			"bill_id": bill.ID.String(),
+			"tx_id":   txID.String(),
+		}).Warn("reconcile: reverse contribution failed")
+		return false
+	}
+
+	for i := range bill.Transactions {
+		if bill.Transactions[i].ID == reversed.ID {
+			bill.Transactions[i] = *reversed
+		}
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"bill_id": bill.ID.String(),
+		"tx_id":   reversed.ID.String(),
+		"status":  status,
+		"amount":  reversed.Amount,
+		"lt":      ref.LT,
+		"tx_hash": ref.Hash,
+	}).Info("reconcile: contribution reversed")
+	s.publishTx(ctx, *reversed)
+	return true
+}
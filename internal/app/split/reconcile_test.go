@@ -0,0 +1,91 @@
+package split
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/config"
+	"github.com/Hackathon-Apps/go-split-api/internal/app/storage"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/xssnick/tonutils-go/address"
+)
+
+func newTestServer(cfg *config.Configuration, db storage.Repository) *Server {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	return NewServer(cfg, log, db, nil)
+}
+
+func randomWallet() string {
+	data := make([]byte, 32)
+	_, _ = rand.Read(data)
+	return address.NewAddress(0, 0, data).String()
+}
+
+func contribute(t *testing.T, db storage.Repository, billID uuid.UUID, sender string, amount int64) storage.Transaction {
+	t.Helper()
+	ctx := context.Background()
+	ref := storage.ChainRef{Hash: uuid.NewString(), LT: uint64(amount), Amount: storage.NewAmount(amount)}
+	tx, err := db.AddConfirmingTransaction(ctx, billID, sender, storage.OpContribute, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.ConfirmContribution(ctx, tx.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.Transaction
+}
+
+// A return reverses the one contribution it covers; value no contribution
+// accounts for is journaled as a refund.
+func TestReconcileReturnMatchesOneContribution(t *testing.T) {
+	ctx := context.Background()
+	db := storage.NewMemory()
+	s := newTestServer(config.NewConfiguration(), db)
+
+	bill, err := db.CreateBill(ctx, storage.NewAmount(1000), randomWallet(), randomWallet(), randomWallet(), uuid.NewString(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contributor := randomWallet()
+	big := contribute(t, db, bill.ID, contributor, 600)
+	small := contribute(t, db, bill.ID, contributor, 300)
+
+	ret := tcTransaction{
+		TransactionID: tcTxID{Hash: "return"},
+		InMsg:         tcMessage{Source: randomWallet()},
+		OutMsgs: []tcMessage{
+			{Destination: contributor, Value: "5"},
+			{Destination: contributor, Value: "310"},
+		},
+	}
+	for i := 0; i < 2; i++ { // the second pass is a rescan
+		loaded, err := db.GetBillWithTransactions(ctx, bill.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.reconcileOutgoing(ctx, loaded, ret, 77)
+	}
+
+	got, err := db.GetBill(ctx, bill.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Collected.Cmp(storage.NewAmount(600)) != 0 {
+		t.Fatalf("collected %s, want 600", got.Collected)
+	}
+	if tx, _ := db.GetTransaction(ctx, small.ID); tx.Status != storage.StatusReturned {
+		t.Fatalf("300 contribution is %s, want RETURNED", tx.Status)
+	}
+	if tx, _ := db.GetTransaction(ctx, big.ID); tx.Status != storage.StatusSuccess {
+		t.Fatalf("600 contribution is %s, want SUCCESS", tx.Status)
+	}
+	// 900 in, 300 returned, 5 and the 10 over the contribution refunded
+	if balance, _ := db.AccountBalance(ctx, storage.EscrowAccount(bill.ID)); balance.Cmp(storage.NewAmount(585)) != 0 {
+		t.Fatalf("escrow holds %s, want 585", balance)
+	}
+}
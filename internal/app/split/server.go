@@ -3,16 +3,20 @@ package split
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Hackathon-Apps/go-split-api/internal/app/chain"
 	"github.com/Hackathon-Apps/go-split-api/internal/app/config"
 	"github.com/Hackathon-Apps/go-split-api/internal/app/storage"
+	"github.com/Hackathon-Apps/go-split-api/internal/app/telegram"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
@@ -21,9 +25,11 @@ import (
 )
 
 const (
-	WsURL                       = "wss://tonapi.io/v2/websocket"
-	TonCenterGetTransactionsURL = "https://toncenter.com/api/v2/getTransactions"
-	billAutoTimeoutTTL          = 10 * time.Minute
+	WsURL              = "wss://tonapi.io/v2/websocket"
+	billAutoTimeoutTTL = 10 * time.Minute
+	txWatchTTL         = 10 * time.Minute
+	// version conflicts tolerated before the auto-timeout is retried later
+	billAutoTimeoutAttempts = 5
 )
 
 var feeCollectorAddr string
@@ -31,32 +37,90 @@ var feeCollectorAddr string
 type Server struct {
 	configuration *config.Configuration
 	logger        *logrus.Logger
+	instanceID    string
 	router        *mux.Router
-	db            *storage.Storage
+	db            storage.Repository
+	bus           storage.EventBus // nil unless events fan out through the database
 	tonApiClient  *ton.APIClient
 
 	ws        *WsHub
 	tonStream *chain.TonStream
+	tonCenter *chain.TonCenterClient
+	finality  *chain.Finality
+
+	wsTokenKey []byte
+
+	// nil when Telegram notifications are off
+	telegram *telegram.Client
+	notifyCh chan notification
+
+	indexMu  sync.Mutex
+	indexers map[uuid.UUID]struct{}
+
+	watchMu  sync.Mutex
+	watchers map[uuid.UUID]context.CancelFunc
 }
 
-func NewServer(configuration *config.Configuration, log *logrus.Logger, db *storage.Storage, api *ton.APIClient) *Server {
+func NewServer(configuration *config.Configuration, log *logrus.Logger, db storage.Repository, api *ton.APIClient) *Server {
 	ts := chain.NewTonStream(log, WsURL, configuration.TonApiToken)
+	tc := chain.NewTonCenterClient(log, chain.TonCenterOptions{
+		BaseURL:    configuration.TonCenterURL,
+		APIKey:     configuration.TonCenterApiKey,
+		RPS:        configuration.TonCenterRPS,
+		MaxRetries: configuration.TonCenterMaxRetries,
+	})
+	hub := NewWSHub(WsHubOptions{
+		AllowedOrigins:        configuration.WsAllowedOrigins,
+		MaxConnsPerIP:         configuration.WsMaxConnsPerIP,
+		MaxSubscribersPerBill: configuration.WsMaxSubscribersPerBill,
+	})
+	var tg *telegram.Client
+	if configuration.TelegramBotToken != "" {
+		tg = telegram.NewClient(configuration.TelegramAPIURL, configuration.TelegramBotToken)
+	}
+	var bus storage.EventBus
+	if configuration.EventFanout == fanoutPostgres {
+		if b, ok := db.(storage.EventBus); ok {
+			bus = b
+		} else {
+			log.Warn("fanout: storage has no event bus, delivery stays local")
+		}
+	}
 	feeCollectorAddr = configuration.FeeCollectorAddress
 
 	return &Server{
 		configuration: configuration,
 		logger:        log,
+		instanceID:    uuid.NewString(),
 		router:        mux.NewRouter(),
 		db:            db,
+		bus:           bus,
 		tonApiClient:  api,
 		tonStream:     ts,
-		ws:            NewWSHub(),
+		tonCenter:     tc,
+		finality:      chain.NewFinality(api),
+		ws:            hub,
+		wsTokenKey:    wsTokenKey(configuration.WsTokenSecret, log),
+		telegram:      tg,
+		notifyCh:      make(chan notification, notifyQueueSize),
+		indexers:      make(map[uuid.UUID]struct{}),
+		watchers:      make(map[uuid.UUID]context.CancelFunc),
 	}
 }
 
 func (s *Server) Start() error {
 	s.configureRouter()
 	go s.bootstrapBillAutoTimeouts()
+	go s.bootstrapBillIndexers()
+	go s.bootstrapWatchJobs()
+	go s.runFinality()
+	go s.runIdempotencyJanitor()
+	go s.runEventPruner()
+	go s.runLedgerChecker()
+	go s.runFanout()
+	go s.runWebhookDispatcher()
+	go s.runNotifier()
+	go s.serveMetrics()
 
 	s.logger.WithField("addr", s.configuration.BindAddress).Info("http: starting")
 	handler := corsMiddleware(s.router)
@@ -70,18 +134,53 @@ func (s *Server) Start() error {
 	return http.ListenAndServe(s.configuration.BindAddress, handler)
 }
 
+// serveMetrics serves expvar on metrics_bind_address, apart from the public
+// API: it exposes the command line and memory stats.
+func (s *Server) serveMetrics() {
+	addr := s.configuration.MetricsBindAddress
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /debug/vars", expvar.Handler())
+
+	s.logger.WithField("addr", addr).Info("http: metrics starting")
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		s.logger.WithError(err).Error("http: metrics listener stopped")
+	}
+}
+
 func (s *Server) configureRouter() {
 	s.router.HandleFunc("/api/healthz", s.handleHealthz()).Methods(http.MethodGet)
 
 	s.router.HandleFunc("/api/history", s.handleHistory()).Methods(http.MethodGet)
-	s.router.HandleFunc("/api/bills", s.handleCreateBill()).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/bills", s.idempotent(s.handleCreateBill())).Methods(http.MethodPost)
 	s.router.HandleFunc("/api/bills/{id}", s.handleGetBill()).Methods(http.MethodGet)
 	s.router.HandleFunc("/api/bills/{id}/refund", s.handleRefundBill()).Methods(http.MethodPost)
 	s.router.HandleFunc("/api/bills/{id}/cancel", s.handleCancelBill()).Methods(http.MethodPost)
 
-	s.router.HandleFunc("/api/bills/{id}/transactions", s.handleCreateTransaction()).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/bills/{id}/transactions", s.idempotent(s.handleCreateTransaction())).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/bills/{id}/transactions", s.handleListTransactions()).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/bills/{id}/transactions/{txId}", s.handleCancelTransaction()).Methods(http.MethodDelete)
+	s.router.HandleFunc("/api/bills/{id}/ledger", s.handleBillLedger()).Methods(http.MethodGet)
 
 	s.router.HandleFunc("/api/bills/{id}/ws", s.handleBillWS()).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/bills/{id}/events", s.handleBillEvents()).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/bills/{id}/ws-token", s.handleIssueWsToken()).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/ws", s.handleUserWS()).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/ws-token", s.handleIssueWsToken()).Methods(http.MethodPost)
+
+	s.router.HandleFunc("/api/auth/ton-proof", s.handleTonProofPayload()).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/auth/ton-proof", s.handleWalletAuth()).Methods(http.MethodPost)
+
+	s.router.HandleFunc("/api/notifications/telegram/link", s.handleTelegramLink()).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/telegram/updates", s.handleTelegramUpdate()).Methods(http.MethodPost)
+
+	s.router.HandleFunc("/api/webhooks", s.handleCreateWebhook()).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/webhooks", s.handleListWebhooks()).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/webhooks/{webhookId}", s.handleDeleteWebhook()).Methods(http.MethodDelete)
+	s.router.HandleFunc("/api/webhooks/{webhookId}/deliveries", s.handleListWebhookDeliveries()).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/webhooks/{webhookId}/deliveries/{deliveryId}/redeliver", s.handleRedeliverWebhook()).Methods(http.MethodPost)
 }
 
 func (s *Server) handleBillWS() http.HandlerFunc {
@@ -97,16 +196,29 @@ func (s *Server) handleBillWS() http.HandlerFunc {
 			"remote":  r.RemoteAddr,
 		}).Info("ws: subscribe request")
 
-		s.ws.subscribe(billID.String(), w, r)
+		if !s.authorizeBillStream(w, r, billID) {
+			return
+		}
+
+		var since *uint64
+		if v := r.URL.Query().Get("since"); v != "" {
+			seq, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				renderErr(w, http.StatusBadRequest, "invalid since")
+				return
+			}
+			since = &seq
+		}
 
 		ctx := r.Context()
-		bill, err := s.db.GetBillWithSuccessTransactions(ctx, billID)
-		if err == nil {
-			s.ws.broadcastBill(billID.String(), bill)
-			s.logger.WithField("bill_id", billID.String()).Debug("ws: initial snapshot sent")
-		} else {
-			s.logger.WithError(err).WithField("bill_id", billID.String()).Warn("ws: failed to fetch initial snapshot")
+		err = s.ws.subscribe(billID.String(), w, r, s.clientIP(r), func() ([]wsEnvelope, error) {
+			return s.wsBacklog(ctx, billID, since)
+		})
+		if err != nil {
+			s.logger.WithError(err).WithField("bill_id", billID.String()).Warn("ws: subscribe failed")
+			return
 		}
+		s.logger.WithField("bill_id", billID.String()).Debug("ws: backlog sent")
 	}
 }
 
@@ -124,8 +236,12 @@ func (s *Server) handleCreateBill() http.HandlerFunc {
 			return
 		}
 		goal := req.Goal
-		if goal <= 0 {
-			renderErr(w, http.StatusBadRequest, "goal must be positive int64 (nanoton)")
+		if goal.Sign() <= 0 {
+			renderErr(w, http.StatusBadRequest, "goal must be a positive amount (nanoton or decimal TON)")
+			return
+		}
+		if goal.BigInt().Cmp(chain.MaxCoins) > 0 {
+			renderErr(w, http.StatusBadRequest, "goal must be below 2^120 nanoton")
 			return
 		}
 		destinationAddr := req.DestinationAddress
@@ -133,6 +249,10 @@ func (s *Server) handleCreateBill() http.HandlerFunc {
 			renderErr(w, http.StatusBadRequest, "addresses is required")
 			return
 		}
+		if _, err := address.ParseAddr(destinationAddr); err != nil {
+			renderErr(w, http.StatusBadRequest, "invalid destination_address: "+err.Error())
+			return
+		}
 
 		ctx := r.Context()
 		creator, err := s.walletFromHeader(r)
@@ -141,13 +261,19 @@ func (s *Server) handleCreateBill() http.HandlerFunc {
 			return
 		}
 
-		proxyWalletInfo, err := chain.GenerateContractInfo(s.configuration.SmartContractHex, destinationAddr, creator, feeCollectorAddr, req.Goal)
+		keyID, err := s.apiKeyFromRequest(r)
+		if err != nil {
+			renderErr(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		proxyWalletInfo, err := chain.GenerateContractInfo(s.configuration.SmartContractHex, destinationAddr, creator, feeCollectorAddr, goal.BigInt())
 		if err != nil {
 			renderErr(w, http.StatusInternalServerError, "failed to generate TON address: "+err.Error())
 			return
 		}
 
-		bill, err := s.db.CreateBill(ctx, goal, creator, destinationAddr, proxyWalletInfo.TonAddress, proxyWalletInfo.StateInitHash)
+		bill, err := s.db.CreateBill(ctx, goal, creator, destinationAddr, proxyWalletInfo.TonAddress, proxyWalletInfo.StateInitHash, keyID)
 		if err != nil {
 			renderErr(w, http.StatusInternalServerError, err.Error())
 			return
@@ -161,6 +287,8 @@ func (s *Server) handleCreateBill() http.HandlerFunc {
 		}).Info("bill: created")
 
 		s.scheduleBillAutoTimeoutAfter(bill.ID, billAutoTimeoutTTL)
+		s.startBillIndexer(bill.ID, bill.ProxyWallet)
+		s.ws.follow(creator, bill.ID.String())
 
 		resp := billResponse{
 			ID:                 bill.ID,
@@ -195,6 +323,7 @@ func (s *Server) handleGetBill() http.HandlerFunc {
 			return
 		}
 
+		w.Header().Set("ETag", billETag(bill))
 		renderJSON(w, bill)
 	}
 }
@@ -224,14 +353,25 @@ func (s *Server) handleCancelBill() http.HandlerFunc {
 			renderErr(w, http.StatusUnauthorized, "not your bill")
 			return
 		}
+		if !ifMatch(r, bill) {
+			renderBillChanged(w, r)
+			return
+		}
 
-		err = s.db.UpdateBillStatus(ctx, bill.ID, storage.StatusDone)
+		updated, err := s.db.UpdateBillStatus(ctx, bill.ID, storage.StatusDone, bill.Version)
+		if errors.Is(err, storage.ErrBillVersionConflict) {
+			renderBillChanged(w, r)
+			return
+		}
 		if err != nil {
 			renderErr(w, http.StatusInternalServerError, "unable to cancel bill")
 			return
 		}
+		s.publishBillStatus(ctx, bill.ID, bill.Status)
 
-		renderJSON(w, bill)
+		updated.Transactions = bill.Transactions
+		w.Header().Set("ETag", billETag(updated))
+		renderJSON(w, updated)
 	}
 }
 
@@ -260,13 +400,23 @@ func (s *Server) handleRefundBill() http.HandlerFunc {
 			renderErr(w, http.StatusBadRequest, "Refund error: creator addresses mismatch")
 			return
 		}
+		if !ifMatch(r, bill) {
+			renderBillChanged(w, r)
+			return
+		}
 
-		if err = s.db.UpdateBillStatus(ctx, bill.ID, storage.StatusRefunded); err != nil {
+		updated, err := s.db.UpdateBillStatus(ctx, bill.ID, storage.StatusRefunded, bill.Version)
+		if errors.Is(err, storage.ErrBillVersionConflict) {
+			renderBillChanged(w, r)
+			return
+		}
+		if err != nil {
 			renderErr(w, http.StatusNotFound, err.Error())
 			return
 		}
-		s.ws.broadcastBill(bill.ID.String(), bill)
+		s.publishBillStatus(ctx, bill.ID, bill.Status)
 
+		w.Header().Set("ETag", billETag(updated))
 		renderJSON(w, "ok")
 	}
 }
@@ -286,13 +436,13 @@ func (s *Server) handleCreateTransaction() http.HandlerFunc {
 		}
 
 		sender, err := s.walletFromHeader(r)
-		if req.Amount == "" || sender == "" || req.OpType == "" {
+		if req.Amount.IsZero() || sender == "" || req.OpType == "" {
 			renderErr(w, http.StatusBadRequest, "amount, sender_address and op_type are required")
 			return
 		}
-		amount, err := parseInt64(req.Amount)
-		if err != nil || amount <= 0 {
-			renderErr(w, http.StatusBadRequest, "amount must be positive int64 (nanoton)")
+		amount := req.Amount
+		if amount.Sign() <= 0 {
+			renderErr(w, http.StatusBadRequest, "amount must be a positive amount (nanoton or decimal TON)")
 			return
 		}
 		op, err := parseOpType(req.OpType)
@@ -315,6 +465,11 @@ func (s *Server) handleCreateTransaction() http.HandlerFunc {
 			"op":      op,
 		}).Info("tx: created (PENDING)")
 
+		if _, err := s.db.CreateWatchJob(ctx, tx.ID, billID, tx.CreatedAt.Add(txWatchTTL)); err != nil {
+			s.logger.WithError(err).WithField("tx_id", tx.ID.String()).Warn("watch: persist job failed")
+		}
+
+		s.publishTx(ctx, *tx)
 		go s.ensureBillSubscriptionAndWatch(billID, tx.ID)
 
 		w.WriteHeader(http.StatusCreated)
@@ -327,6 +482,103 @@ func (s *Server) handleCreateTransaction() http.HandlerFunc {
 	}
 }
 
+func (s *Server) handleListTransactions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		billID, err := uuidFromVars(mux.Vars(r), "id")
+		if err != nil {
+			renderErr(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		q := r.URL.Query()
+		filter := storage.TxFilter{Sender: strings.TrimSpace(q.Get("sender"))}
+		if v := q.Get("status"); v != "" {
+			if filter.Status, err = parseTxStatus(v); err != nil {
+				renderErr(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		if v := q.Get("op"); v != "" {
+			if filter.OpType, err = parseOpType(v); err != nil {
+				renderErr(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+
+		// sender wallets and amounts are for the bill's participants
+		if _, ok := s.billForParticipant(w, r, billID); !ok {
+			return
+		}
+
+		txs, err := s.db.ListTransactions(r.Context(), billID, filter)
+		if err != nil {
+			renderErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		renderJSON(w, txs)
+	}
+}
+
+func (s *Server) handleCancelTransaction() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		billID, err := uuidFromVars(vars, "id")
+		if err != nil {
+			renderErr(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		txID, err := uuidFromVars(vars, "txId")
+		if err != nil {
+			renderErr(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		sender, err := s.walletFromHeader(r)
+		if err != nil {
+			renderErr(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		ctx := r.Context()
+		tx, err := s.db.GetTransaction(ctx, txID)
+		if err != nil || tx.BillID != billID {
+			renderErr(w, http.StatusNotFound, "transaction not found")
+			return
+		}
+
+		tx, err = s.db.CancelTransaction(ctx, txID, sender)
+		switch {
+		case errors.Is(err, storage.ErrTxNotOwned):
+			renderErr(w, http.StatusUnauthorized, "not your transaction")
+			return
+		case errors.Is(err, storage.ErrTxNotPending):
+			renderErr(w, http.StatusConflict, "transaction is not pending")
+			return
+		case err != nil:
+			renderErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if !s.stopWatch(txID) {
+			// nothing running on this instance, drop the job so no one resumes it
+			if err := s.db.DeleteWatchJob(ctx, txID); err != nil {
+				s.logger.WithError(err).WithField("tx_id", txID.String()).Warn("watch: delete job failed")
+			}
+		}
+
+		s.logger.WithFields(logrus.Fields{
+			"bill_id": billID.String(),
+			"tx_id":   txID.String(),
+			"sender":  sender,
+		}).Info("tx: cancelled by sender")
+
+		s.publishTx(ctx, *tx)
+
+		renderJSON(w, tx)
+	}
+}
+
 func (s *Server) handleHistory() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		sender, err := s.walletFromHeader(r)
@@ -364,11 +616,27 @@ func (s *Server) ensureBillSubscriptionAndWatch(billID uuid.UUID, txID uuid.UUID
 		return
 	}
 
+	job, err := s.db.GetWatchJob(context.Background(), txID)
+	if err != nil {
+		job, err = s.db.CreateWatchJob(context.Background(), txID, billID, pendingTx.CreatedAt.Add(txWatchTTL))
+		if err != nil {
+			s.logger.WithError(err).WithField("tx_id", txID.String()).Warn("watch: persist job failed")
+			return
+		}
+	}
+
 	addr := bill.ProxyWallet
 	if addr == "" {
 		s.logger.Warn("empty proxy wallet address")
 		return
 	}
+
+	watchCtx, ok := s.startWatch(txID)
+	if !ok {
+		s.logger.WithField("tx_id", txID.String()).Debug("watch: already running")
+		return
+	}
+
 	rawAddr := address.MustParseAddr(addr).StringRaw()
 	eventCh, cancel := s.tonStream.RegisterListener(rawAddr)
 
@@ -380,6 +648,7 @@ func (s *Server) ensureBillSubscriptionAndWatch(billID uuid.UUID, txID uuid.UUID
 
 	if err := s.tonStream.Subscribe(addr); err != nil {
 		cancel()
+		s.endWatch(txID)
 		s.logger.WithError(err).Warn("ton stream subscribe failed")
 		return
 	}
@@ -389,29 +658,50 @@ func (s *Server) ensureBillSubscriptionAndWatch(billID uuid.UUID, txID uuid.UUID
 		"address": addr,
 	}).Info("tonstream: subscribed")
 
-	go s.listenForTxAndFinalize(bill, *pendingTx, addr, eventCh, cancel)
+	go s.listenForTxAndFinalize(watchCtx, bill, *pendingTx, job, addr, eventCh, cancel)
 }
 
-func (s *Server) listenForTxAndFinalize(bill *storage.Bill, pending storage.Transaction, proxyAddr string, eventCh <-chan chain.TonEvent, cancel func()) {
-	timeout := time.NewTimer(10 * time.Minute)
+func (s *Server) listenForTxAndFinalize(ctx context.Context, bill *storage.Bill, pending storage.Transaction, job *storage.WatchJob, proxyAddr string, eventCh <-chan chain.TonEvent, cancel func()) {
+	timeout := time.NewTimer(time.Until(job.Deadline))
 	defer timeout.Stop()
 
 	pollTicker := time.NewTicker(3 * time.Second)
 	defer pollTicker.Stop()
 
 	s.logger.WithFields(logrus.Fields{
-		"bill_id": bill.ID.String(),
-		"tx_id":   pending.ID.String(),
-		"address": proxyAddr,
+		"bill_id":  bill.ID.String(),
+		"tx_id":    pending.ID.String(),
+		"address":  proxyAddr,
+		"attempts": job.Attempts,
+		"last_lt":  job.LastLT,
+		"deadline": job.Deadline,
 	}).Info("watch: started")
+	defer s.endWatch(pending.ID)
 	defer cancel()
+	defer func() {
+		if err := s.db.DeleteWatchJob(context.Background(), pending.ID); err != nil {
+			s.logger.WithError(err).WithField("tx_id", pending.ID.String()).Warn("watch: delete job failed")
+		}
+	}()
 
 	rawAddr := address.MustParseAddr(proxyAddr).StringRaw()
 	curEvCh := eventCh
 	curCancel := cancel
+	defer func() {
+		if curCancel != nil {
+			curCancel()
+		}
+	}()
 
 	for {
 		select {
+		case <-ctx.Done():
+			s.logger.WithFields(logrus.Fields{
+				"bill_id": bill.ID.String(),
+				"tx_id":   pending.ID.String(),
+			}).Info("watch: stopped")
+			return
+
 		case ev, ok := <-curEvCh:
 			if !ok {
 				s.logger.WithFields(logrus.Fields{
@@ -446,27 +736,22 @@ func (s *Server) listenForTxAndFinalize(bill *storage.Bill, pending storage.Tran
 			}
 
 			if d.Matched && !d.Bounced {
-				if err := s.db.UpdateTransaction(context.Background(), pending.ID, storage.StatusSuccess); err != nil {
-					s.logger.WithError(err).Warn("update tx status confirmed failed")
-				}
-				if err := s.db.IncreaseBillCollected(context.Background(), bill.ID, d.Amount); err != nil {
-					s.logger.WithError(err).Warn("increase bill collected failed")
+				if !s.confirmMatched(bill, pending, d) {
+					continue
 				}
 				s.logger.WithFields(logrus.Fields{
 					"bill_id": bill.ID.String(),
 					"tx_id":   pending.ID.String(),
 					"lt":      d.LT,
+					"tx_hash": d.Hash,
 					"amount":  d.Amount,
 					"from":    d.From,
 					"to":      d.To,
-				}).Info("tx: matched -> SUCCESS")
-			} else if d.Bounced {
-				_ = s.db.UpdateTransaction(context.Background(), pending.ID, storage.StatusFailed)
-				s.logger.WithFields(logrus.Fields{
-					"bill_id": bill.ID.String(),
-					"tx_id":   pending.ID.String(),
-					"lt":      d.LT,
-				}).Info("tx: bounced -> FAILED")
+				}).Info("tx: matched -> CONFIRMING")
+			} else if d.Matched && d.Bounced {
+				if !s.bounceMatched(bill, pending, d) {
+					continue
+				}
 			} else {
 				s.logger.WithFields(logrus.Fields{
 					"bill_id": bill.ID.String(),
@@ -474,49 +759,130 @@ func (s *Server) listenForTxAndFinalize(bill *storage.Bill, pending storage.Tran
 				}).Debug("watch: event not our tx, continue")
 				continue
 			}
-
-			if updated, err := s.db.GetBillWithTransactions(context.Background(), bill.ID); err == nil {
-				s.ws.broadcastBill(bill.ID.String(), updated)
-				s.logger.WithField("bill_id", bill.ID.String()).Debug("ws: broadcast after update")
-			}
 			return
 
 		case <-pollTicker.C:
-			d, err := s.fetchAndMatchAny(pending, bill)
-			if err == nil && d.Matched && !d.Bounced {
-				if err := s.db.UpdateTransaction(context.Background(), pending.ID, storage.StatusSuccess); err != nil {
-					s.logger.WithError(err).Warn("update tx status confirmed failed (polling)")
-				}
-				if err := s.db.IncreaseBillCollected(context.Background(), bill.ID, d.Amount); err != nil {
-					s.logger.WithError(err).Warn("increase bill collected failed (polling)")
-				}
+			d, lastLT, err := s.fetchAndMatchAny(pending, bill, job.LastLT)
+			job.Attempts++
+			if lastLT > job.LastLT {
+				job.LastLT = lastLT
+			}
+			if err := s.db.UpdateWatchJobProgress(context.Background(), pending.ID, job.Attempts, job.LastLT); err != nil {
+				s.logger.WithError(err).WithField("tx_id", pending.ID.String()).Warn("watch: persist progress failed")
+			}
+			if err == nil && d.Matched && d.Bounced && s.bounceMatched(bill, pending, d) {
+				return
+			}
+			if err == nil && d.Matched && !d.Bounced && s.confirmMatched(bill, pending, d) {
 				s.logger.WithFields(logrus.Fields{
 					"bill_id": bill.ID.String(),
 					"tx_id":   pending.ID.String(),
 					"lt":      d.LT,
+					"tx_hash": d.Hash,
 					"amount":  d.Amount,
-				}).Info("tx: matched via polling -> SUCCESS")
-
-				if updated, err := s.db.GetBillWithTransactions(context.Background(), bill.ID); err == nil {
-					s.ws.broadcastBill(bill.ID.String(), updated)
-				}
+				}).Info("tx: matched via polling -> CONFIRMING")
 				return
 			}
 
 		case <-timeout.C:
-			_ = s.db.UpdateTransaction(context.Background(), pending.ID, storage.StatusFailed)
-			if updated, err := s.db.GetBillWithTransactions(context.Background(), bill.ID); err == nil {
-				s.ws.broadcastBill(bill.ID.String(), updated)
+			if ctx.Err() != nil {
+				return
 			}
-			s.logger.WithFields(logrus.Fields{
+			fields := logrus.Fields{
 				"bill_id": bill.ID.String(),
 				"tx_id":   pending.ID.String(),
-			}).Warn("watch: timeout -> FAILED")
+			}
+			err := s.db.FailTransaction(context.Background(), pending.ID)
+			switch {
+			case errors.Is(err, storage.ErrTxNotPending):
+				s.logger.WithFields(fields).Info("watch: timeout, tx no longer pending")
+			case err != nil:
+				s.logger.WithError(err).WithFields(fields).Warn("watch: fail tx failed")
+			default:
+				s.publishTxByID(context.Background(), pending.ID)
+				s.logger.WithFields(fields).Warn("watch: timeout -> FAILED")
+			}
 			return
 		}
 	}
 }
 
+// confirmMatched binds the matched chain transaction to the pending tx, which
+// then waits in CONFIRMING for finality. It returns false when that chain
+// transaction already backs another contribution, so the watcher keeps looking.
+func (s *Server) confirmMatched(bill *storage.Bill, pending storage.Transaction, d OnChainTx) bool {
+	ctx := context.Background()
+	err := s.db.ConfirmTransaction(ctx, pending.ID, storage.ChainRef{Hash: d.Hash, LT: d.LT, Amount: d.Amount})
+	switch {
+	case errors.Is(err, storage.ErrChainTxReused):
+		s.logger.WithFields(logrus.Fields{
+			"bill_id": bill.ID.String(),
+			"tx_id":   pending.ID.String(),
+			"lt":      d.LT,
+		}).Debug("watch: chain tx already used, continue")
+		return false
+	case errors.Is(err, storage.ErrTxNotPending):
+		s.logger.WithField("tx_id", pending.ID.String()).Info("watch: tx no longer pending, stop")
+		return true
+	case err != nil:
+		s.logger.WithError(err).Warn("update tx status confirmed failed")
+		return false
+	}
+
+	tx, err := s.db.GetTransaction(ctx, pending.ID)
+	if err != nil {
+		s.logger.WithError(err).WithField("tx_id", pending.ID.String()).Warn("watch: reload confirmed tx failed")
+		return true
+	}
+	if s.configuration.FinalityDepth <= 0 {
+		s.finalizeTransaction(ctx, *tx)
+		return true
+	}
+	s.publishTx(ctx, *tx)
+	return true
+}
+
+// bounceMatched closes the pending tx whose chain transaction was rejected by
+// the proxy and bounced back to the sender.
+func (s *Server) bounceMatched(bill *storage.Bill, pending storage.Transaction, d OnChainTx) bool {
+	err := s.db.BounceTransaction(context.Background(), pending.ID, storage.ChainRef{Hash: d.Hash, LT: d.LT, Amount: d.Amount})
+	switch {
+	case errors.Is(err, storage.ErrChainTxReused):
+		return false
+	case errors.Is(err, storage.ErrTxNotPending):
+		return true
+	case err != nil:
+		s.logger.WithError(err).Warn("update tx status bounced failed")
+		return false
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"bill_id": bill.ID.String(),
+		"tx_id":   pending.ID.String(),
+		"lt":      d.LT,
+		"tx_hash": d.Hash,
+	}).Info("tx: bounced by proxy -> BOUNCED")
+	s.publishTxByID(context.Background(), pending.ID)
+	return true
+}
+
+func (s *Server) bootstrapWatchJobs() {
+	ctx := context.Background()
+	pending, err := s.db.ListTransactionsByStatus(ctx, storage.StatusPending)
+	if err != nil {
+		s.logger.WithError(err).Warn("watch: bootstrap failed")
+		return
+	}
+
+	for _, tx := range pending {
+		s.logger.WithFields(logrus.Fields{
+			"bill_id": tx.BillID.String(),
+			"tx_id":   tx.ID.String(),
+		}).Info("watch: resuming pending tx")
+		go s.ensureBillSubscriptionAndWatch(tx.BillID, tx.ID)
+	}
+}
+
 func (s *Server) bootstrapBillAutoTimeouts() {
 	ctx := context.Background()
 	bills, err := s.db.ListBillsByStatus(ctx, storage.StatusActive)
@@ -551,6 +917,13 @@ func (s *Server) scheduleBillAutoTimeoutAfter(billID uuid.UUID, delay time.Durat
 		timer := time.NewTimer(d)
 		defer timer.Stop()
 
+		if s.notifierEnabled() && d > billTimeoutWarning {
+			warn := time.NewTimer(d - billTimeoutWarning)
+			defer warn.Stop()
+			<-warn.C
+			s.notifyTimeoutSoon(id)
+		}
+
 		<-timer.C
 		s.autoTimeoutBill(id)
 	}(billID, delay)
@@ -558,50 +931,67 @@ func (s *Server) scheduleBillAutoTimeoutAfter(billID uuid.UUID, delay time.Durat
 
 func (s *Server) autoTimeoutBill(billID uuid.UUID) {
 	ctx := context.Background()
-	bill, err := s.db.GetBillWithTransactions(ctx, billID)
-	if err != nil {
-		s.logger.WithError(err).WithField("bill_id", billID.String()).Warn("bill: auto-timeout fetch failed")
-		return
-	}
+	// a version conflict means a contribution or the creator got there
+	// first, decide again on the fresh bill
+	for attempt := 1; attempt <= billAutoTimeoutAttempts; attempt++ {
+		bill, err := s.db.GetBillWithTransactions(ctx, billID)
+		if err != nil {
+			s.logger.WithError(err).WithField("bill_id", billID.String()).Warn("bill: auto-timeout fetch failed")
+			return
+		}
 
-	if bill.Status == storage.StatusDone || bill.Status == storage.StatusTimeout {
-		s.logger.WithField("bill_id", billID.String()).Debug("bill: auto-timeout skip (already finalized)")
-		return
-	}
+		// only an active bill times out; done, refunded and timed out ones
+		// are final
+		if bill.Status != storage.StatusActive {
+			s.logger.WithFields(logrus.Fields{
+				"bill_id": billID.String(),
+				"status":  bill.Status,
+			}).Debug("bill: auto-timeout skip (already finalized)")
+			return
+		}
 
-	if !bill.CreatedAt.IsZero() && time.Since(bill.CreatedAt) < billAutoTimeoutTTL {
-		delay := billAutoTimeoutTTL - time.Since(bill.CreatedAt)
-		s.logger.WithFields(logrus.Fields{
-			"bill_id":  billID.String(),
-			"retry_in": delay,
-		}).Debug("bill: auto-timeout rescheduled (deadline not reached)")
-		s.scheduleBillAutoTimeoutAfter(billID, delay)
-		return
-	}
+		if !bill.CreatedAt.IsZero() && time.Since(bill.CreatedAt) < billAutoTimeoutTTL {
+			delay := billAutoTimeoutTTL - time.Since(bill.CreatedAt)
+			s.logger.WithFields(logrus.Fields{
+				"bill_id":  billID.String(),
+				"retry_in": delay,
+			}).Debug("bill: auto-timeout rescheduled (deadline not reached)")
+			s.scheduleBillAutoTimeoutAfter(billID, delay)
+			return
+		}
 
-	if bill.Collected >= bill.Goal {
-		s.logger.WithField("bill_id", billID.String()).Debug("bill: auto-timeout skip (goal met)")
-		return
-	}
+		if bill.Collected.Cmp(bill.Goal) >= 0 {
+			s.logger.WithField("bill_id", billID.String()).Debug("bill: auto-timeout skip (goal met)")
+			return
+		}
 
-	if err = s.db.UpdateBillStatus(ctx, bill.ID, storage.StatusTimeout); err != nil {
-		s.logger.WithError(err).WithField("bill_id", bill.ID.String()).Warn("bill: auto-timeout update failed")
-		return
-	}
+		_, err = s.db.UpdateBillStatus(ctx, bill.ID, storage.StatusTimeout, bill.Version)
+		if errors.Is(err, storage.ErrBillVersionConflict) {
+			s.logger.WithFields(logrus.Fields{
+				"bill_id": bill.ID.String(),
+				"attempt": attempt,
+			}).Debug("bill: auto-timeout raced another write, re-checking")
+			continue
+		}
+		if err != nil {
+			s.logger.WithError(err).WithField("bill_id", bill.ID.String()).Warn("bill: auto-timeout update failed")
+			return
+		}
 
-	s.logger.WithFields(logrus.Fields{
-		"bill_id": bill.ID.String(),
-		"status":  bill.Status,
-	}).Info("bill: auto-timeout status applied")
+		s.logger.WithFields(logrus.Fields{
+			"bill_id": bill.ID.String(),
+			"status":  bill.Status,
+		}).Info("bill: auto-timeout status applied")
 
-	s.ws.broadcastBill(billID.String(), bill)
-}
+		s.publishBillStatus(ctx, billID, bill.Status)
+		return
+	}
 
-func (s *Server) httpClient() *http.Client {
-	return &http.Client{Timeout: 7 * time.Second}
+	s.logger.WithField("bill_id", billID.String()).Warn("bill: auto-timeout kept conflicting, retrying in a minute")
+	s.scheduleBillAutoTimeoutAfter(billID, time.Minute)
 }
 
-func (s *Server) tonCenterGetTransactions(address string, limit int) (*tcGetTxResp, error) {
+func (s *Server) tonCenterGetTransactions(address string, limit int, lt uint64, hash string) (*tcGetTxResp, error) {
 	start := time.Now()
 	q := url.Values{}
 	q.Set("address", address)
@@ -609,50 +999,31 @@ func (s *Server) tonCenterGetTransactions(address string, limit int) (*tcGetTxRe
 		limit = 20
 	}
 	q.Set("limit", strconv.Itoa(limit))
-
-	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, TonCenterGetTransactionsURL+"?"+q.Encode(), nil)
-	if err != nil {
-		return nil, err
-	}
-
-	if key := strings.TrimSpace(s.configuration.TonCenterApiKey); key != "" {
-		req.Header.Set("X-API-Key", key)
+	if lt > 0 && hash != "" {
+		q.Set("lt", strconv.FormatUint(lt, 10))
+		q.Set("hash", hash)
+		q.Set("archival", "true")
 	}
-	req.Header.Set("Accept", "application/json")
-
-	resp, err := s.httpClient().Do(req)
-	if err != nil {
-		s.logger.WithError(err).WithFields(logrus.Fields{
-			"address": address,
-			"limit":   limit,
-			"ms":      time.Since(start).Milliseconds(),
-		}).Warn("toncenter: request failed")
-		return nil, err
-	}
-	defer resp.Body.Close()
 
 	var out tcGetTxResp
-	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+	if err := s.tonCenter.Call(context.Background(), "getTransactions", q, &out); err != nil {
 		s.logger.WithError(err).WithFields(logrus.Fields{
-			"status":  resp.StatusCode,
 			"address": address,
 			"limit":   limit,
+			"lt":      lt,
 			"ms":      time.Since(start).Milliseconds(),
-		}).Warn("toncenter: decode failed")
+		}).Warn("toncenter: getTransactions failed")
 		return nil, err
 	}
 
 	s.logger.WithFields(logrus.Fields{
-		"status":  resp.StatusCode,
 		"address": address,
 		"limit":   limit,
-		"ok":      out.Ok,
+		"lt":      lt,
+		"count":   len(out.Result),
 		"ms":      time.Since(start).Milliseconds(),
-	}).Info("toncenter: getTransactions")
+	}).Debug("toncenter: getTransactions")
 
-	if !out.Ok {
-		return nil, fmt.Errorf("toncenter getTransactions: ok=false")
-	}
 	return &out, nil
 }
 
@@ -668,23 +1039,33 @@ func (s *Server) fetchAndMatch(lt uint64, pending storage.Transaction, bill *sto
 		To:      bill.ProxyWallet,
 		Bounced: false,
 	}
-
-	pageLimit := 20
-	res, err := s.tonCenterGetTransactions(bill.ProxyWallet, pageLimit)
-	if err != nil {
-		return onChainTx, err
+	if lt == 0 {
+		return onChainTx, fmt.Errorf("empty event lt for address %s", bill.ProxyWallet)
 	}
 
-	for _, tx := range res.Result {
-		if tx.TransactionID.LT == strconv.FormatUint(lt, 10) {
-			amount, _ := strconv.ParseInt(tx.InMsg.Value, 10, 64)
+	it := s.iterateTransactions(bill.ProxyWallet, txLowerBound{LT: lt - 1, Since: bill.CreatedAt})
+	for {
+		tx, txLT, ok := it.Next()
+		if !ok {
+			break
+		}
+		if txLT == lt {
+			amount, err := storage.ParseNano(tx.InMsg.Value)
+			if err != nil {
+				return onChainTx, fmt.Errorf("transaction %d: invalid in_msg value %q", lt, tx.InMsg.Value)
+			}
 
+			onChainTx.Hash = tx.TransactionID.Hash
 			onChainTx.Amount = amount
 			onChainTx.From = tx.InMsg.Source
 			onChainTx.To = tx.InMsg.Destination
-			onChainTx.Bounced = tx.InMsg.Bounce || tx.InMsg.Bounced
+			onChainTx.Bounced = depositBounced(tx)
 
-			onChainFromRaw := address.MustParseAddr(onChainTx.From).StringRaw()
+			onChainFrom, err := address.ParseAddr(onChainTx.From)
+			if err != nil {
+				return onChainTx, fmt.Errorf("transaction %d: no internal sender", lt)
+			}
+			onChainFromRaw := onChainFrom.StringRaw()
 			pendingFromRaw := address.MustParseAddr(pending.SenderAddress).StringRaw()
 
 			if onChainTx.To != bill.ProxyWallet {
@@ -695,13 +1076,13 @@ func (s *Server) fetchAndMatch(lt uint64, pending storage.Transaction, bill *sto
 				s.logger.Error("from_wallet mismatch. onChainTx.From:", onChainFromRaw, "pendingFromRaw:", pendingFromRaw)
 			}
 
-			if onChainTx.Amount != pending.Amount {
+			if onChainTx.Amount.Cmp(pending.Amount) != 0 {
 				s.logger.Error("amount mismatch. onChainTx.Amount:", onChainTx.Amount, "pending.Amount:", pending.Amount)
 			}
 
 			onChainTx.Matched = strings.EqualFold(onChainTx.To, bill.ProxyWallet) &&
 				strings.EqualFold(onChainFromRaw, pendingFromRaw) &&
-				onChainTx.Amount >= pending.Amount
+				onChainTx.Amount.Cmp(pending.Amount) >= 0
 
 			s.logger.WithFields(logrus.Fields{
 				"bill_id": bill.ID.String(),
@@ -717,51 +1098,70 @@ func (s *Server) fetchAndMatch(lt uint64, pending storage.Transaction, bill *sto
 		}
 	}
 
+	if err := it.Err(); err != nil {
+		return onChainTx, err
+	}
+
 	s.logger.WithFields(logrus.Fields{
 		"bill_id": bill.ID.String(),
 		"lt":      lt,
-	}).Warn("match: transaction not found in toncenter window")
+	}).Warn("match: transaction not found in account history")
 
 	return onChainTx, fmt.Errorf("transaction %d not found for address %s", lt, bill.ProxyWallet)
 }
 
-func (s *Server) fetchAndMatchAny(pending storage.Transaction, bill *storage.Bill) (OnChainTx, error) {
+// fetchAndMatchAny scans proxy transactions newer than afterLT and returns the
+// highest LT it has fully examined, so the caller can skip them next attempt.
+func (s *Server) fetchAndMatchAny(pending storage.Transaction, bill *storage.Bill, afterLT uint64) (OnChainTx, uint64, error) {
 	onChainTx := OnChainTx{
 		To:      bill.ProxyWallet,
 		Bounced: false,
 	}
 
-	res, err := s.tonCenterGetTransactions(bill.ProxyWallet, 30)
-	if err != nil {
-		return onChainTx, err
-	}
-
 	pendingFromRaw := address.MustParseAddr(pending.SenderAddress).StringRaw()
 	targetTo := strings.ToLower(bill.ProxyWallet)
 
-	for _, tx := range res.Result {
+	newestLT := afterLT
+	it := s.iterateTransactions(bill.ProxyWallet, txLowerBound{LT: afterLT, Since: bill.CreatedAt})
+	for {
+		tx, lt, ok := it.Next()
+		if !ok {
+			break
+		}
+		if lt > newestLT {
+			newestLT = lt
+		}
 		if !strings.EqualFold(strings.ToLower(tx.InMsg.Destination), targetTo) {
 			continue
 		}
-		onChainFromRaw := address.MustParseAddr(tx.InMsg.Source).StringRaw()
-		if !strings.EqualFold(onChainFromRaw, pendingFromRaw) {
+		onChainFrom, err := address.ParseAddr(tx.InMsg.Source)
+		if err != nil || !strings.EqualFold(onChainFrom.StringRaw(), pendingFromRaw) {
 			continue
 		}
-		if tx.InMsg.Bounce || tx.InMsg.Bounced {
+		// an inbound bounce is our own message coming back, not a deposit
+		if tx.InMsg.Bounced {
 			continue
 		}
-		amount, _ := strconv.ParseInt(tx.InMsg.Value, 10, 64)
-		if amount < pending.Amount {
+		amount, err := storage.ParseNano(tx.InMsg.Value)
+		if err != nil || amount.Cmp(pending.Amount) < 0 {
 			continue
 		}
 
-		lt, _ := strconv.ParseUint(tx.TransactionID.LT, 10, 64)
+		if used, err := s.db.ChainTxUsed(context.Background(), tx.TransactionID.Hash, lt); err != nil || used {
+			continue
+		}
 		onChainTx.LT = lt
+		onChainTx.Hash = tx.TransactionID.Hash
 		onChainTx.Amount = amount
 		onChainTx.From = tx.InMsg.Source
+		onChainTx.Bounced = depositBounced(tx)
 		onChainTx.Matched = true
-		return onChainTx, nil
+		return onChainTx, afterLT, nil
 	}
 
-	return onChainTx, fmt.Errorf("pending transaction not found for proxy %s", bill.ProxyWallet)
+	if err := it.Err(); err != nil {
+		// the gap down to afterLT is not covered yet, keep the old cursor
+		return onChainTx, afterLT, err
+	}
+	return onChainTx, newestLT, fmt.Errorf("pending transaction not found for proxy %s", bill.ProxyWallet)
 }
@@ -2,74 +2,471 @@ package split
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/xssnick/tonutils-go/address"
 )
 
+const (
+	// events a subscriber may lag behind before it is cut off; a full replay
+	// has to fit
+	sinkQueueSize = wsReplayLimit + 64
+
+	wsWriteWait  = 5 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = 25 * time.Second
+)
+
+var (
+	errSlowConsumer = errors.New("subscriber queue overflow")
+	errTooManyConns = errors.New("too many connections from this address")
+	errBillFull     = errors.New("too many subscribers for this bill")
+)
+
+// eventSink is a subscriber of bill events: a websocket connection or an
+// event stream. send must not block; a sink that cannot keep up drops
+// itself.
+type eventSink interface {
+	send(ev wsEnvelope) error
+	queued() int
+}
+
+type WsHubOptions struct {
+	// AllowedOrigins lists browser origins allowed to connect; "*" allows
+	// any, an empty list only the API's own host.
+	AllowedOrigins []string
+	// zero disables the limit
+	MaxConnsPerIP         int
+	MaxSubscribersPerBill int
+}
+
 type WsHub struct {
-	mu    sync.RWMutex
-	conns map[string]map[*websocket.Conn]struct{} // billID -> set of conns
-	upgr  websocket.Upgrader
+	mu      sync.Mutex
+	conns   map[string]map[eventSink]*subscription
+	wallets map[string]map[eventSink]struct{} // raw wallet -> user channel sinks
+	sinks   map[eventSink]string              // sink -> client ip
+	perIP   map[string]int
+	opts    WsHubOptions
+	upgr    websocket.Upgrader
 }
 
-func NewWSHub() *WsHub {
-	return &WsHub{
-		conns: make(map[string]map[*websocket.Conn]struct{}),
+// subscription is the state of a sink on one bill.
+type subscription struct {
+	// last is the highest seq the backlog covered; live events up to it are
+	// skipped
+	last uint64
+	// loading: the backlog is being read, events published meanwhile wait in
+	// pending
+	loading bool
+	pending []wsEnvelope
+}
+
+func NewWSHub(opts WsHubOptions) *WsHub {
+	h := &WsHub{
+		conns:   make(map[string]map[eventSink]*subscription),
+		wallets: make(map[string]map[eventSink]struct{}),
+		sinks:   make(map[eventSink]string),
+		perIP:   make(map[string]int),
+		opts:    opts,
 		upgr: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
-			CheckOrigin:     func(r *http.Request) bool { return true },
 		},
 	}
+	h.upgr.CheckOrigin = h.checkOrigin
+	registerHubMetrics(h)
+	return h
+}
+
+func (h *WsHub) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// not a browser
+		return true
+	}
+	for _, allowed := range h.opts.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	if len(h.opts.AllowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	return false
+}
+
+// wsConn owns a websocket: everything it sends goes through a bounded queue
+// drained by a single writer goroutine, which also pings on schedule.
+type wsConn struct {
+	conn      *websocket.Conn
+	out       chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	closeCode int
 }
 
-func (h *WsHub) subscribe(billID string, w http.ResponseWriter, r *http.Request) {
+func (c *wsConn) send(ev wsEnvelope) error {
+	return c.writeJSON(ev)
+}
+
+func (c *wsConn) queued() int {
+	return len(c.out)
+}
+
+func (c *wsConn) writeJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-c.done:
+		return websocket.ErrCloseSent
+	default:
+	}
+	select {
+	case c.out <- data:
+		return nil
+	default:
+		wsDropped.Add(1)
+		wsSlowDisconnects.Add(1)
+		c.close(websocket.CloseTryAgainLater)
+		return errSlowConsumer
+	}
+}
+
+func (c *wsConn) close(code int) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		close(c.done)
+	})
+}
+
+func (c *wsConn) writePump() {
+	ping := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ping.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case data := <-c.out:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				c.close(websocket.CloseAbnormalClosure)
+				return
+			}
+			wsSent.Add(1)
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				c.close(websocket.CloseAbnormalClosure)
+				return
+			}
+		case <-c.done:
+			msg := websocket.FormatCloseMessage(c.closeCode, "")
+			_ = c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			return
+		}
+	}
+}
+
+// readLoop keeps the connection alive on pongs and hands text messages to
+// onMessage until the peer goes away or the connection is closed.
+func (c *wsConn) readLoop(onMessage func([]byte)) {
+	defer c.close(websocket.CloseNormalClosure)
+
+	c.conn.SetReadLimit(512)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		return nil
+	})
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		if onMessage != nil {
+			onMessage(data)
+		}
+	}
+}
+
+// walletKey normalizes an address so both user-friendly forms of a wallet
+// map to the same channel.
+func walletKey(wallet string) string {
+	if a, err := address.ParseAddr(wallet); err == nil {
+		return a.StringRaw()
+	}
+	return wallet
+}
+
+// open counts the connection against the client ip, upgrades the request
+// and starts the connection writer. Limit errors are answered over HTTP.
+func (h *WsHub) open(w http.ResponseWriter, r *http.Request, ip string) (*wsConn, error) {
+	c := &wsConn{
+		out:  make(chan []byte, sinkQueueSize),
+		done: make(chan struct{}),
+	}
+	if err := h.register(c, ip); err != nil {
+		renderErr(w, http.StatusTooManyRequests, err.Error())
+		return nil, err
+	}
+
 	conn, err := h.upgr.Upgrade(w, r, nil)
 	if err != nil {
+		h.unregister(c)
+		return nil, err
+	}
+	c.conn = conn
+	go c.writePump()
+	return c, nil
+}
+
+func (h *WsHub) register(sink eventSink, ip string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.opts.MaxConnsPerIP > 0 && h.perIP[ip] >= h.opts.MaxConnsPerIP {
+		return errTooManyConns
+	}
+	h.perIP[ip]++
+	h.sinks[sink] = ip
+	wsConnections.Add(1)
+	return nil
+}
+
+func (h *WsHub) unregister(sink eventSink) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ip, ok := h.sinks[sink]
+	if !ok {
 		return
 	}
+	delete(h.sinks, sink)
+	if h.perIP[ip]--; h.perIP[ip] <= 0 {
+		delete(h.perIP, ip)
+	}
+	wsConnections.Add(-1)
+}
+
+// billFull reports whether the bill has no room for another subscriber.
+func (h *WsHub) billFull(billID string) bool {
 	h.mu.Lock()
-	if _, ok := h.conns[billID]; !ok {
-		h.conns[billID] = make(map[*websocket.Conn]struct{})
+	defer h.mu.Unlock()
+
+	return h.billFullLocked(billID)
+}
+
+func (h *WsHub) billFullLocked(billID string) bool {
+	return h.opts.MaxSubscribersPerBill > 0 && len(h.conns[billID]) >= h.opts.MaxSubscribersPerBill
+}
+
+// subscribe upgrades the request and attaches the connection to the bill.
+func (h *WsHub) subscribe(billID string, w http.ResponseWriter, r *http.Request, ip string, backlog func() ([]wsEnvelope, error)) error {
+	if h.billFull(billID) {
+		renderErr(w, http.StatusServiceUnavailable, errBillFull.Error())
+		return errBillFull
+	}
+	c, err := h.open(w, r, ip)
+	if err != nil {
+		return err
+	}
+	if err := h.attach(billID, c, backlog); err != nil {
+		code := websocket.CloseInternalServerErr
+		if errors.Is(err, errBillFull) {
+			code = websocket.CloseTryAgainLater
+		}
+		c.close(code)
+		h.unregister(c)
+		return err
 	}
-	h.conns[billID][conn] = struct{}{}
-	h.mu.Unlock()
 
 	go func() {
 		defer func() {
-			h.mu.Lock()
-			delete(h.conns[billID], conn)
-			if len(h.conns[billID]) == 0 {
-				delete(h.conns, billID)
-			}
-			h.mu.Unlock()
-			conn.Close()
+			h.detach(billID, c)
+			h.unregister(c)
 		}()
-		conn.SetReadLimit(512)
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-		conn.SetPongHandler(func(string) error {
-			conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-			return nil
-		})
-		for {
-			_, _, err := conn.ReadMessage()
-			if err != nil {
-				return
-			}
-		}
+		c.readLoop(nil)
 	}()
+	return nil
+}
+
+// attach sends the backlog (a snapshot or the replay of missed events) to
+// sink before it joins the bill. The backlog is read without the hub lock;
+// events published meanwhile are held for the sink and sent after it, minus
+// those the backlog already covered, so nothing is lost or repeated.
+func (h *WsHub) attach(billID string, sink eventSink, backlog func() ([]wsEnvelope, error)) error {
+	h.mu.Lock()
+	sub, existed := h.conns[billID][sink]
+	if !existed {
+		if h.billFullLocked(billID) {
+			h.mu.Unlock()
+			return errBillFull
+		}
+		if _, ok := h.conns[billID]; !ok {
+			h.conns[billID] = make(map[eventSink]*subscription)
+		}
+		sub = &subscription{}
+		h.conns[billID][sink] = sub
+	}
+	sub.loading = true
+	h.mu.Unlock()
+
+	events, err := backlog()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.conns[billID][sink] != sub {
+		// detached while the backlog loaded
+		return nil
+	}
+	pending := sub.pending
+	sub.loading, sub.pending = false, nil
+	if err != nil {
+		if !existed {
+			h.detachLocked(billID, sink)
+		} else {
+			h.sendPendingLocked(sink, sub, pending)
+		}
+		return err
+	}
+
+	var last uint64
+	for _, ev := range events {
+		if err := sink.send(ev); err != nil {
+			h.detachLocked(billID, sink)
+			return err
+		}
+		if ev.Seq > last {
+			last = ev.Seq
+		}
+	}
+	sub.last = last
+	h.sendPendingLocked(sink, sub, pending)
+	return nil
+}
+
+// sendPendingLocked delivers the events held while sub loaded its backlog.
+func (h *WsHub) sendPendingLocked(sink eventSink, sub *subscription, pending []wsEnvelope) {
+	for _, ev := range pending {
+		if ev.Seq <= sub.last {
+			continue
+		}
+		_ = sink.send(ev)
+		sub.last = ev.Seq
+	}
+}
+
+func (h *WsHub) detach(billID string, sink eventSink) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.detachLocked(billID, sink)
 }
 
-func (h *WsHub) broadcastBill(billID string, payload any) {
-	data, _ := json.Marshal(payload)
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-	for c := range h.conns[billID] {
-		_ = c.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(time.Second))
-		c.SetWriteDeadline(time.Now().Add(2 * time.Second))
-		_ = c.WriteMessage(websocket.TextMessage, data)
+func (h *WsHub) detachLocked(billID string, sink eventSink) {
+	delete(h.conns[billID], sink)
+	if len(h.conns[billID]) == 0 {
+		delete(h.conns, billID)
+	}
+}
+
+func (h *WsHub) attached(billID string, sink eventSink) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	_, ok := h.conns[billID][sink]
+	return ok
+}
+
+// sinkBills counts the bills sink is attached to.
+func (h *WsHub) sinkBills(sink eventSink) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := 0
+	for _, sinks := range h.conns {
+		if _, ok := sinks[sink]; ok {
+			n++
+		}
+	}
+	return n
+}
+
+// watchWallet registers a user channel sink so bills the wallet joins later
+// are attached to it as well.
+func (h *WsHub) watchWallet(wallet string, sink eventSink) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := walletKey(wallet)
+	if _, ok := h.wallets[key]; !ok {
+		h.wallets[key] = make(map[eventSink]struct{})
+	}
+	h.wallets[key][sink] = struct{}{}
+}
+
+// follow attaches the user channels of wallet to the bill, from the next
+// event on.
+func (h *WsHub) follow(wallet, billID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sink := range h.wallets[walletKey(wallet)] {
+		if _, ok := h.conns[billID][sink]; ok || h.billFullLocked(billID) {
+			continue
+		}
+		if _, ok := h.conns[billID]; !ok {
+			h.conns[billID] = make(map[eventSink]*subscription)
+		}
+		h.conns[billID][sink] = &subscription{}
+	}
+}
+
+// forget removes a user channel sink from its wallet and every bill.
+func (h *WsHub) forget(wallet string, sink eventSink) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := walletKey(wallet)
+	delete(h.wallets[key], sink)
+	if len(h.wallets[key]) == 0 {
+		delete(h.wallets, key)
+	}
+	for billID, sinks := range h.conns {
+		if _, ok := sinks[sink]; ok {
+			h.detachLocked(billID, sink)
+		}
+	}
+}
+
+// broadcast queues a stored event for every subscriber of the bill, skipping
+// those whose backlog already covered it. Sinks never block, so a slow
+// subscriber cannot hold up the others.
+func (h *WsHub) broadcast(billID string, ev wsEnvelope) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sink, sub := range h.conns[billID] {
+		if sub.loading {
+			sub.pending = append(sub.pending, ev)
+			continue
+		}
+		if ev.Seq <= sub.last {
+			continue
+		}
+		_ = sink.send(ev)
 	}
 }
@@ -0,0 +1,48 @@
+package split
+
+import (
+	"sync"
+	"testing"
+)
+
+type recordingSink struct {
+	mu   sync.Mutex
+	seqs []uint64
+}
+
+func (s *recordingSink) send(ev wsEnvelope) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seqs = append(s.seqs, ev.Seq)
+	return nil
+}
+
+func (s *recordingSink) queued() int { return 0 }
+
+// Events published while a backlog loads reach the sink after it, once.
+func TestAttachHoldsEventsDuringBacklog(t *testing.T) {
+	h := NewWSHub(WsHubOptions{})
+	sink := &recordingSink{}
+
+	err := h.attach("bill", sink, func() ([]wsEnvelope, error) {
+		// the hub lock is free while the backlog loads
+		h.broadcast("bill", wsEnvelope{Seq: 3})
+		h.broadcast("bill", wsEnvelope{Seq: 4})
+		return []wsEnvelope{{Seq: 2}, {Seq: 3}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.broadcast("bill", wsEnvelope{Seq: 4})
+	h.broadcast("bill", wsEnvelope{Seq: 5})
+
+	want := []uint64{2, 3, 4, 5}
+	if len(sink.seqs) != len(want) {
+		t.Fatalf("sent %v, want %v", sink.seqs, want)
+	}
+	for i := range want {
+		if sink.seqs[i] != want[i] {
+			t.Fatalf("sent %v, want %v", sink.seqs, want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package split
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const sseHeartbeat = 15 * time.Second
+
+// sseSink queues events for the handler goroutine that owns the response.
+// A client that falls a full queue behind is cut off and resumes with
+// Last-Event-ID.
+type sseSink struct {
+	ch       chan wsEnvelope
+	overflow chan struct{}
+	once     sync.Once
+}
+
+func newSSESink() *sseSink {
+	return &sseSink{
+		ch:       make(chan wsEnvelope, sinkQueueSize),
+		overflow: make(chan struct{}),
+	}
+}
+
+func (s *sseSink) send(ev wsEnvelope) error {
+	select {
+	case s.ch <- ev:
+		return nil
+	default:
+		wsDropped.Add(1)
+		s.once.Do(func() {
+			wsSlowDisconnects.Add(1)
+			close(s.overflow)
+		})
+		return errSlowConsumer
+	}
+}
+
+func (s *sseSink) queued() int {
+	return len(s.ch)
+}
+
+func (s *Server) handleBillEvents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		billID, err := uuidFromVars(mux.Vars(r), "id")
+		if err != nil {
+			renderErr(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if !s.authorizeBillStream(w, r, billID) {
+			return
+		}
+
+		// EventSource resends the id of the last event it saw; the query
+		// parameter is for clients that cannot set headers
+		var since *uint64
+		lastID := r.Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = r.URL.Query().Get("since")
+		}
+		if lastID != "" {
+			seq, err := strconv.ParseUint(lastID, 10, 64)
+			if err != nil {
+				renderErr(w, http.StatusBadRequest, "invalid Last-Event-ID")
+				return
+			}
+			since = &seq
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			renderErr(w, http.StatusInternalServerError, "streaming unsupported")
+			return
+		}
+
+		ctx := r.Context()
+		sink := newSSESink()
+		if err := s.ws.register(sink, s.clientIP(r)); err != nil {
+			renderErr(w, http.StatusTooManyRequests, err.Error())
+			return
+		}
+		defer s.ws.unregister(sink)
+		err = s.ws.attach(billID.String(), sink, func() ([]wsEnvelope, error) {
+			return s.wsBacklog(ctx, billID, since)
+		})
+		if errors.Is(err, errBillFull) {
+			renderErr(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		if err != nil {
+			renderErr(w, http.StatusNotFound, err.Error())
+			return
+		}
+		defer s.ws.detach(billID.String(), sink)
+
+		s.logger.WithFields(logrus.Fields{
+			"bill_id": billID.String(),
+			"remote":  r.RemoteAddr,
+		}).Info("sse: stream opened")
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(sseHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sink.overflow:
+				s.logger.WithField("bill_id", billID.String()).Warn("sse: slow client dropped")
+				return
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case ev := <-sink.ch:
+				if err := writeSSE(w, ev); err != nil {
+					return
+				}
+				flusher.Flush()
+				wsSent.Add(1)
+			}
+		}
+	}
+}
+
+func writeSSE(w http.ResponseWriter, ev wsEnvelope) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, ev.Type, data)
+	return err
+}
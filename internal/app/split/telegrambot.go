@@ -0,0 +1,167 @@
+package split
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/storage"
+	"github.com/Hackathon-Apps/go-split-api/internal/app/telegram"
+	"github.com/sirupsen/logrus"
+	"github.com/xssnick/tonutils-go/address"
+)
+
+const (
+	telegramLinkTTL = 10 * time.Minute
+	// workchain, account id, expiry and a truncated MAC: 60 characters once
+	// encoded, under the 64 Telegram allows for a start parameter
+	telegramLinkTokenSize = 1 + 32 + 4 + 8
+)
+
+var errInvalidLinkToken = errors.New("invalid or expired link")
+
+func (s *Server) telegramLinkMAC(data []byte) []byte {
+	mac := hmac.New(sha256.New, s.derivedKey("telegram-link"))
+	mac.Write(data)
+	return mac.Sum(nil)[:8]
+}
+
+// issueTelegramLinkToken binds a proven wallet to whichever chat sends the
+// token back to the bot.
+func (s *Server) issueTelegramLinkToken(addr *address.Address, expires time.Time) string {
+	buf := make([]byte, 0, telegramLinkTokenSize)
+	buf = append(buf, byte(addr.Workchain()))
+	buf = append(buf, addr.Data()...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(expires.Unix()))
+	buf = append(buf, s.telegramLinkMAC(buf)...)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func (s *Server) verifyTelegramLinkToken(token string) (*address.Address, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(buf) != telegramLinkTokenSize {
+		return nil, errInvalidLinkToken
+	}
+	data, sig := buf[:telegramLinkTokenSize-8], buf[telegramLinkTokenSize-8:]
+	if !hmac.Equal(sig, s.telegramLinkMAC(data)) {
+		return nil, errInvalidLinkToken
+	}
+	if time.Now().Unix() > int64(binary.BigEndian.Uint32(data[33:])) {
+		return nil, errInvalidLinkToken
+	}
+	return address.NewAddress(0, data[0], data[1:33]), nil
+}
+
+func (s *Server) telegramLinkEnabled() bool {
+	return s.notifierEnabled() && s.configuration.TelegramBotUsername != ""
+}
+
+// handleTelegramLink answers with the bot deep link that connects the chat
+// opening it to the caller's proven wallet. Neither the wallet nor the chat
+// is taken from the caller's word.
+func (s *Server) handleTelegramLink() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.telegramLinkEnabled() {
+			renderErr(w, http.StatusServiceUnavailable, "telegram notifications are not configured")
+			return
+		}
+
+		sender, err := s.provenWallet(r)
+		if err != nil {
+			renderErr(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		addr, err := address.ParseRawAddr(walletKey(sender))
+		if err != nil {
+			renderErr(w, http.StatusBadRequest, "invalid address")
+			return
+		}
+
+		expires := time.Now().Add(telegramLinkTTL).UTC()
+		token := s.issueTelegramLinkToken(addr, expires)
+		renderJSON(w, telegramLinkResponse{
+			URL:       "https://t.me/" + s.configuration.TelegramBotUsername + "?start=" + token,
+			ExpiresAt: expires,
+		})
+	}
+}
+
+// handleTelegramUpdate receives the bot's updates (setWebhook with
+// secret_token). /start <token> links the chat to the wallet in the token,
+// /stop and /start turn the chat's notifications off and on.
+func (s *Server) handleTelegramUpdate() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret := s.configuration.TelegramWebhookSecret
+		got := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+		if !s.notifierEnabled() || secret == "" || subtle.ConstantTimeCompare([]byte(got), []byte(secret)) != 1 {
+			renderErr(w, http.StatusNotFound, "not found")
+			return
+		}
+
+		var upd telegram.Update
+		if err := json.NewDecoder(r.Body).Decode(&upd); err != nil {
+			renderErr(w, http.StatusBadRequest, "invalid json: "+err.Error())
+			return
+		}
+		// answered regardless, Telegram redelivers updates that fail
+		if upd.Message != nil && upd.Message.Chat.Type == "private" {
+			s.handleBotCommand(r.Context(), upd.Message)
+		}
+		renderJSON(w, struct{}{})
+	}
+}
+
+func (s *Server) handleBotCommand(ctx context.Context, msg *telegram.Message) {
+	chatID := msg.Chat.ID
+	log := s.logger.WithField("chat_id", chatID)
+
+	var reply string
+	switch cmd, arg := msg.Command(); {
+	case cmd == "/start" && arg != "":
+		addr, err := s.verifyTelegramLinkToken(arg)
+		if err != nil {
+			reply = "This link is invalid or has expired. Request a new one in the app."
+			break
+		}
+		sub := &storage.TelegramSubscriber{Wallet: addr.StringRaw(), ChatID: chatID}
+		if err := s.db.UpsertTelegramSubscriber(ctx, sub); err != nil {
+			log.WithError(err).Warn("notify: telegram link failed")
+			reply = "Something went wrong, please try again."
+			break
+		}
+		log.WithField("wallet", sub.Wallet).Info("notify: telegram chat linked")
+		reply = "Notifications for " + addr.String() + " are on. Send /stop to turn them off."
+	case cmd == "/start" || cmd == "/stop":
+		optOut := cmd == "/stop"
+		n, err := s.db.SetTelegramChatOptOut(ctx, chatID, optOut)
+		switch {
+		case err != nil:
+			log.WithError(err).Warn("notify: telegram opt-out update failed")
+			reply = "Something went wrong, please try again."
+		case n == 0:
+			reply = "No wallet is linked to this chat yet. Open the link from the app."
+		case optOut:
+			reply = "Notifications are off. Send /start to turn them back on."
+		default:
+			reply = "Notifications are on. Send /stop to turn them off."
+		}
+		if err == nil && n > 0 {
+			log.WithFields(logrus.Fields{"wallets": n, "opted_out": optOut}).Info("notify: telegram settings updated")
+		}
+	default:
+		return
+	}
+
+	sendCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.telegram.SendMessage(sendCtx, chatID, reply); err != nil {
+		log.WithError(err).Warn("notify: telegram reply failed")
+	}
+}
@@ -0,0 +1,34 @@
+package split
+
+import (
+	"testing"
+	"time"
+
+	"github.com/xssnick/tonutils-go/address"
+)
+
+func TestTelegramLinkToken(t *testing.T) {
+	s := &Server{wsTokenKey: []byte("secret")}
+	addr := address.MustParseAddr("UQDQbRJs32yYxOy-ZscoZ9Tlj_pH6D0jeS7a8U5oSkzkicwR")
+
+	token := s.issueTelegramLinkToken(addr, time.Now().Add(time.Minute))
+	if len(token) > 64 {
+		t.Fatalf("token is %d characters, Telegram allows 64", len(token))
+	}
+	got, err := s.verifyTelegramLinkToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.StringRaw() != addr.StringRaw() {
+		t.Fatalf("wallet = %s, want %s", got.StringRaw(), addr.StringRaw())
+	}
+
+	other := &Server{wsTokenKey: []byte("other")}
+	if _, err := other.verifyTelegramLinkToken(token); err == nil {
+		t.Fatal("token accepted under another key")
+	}
+	expired := s.issueTelegramLinkToken(addr, time.Now().Add(-time.Second))
+	if _, err := s.verifyTelegramLinkToken(expired); err == nil {
+		t.Fatal("expired token accepted")
+	}
+}
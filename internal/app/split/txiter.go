@@ -0,0 +1,124 @@
+package split
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+const txIterPageSize = 50
+
+var errPageBudgetExhausted = errors.New("toncenter: page budget exhausted before lower bound")
+
+// txLowerBound stops the iterator at the first transaction at or below LT or
+// older than Since. Zero values disable the corresponding bound.
+type txLowerBound struct {
+	LT    uint64
+	Since time.Time
+}
+
+// txIterator walks toncenter transactions of one account from the newest
+// backwards, following lt/hash cursors page by page.
+type txIterator struct {
+	s       *Server
+	address string
+	bound   txLowerBound
+	budget  int
+
+	buf    []tcTransaction
+	cursor *tcPrev
+	lastLT uint64
+	done   bool
+	err    error
+}
+
+func (s *Server) iterateTransactions(address string, bound txLowerBound) *txIterator {
+	budget := s.configuration.TonCenterPageBudget
+	if budget <= 0 {
+		budget = 1
+	}
+	return &txIterator{s: s, address: address, bound: bound, budget: budget}
+}
+
+// Next returns the next older transaction together with its parsed LT. It
+// returns false once the lower bound, the end of history or an error (see Err)
+// is reached.
+func (it *txIterator) Next() (tcTransaction, uint64, bool) {
+	for {
+		for len(it.buf) > 0 {
+			tx := it.buf[0]
+			it.buf = it.buf[1:]
+
+			lt, err := strconv.ParseUint(tx.TransactionID.LT, 10, 64)
+			if err != nil {
+				continue
+			}
+			// pages overlap on the cursor transaction
+			if it.lastLT != 0 && lt >= it.lastLT {
+				continue
+			}
+			it.lastLT = lt
+
+			if lt <= it.bound.LT || (!it.bound.Since.IsZero() && tx.Utime > 0 && tx.Utime < it.bound.Since.Unix()) {
+				it.done = true
+				it.buf = nil
+				return tcTransaction{}, 0, false
+			}
+			return tx, lt, true
+		}
+
+		if it.done {
+			return tcTransaction{}, 0, false
+		}
+		if it.budget == 0 {
+			it.done = true
+			it.err = errPageBudgetExhausted
+			return tcTransaction{}, 0, false
+		}
+		it.budget--
+
+		lt, hash := uint64(0), ""
+		if it.cursor != nil {
+			lt, _ = strconv.ParseUint(it.cursor.LT, 10, 64)
+			hash = it.cursor.Hash
+		}
+		res, err := it.s.tonCenterGetTransactions(it.address, txIterPageSize, lt, hash)
+		if err != nil {
+			it.done = true
+			it.err = err
+			return tcTransaction{}, 0, false
+		}
+
+		it.buf = res.Result
+		it.cursor = nextCursor(res)
+		if it.cursor == nil || len(res.Result) < txIterPageSize {
+			it.done = true
+		}
+	}
+}
+
+func (it *txIterator) Err() error {
+	return it.err
+}
+
+// From starts the walk at cursor instead of the newest transaction.
+func (it *txIterator) From(cursor *tcPrev) *txIterator {
+	it.cursor = cursor
+	return it
+}
+
+// Cursor is where a walk stopped by the page budget continues.
+func (it *txIterator) Cursor() *tcPrev {
+	return it.cursor
+}
+
+func nextCursor(res *tcGetTxResp) *tcPrev {
+	if res.PreviousTransaction != nil && res.PreviousTransaction.LT != "" {
+		return res.PreviousTransaction
+	}
+	if len(res.Result) == 0 {
+		return nil
+	}
+	last := res.Result[len(res.Result)-1].TransactionID
+	return &tcPrev{LT: last.LT, Hash: last.Hash}
+}
@@ -0,0 +1,124 @@
+package split
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// bills a single user channel follows at most
+const userChannelMaxBills = 200
+
+// handleUserWS opens one websocket for every bill the wallet created or
+// contributed to. The wallet comes from a user channel token.
+func (s *Server) handleUserWS() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := s.wsTokenFromRequest(r)
+		if err != nil || claims.Bill != "" {
+			renderErr(w, http.StatusUnauthorized, errInvalidWsToken.Error())
+			return
+		}
+		wallet := claims.Wallet
+
+		ctx := r.Context()
+		billIDs, err := s.db.ListWalletBillIDs(ctx, wallet, userChannelMaxBills)
+		if err != nil {
+			renderErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		sink, err := s.ws.open(w, r, s.clientIP(r))
+		if err != nil {
+			return
+		}
+		s.ws.watchWallet(wallet, sink)
+
+		for _, id := range billIDs {
+			if err := s.ws.attach(id.String(), sink, func() ([]wsEnvelope, error) {
+				return s.wsBacklog(ctx, id, nil)
+			}); err != nil {
+				s.logger.WithError(err).WithField("bill_id", id.String()).Warn("ws: user channel attach failed")
+			}
+		}
+
+		s.logger.WithFields(logrus.Fields{
+			"wallet": wallet,
+			"bills":  len(billIDs),
+			"remote": r.RemoteAddr,
+		}).Info("ws: user channel opened")
+
+		go s.userChannelReadLoop(wallet, sink)
+	}
+}
+
+func (s *Server) userChannelReadLoop(wallet string, sink *wsConn) {
+	defer func() {
+		s.ws.forget(wallet, sink)
+		s.ws.unregister(sink)
+	}()
+
+	sink.readLoop(func(data []byte) {
+		var msg wsClientMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			_ = sink.writeJSON(wsControlReply{Type: "error", Error: "invalid message"})
+			return
+		}
+		billID, err := uuid.Parse(msg.BillID)
+		if err != nil {
+			_ = sink.writeJSON(wsControlReply{Type: "error", BillID: msg.BillID, Error: "invalid bill_id"})
+			return
+		}
+
+		switch strings.ToLower(msg.Action) {
+		case "subscribe":
+			s.userChannelSubscribe(sink, wallet, billID, msg)
+		case "unsubscribe":
+			s.ws.detach(billID.String(), sink)
+			_ = sink.writeJSON(wsControlReply{Type: "unsubscribed", BillID: billID.String()})
+		default:
+			_ = sink.writeJSON(wsControlReply{Type: "error", BillID: msg.BillID, Error: "unknown action: use subscribe|unsubscribe"})
+		}
+	})
+}
+
+func (s *Server) userChannelSubscribe(sink *wsConn, wallet string, billID uuid.UUID, msg wsClientMessage) {
+	if s.ws.attached(billID.String(), sink) {
+		_ = sink.writeJSON(wsControlReply{Type: "subscribed", BillID: billID.String()})
+		return
+	}
+	if s.ws.sinkBills(sink) >= userChannelMaxBills {
+		_ = sink.writeJSON(wsControlReply{Type: "error", BillID: billID.String(), Error: "too many subscriptions"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// bills of other people need the same token a bill stream would
+	if c, err := s.verifyWsToken(msg.Token); err != nil || c.Bill != billID.String() {
+		involved, err := s.db.WalletInBill(ctx, wallet, billID)
+		if err != nil || !involved {
+			_ = sink.writeJSON(wsControlReply{Type: "error", BillID: billID.String(), Error: errInvalidWsToken.Error()})
+			return
+		}
+	}
+
+	err := s.ws.attach(billID.String(), sink, func() ([]wsEnvelope, error) {
+		return s.wsBacklog(ctx, billID, msg.Since)
+	})
+	if errors.Is(err, errBillFull) {
+		_ = sink.writeJSON(wsControlReply{Type: "error", BillID: billID.String(), Error: err.Error()})
+		return
+	}
+	if err != nil {
+		_ = sink.writeJSON(wsControlReply{Type: "error", BillID: billID.String(), Error: "bill not found"})
+		return
+	}
+	_ = sink.writeJSON(wsControlReply{Type: "subscribed", BillID: billID.String()})
+}
@@ -0,0 +1,107 @@
+package split
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/ton/wallet"
+)
+
+const tonProofTTL = 5 * time.Minute
+
+var errWalletNotProven = errors.New("wallet not proven: send X-Wallet-Token for the Sender-Address wallet")
+
+// walletClaims is what a wallet token asserts: the holder proved with
+// ton_proof that it controls Wallet (raw form).
+type walletClaims struct {
+	Wallet string `json:"w"`
+	Exp    int64  `json:"exp"`
+}
+
+// derivedKey separates the uses of the subscription token secret.
+func (s *Server) derivedKey(label string) []byte {
+	mac := hmac.New(sha256.New, s.wsTokenKey)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func (s *Server) issueWalletToken(addr *address.Address, expires time.Time) (string, error) {
+	return signClaims(s.derivedKey("wallet"), walletClaims{Wallet: addr.StringRaw(), Exp: expires.Unix()})
+}
+
+// provenWallet returns the Sender-Address wallet when the request also
+// carries a wallet token for it; the header alone proves nothing.
+func (s *Server) provenWallet(r *http.Request) (string, error) {
+	sender, err := s.walletFromHeader(r)
+	if err != nil {
+		return "", err
+	}
+	var c walletClaims
+	token := strings.TrimSpace(r.Header.Get("X-Wallet-Token"))
+	if !openClaims(s.derivedKey("wallet"), token, &c) || time.Now().Unix() > c.Exp || c.Wallet != walletKey(sender) {
+		return "", errWalletNotProven
+	}
+	return sender, nil
+}
+
+// handleTonProofPayload hands out the payload a wallet signs with ton_proof
+// to prove it is the caller's.
+func (s *Server) handleTonProofPayload() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		expires := time.Now().Add(tonProofTTL).UTC()
+		payload, err := wallet.GeneratePayload(string(s.derivedKey("ton-proof")), tonProofTTL)
+		if err != nil {
+			renderErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		renderJSON(w, tonProofPayloadResponse{Payload: payload, ExpiresAt: expires})
+	}
+}
+
+// handleWalletAuth checks a TON Connect ton_proof over a payload from
+// handleTonProofPayload and answers with a wallet token for that wallet.
+func (s *Server) handleWalletAuth() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.configuration.TonProofDomain == "" {
+			renderErr(w, http.StatusServiceUnavailable, "ton_proof_domain is not configured")
+			return
+		}
+
+		var req tonProofRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			renderErr(w, http.StatusBadRequest, "invalid json: "+err.Error())
+			return
+		}
+		addr, err := address.ParseRawAddr(req.Address)
+		if err != nil {
+			if addr, err = address.ParseAddr(req.Address); err != nil {
+				renderErr(w, http.StatusBadRequest, "invalid address")
+				return
+			}
+		}
+
+		verifier := wallet.NewTonConnectVerifier(s.configuration.TonProofDomain, tonProofTTL, s.tonApiClient)
+		if err := verifier.VerifyProofHandlePayload(r.Context(), addr, req.Proof, req.StateInit,
+			wallet.CheckPayload, string(s.derivedKey("ton-proof"))); err != nil {
+			renderErr(w, http.StatusUnauthorized, "ton_proof rejected: "+err.Error())
+			return
+		}
+
+		expires := time.Now().Add(time.Duration(s.configuration.WalletTokenTTLSeconds) * time.Second).UTC()
+		token, err := s.issueWalletToken(addr, expires)
+		if err != nil {
+			renderErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		s.logger.WithFields(logrus.Fields{"wallet": addr.StringRaw()}).Debug("auth: wallet proven")
+
+		renderJSON(w, walletTokenResponse{Token: token, Wallet: addr.StringRaw(), ExpiresAt: expires})
+	}
+}
@@ -0,0 +1,47 @@
+package split
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/xssnick/tonutils-go/address"
+)
+
+func TestProvenWallet(t *testing.T) {
+	s := &Server{wsTokenKey: []byte("secret")}
+	addr := address.MustParseAddr("UQDQbRJs32yYxOy-ZscoZ9Tlj_pH6D0jeS7a8U5oSkzkicwR")
+	token, err := s.issueWalletToken(addr, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := s.issueWalletToken(addr, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the ws token of the same key must not pass for a wallet token
+	wsToken, err := s.issueWsToken(wsClaims{Wallet: addr.StringRaw(), Exp: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range map[string]struct {
+		sender, token string
+		ok            bool
+	}{
+		"same wallet":        {addr.String(), token, true},
+		"another form":       {addr.StringRaw(), token, true},
+		"another wallet":     {"UQAs87W4yJHlF8mt29ocA4agnMrLsOP69jC1HPyBUjJay7H9", token, false},
+		"no token":           {addr.String(), "", false},
+		"expired":            {addr.String(), expired, false},
+		"subscription token": {addr.String(), wsToken, false},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Sender-Address", tc.sender)
+		r.Header.Set("X-Wallet-Token", tc.token)
+		_, err := s.provenWallet(r)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package split
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+// startWatch registers the watcher of a pending tx so it can be stopped from
+// outside. It returns false when a watcher for txID is already running.
+func (s *Server) startWatch(txID uuid.UUID) (context.Context, bool) {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+
+	if _, ok := s.watchers[txID]; ok {
+		return nil, false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.watchers[txID] = cancel
+	return ctx, true
+}
+
+func (s *Server) endWatch(txID uuid.UUID) {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+
+	if cancel, ok := s.watchers[txID]; ok {
+		cancel()
+		delete(s.watchers, txID)
+	}
+}
+
+// stopWatch cancels the watcher of txID, if any; the watcher releases its
+// stream listener and watch job on the way out.
+func (s *Server) stopWatch(txID uuid.UUID) bool {
+	s.watchMu.Lock()
+	cancel, ok := s.watchers[txID]
+	s.watchMu.Unlock()
+
+	if ok {
+		cancel()
+	}
+	return ok
+}
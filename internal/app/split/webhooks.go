@@ -0,0 +1,487 @@
+package split
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/storage"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	webhookBatch       = 20
+	webhookLease       = time.Minute
+	webhookTick        = 2 * time.Second
+	webhookBackoffBase = 10 * time.Second
+	webhookBackoffMax  = time.Hour
+	webhookLogLimit    = 100
+)
+
+var errInvalidAPIKey = errors.New("invalid api key")
+
+// apiKeyID is the public handle of an API key: webhooks and bills refer to
+// keys by it, the key itself is never stored.
+func apiKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// apiKeyFromRequest checks X-API-Key against the configured keys. It returns
+// an empty id when the header is absent.
+func (s *Server) apiKeyFromRequest(r *http.Request) (string, error) {
+	key := strings.TrimSpace(r.Header.Get("X-API-Key"))
+	if key == "" {
+		return "", nil
+	}
+	for _, k := range s.configuration.ApiKeys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			return apiKeyID(key), nil
+		}
+	}
+	return "", errInvalidAPIKey
+}
+
+// canManageWebhook: a key webhook belongs to its key, a bill webhook to the
+// bill's proven creator and to the key the bill was created with.
+func (s *Server) canManageWebhook(ctx context.Context, r *http.Request, wh *storage.Webhook) bool {
+	keyID, err := s.apiKeyFromRequest(r)
+	if err != nil {
+		return false
+	}
+	if wh.APIKeyID != nil {
+		return keyID != "" && *wh.APIKeyID == keyID
+	}
+	if wh.BillID == nil {
+		return false
+	}
+	bill, err := s.db.GetBill(ctx, *wh.BillID)
+	if err != nil {
+		return false
+	}
+	return s.canManageBillWebhooks(r, bill, keyID)
+}
+
+func (s *Server) canManageBillWebhooks(r *http.Request, bill *storage.Bill, keyID string) bool {
+	if keyID != "" && bill.APIKeyID != nil && *bill.APIKeyID == keyID {
+		return true
+	}
+	wallet, err := s.provenWallet(r)
+	return err == nil && walletKey(wallet) == walletKey(bill.CreatorAddress)
+}
+
+func (s *Server) handleCreateWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req createWebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			renderErr(w, http.StatusBadRequest, "invalid json: "+err.Error())
+			return
+		}
+		u, err := url.Parse(req.URL)
+		if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+			renderErr(w, http.StatusBadRequest, "url must be an absolute https url")
+			return
+		}
+		// names are checked again on every dial, they may resolve anywhere
+		if ip, err := netip.ParseAddr(u.Hostname()); err == nil && !webhookAddrAllowed(ip) {
+			renderErr(w, http.StatusBadRequest, "url must not point at a private address")
+			return
+		}
+		for _, e := range req.Events {
+			switch wsEventType(e) {
+			case evTxPending, evTxConfirmed, evTxFailed, evBillStatusChanged:
+			default:
+				renderErr(w, http.StatusBadRequest, "invalid event: "+e)
+				return
+			}
+		}
+
+		keyID, err := s.apiKeyFromRequest(r)
+		if err != nil {
+			renderErr(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		ctx := r.Context()
+		wh := &storage.Webhook{URL: u.String(), Events: strings.Join(req.Events, ",")}
+		if req.BillID != nil {
+			bill, err := s.db.GetBill(ctx, *req.BillID)
+			if err != nil {
+				renderErr(w, http.StatusNotFound, err.Error())
+				return
+			}
+			if !s.canManageBillWebhooks(r, bill, keyID) {
+				renderErr(w, http.StatusUnauthorized, "not your bill")
+				return
+			}
+			wh.BillID = &bill.ID
+		} else {
+			if keyID == "" {
+				renderErr(w, http.StatusUnauthorized, "api key required for webhooks without bill_id")
+				return
+			}
+			wh.APIKeyID = &keyID
+		}
+
+		secret := make([]byte, 32)
+		if _, err := crand.Read(secret); err != nil {
+			renderErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		wh.Secret = hex.EncodeToString(secret)
+
+		if err := s.db.CreateWebhook(ctx, wh); err != nil {
+			renderErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		s.logger.WithFields(logrus.Fields{
+			"webhook_id": wh.ID.String(),
+			"bill_id":    req.BillID,
+			"api_key_id": keyID,
+		}).Info("webhook: registered")
+
+		w.WriteHeader(http.StatusCreated)
+		renderJSON(w, webhookCreatedResponse{Webhook: *wh, Secret: wh.Secret})
+	}
+}
+
+func (s *Server) handleListWebhooks() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keyID, err := s.apiKeyFromRequest(r)
+		if err != nil {
+			renderErr(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		ctx := r.Context()
+		var billID *uuid.UUID
+		if v := r.URL.Query().Get("bill_id"); v != "" {
+			id, err := uuid.Parse(v)
+			if err != nil {
+				renderErr(w, http.StatusBadRequest, "invalid bill_id")
+				return
+			}
+			bill, err := s.db.GetBill(ctx, id)
+			if err != nil {
+				renderErr(w, http.StatusNotFound, err.Error())
+				return
+			}
+			if !s.canManageBillWebhooks(r, bill, keyID) {
+				renderErr(w, http.StatusUnauthorized, "not your bill")
+				return
+			}
+			billID = &id
+			// the bill itself is authorized, list all of its webhooks
+			keyID = ""
+		} else if keyID == "" {
+			renderErr(w, http.StatusUnauthorized, "api key or bill_id required")
+			return
+		}
+
+		hooks, err := s.db.ListWebhooks(ctx, keyID, billID)
+		if err != nil {
+			renderErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		renderJSON(w, hooks)
+	}
+}
+
+// webhookFromRequest loads the {webhookId} webhook and checks the caller may
+// manage it, answering the request otherwise.
+func (s *Server) webhookFromRequest(w http.ResponseWriter, r *http.Request) (*storage.Webhook, bool) {
+	id, err := uuidFromVars(mux.Vars(r), "webhookId")
+	if err != nil {
+		renderErr(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	wh, err := s.db.GetWebhook(r.Context(), id)
+	if err != nil {
+		renderErr(w, http.StatusNotFound, "webhook not found")
+		return nil, false
+	}
+	if !s.canManageWebhook(r.Context(), r, wh) {
+		renderErr(w, http.StatusUnauthorized, "not your webhook")
+		return nil, false
+	}
+	return wh, true
+}
+
+func (s *Server) handleDeleteWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		wh, ok := s.webhookFromRequest(w, r)
+		if !ok {
+			return
+		}
+		if err := s.db.DeleteWebhook(r.Context(), wh.ID); err != nil {
+			renderErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		renderJSON(w, "ok")
+	}
+}
+
+func (s *Server) handleListWebhookDeliveries() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		wh, ok := s.webhookFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		status := storage.DeliveryStatus(strings.ToUpper(r.URL.Query().Get("status")))
+		switch status {
+		case "", storage.DeliveryPending, storage.DeliveryDelivered, storage.DeliveryDead:
+		default:
+			renderErr(w, http.StatusBadRequest, "invalid status: use PENDING|DELIVERED|DEAD")
+			return
+		}
+		limit := webhookLogLimit
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > webhookLogLimit {
+				renderErr(w, http.StatusBadRequest, fmt.Sprintf("limit must be 1..%d", webhookLogLimit))
+				return
+			}
+			limit = n
+		}
+
+		deliveries, err := s.db.ListWebhookDeliveries(r.Context(), wh.ID, status, limit)
+		if err != nil {
+			renderErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		renderJSON(w, deliveries)
+	}
+}
+
+func (s *Server) handleRedeliverWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		wh, ok := s.webhookFromRequest(w, r)
+		if !ok {
+			return
+		}
+		deliveryID, err := uuidFromVars(mux.Vars(r), "deliveryId")
+		if err != nil {
+			renderErr(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		d, err := s.db.RedeliverWebhookDelivery(r.Context(), wh.ID, deliveryID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			renderErr(w, http.StatusNotFound, "delivery not found")
+			return
+		}
+		if err != nil {
+			renderErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		renderJSON(w, d)
+	}
+}
+
+// enqueueWebhooks queues a stored bill event for the webhooks interested in
+// it. Only the instance that stored the event does this.
+func (s *Server) enqueueWebhooks(ctx context.Context, ev storage.BillEvent) {
+	payload, err := json.Marshal(envelopeFromEvent(ev))
+	if err != nil {
+		return
+	}
+	n, err := s.db.EnqueueWebhookDeliveries(ctx, ev, payload)
+	if err != nil {
+		s.logger.WithError(err).WithFields(logrus.Fields{
+			"bill_id": ev.BillID.String(),
+			"seq":     ev.Seq,
+		}).Warn("webhook: enqueue failed")
+		return
+	}
+	if n > 0 {
+		s.logger.WithFields(logrus.Fields{
+			"bill_id":    ev.BillID.String(),
+			"seq":        ev.Seq,
+			"deliveries": n,
+		}).Debug("webhook: deliveries queued")
+	}
+}
+
+func (s *Server) runWebhookDispatcher() {
+	ticker := time.NewTicker(webhookTick)
+	defer ticker.Stop()
+
+	client := newWebhookClient(time.Duration(s.configuration.WebhookTimeoutSeconds) * time.Second)
+	for range ticker.C {
+		due, err := s.db.ClaimDueDeliveries(context.Background(), webhookBatch, webhookLease)
+		if err != nil {
+			s.logger.WithError(err).Warn("webhook: claim deliveries failed")
+			continue
+		}
+
+		var wg sync.WaitGroup
+		for _, d := range due {
+			wg.Add(1)
+			go func(d storage.WebhookDelivery) {
+				defer wg.Done()
+				s.deliverWebhook(client, d)
+			}(d)
+		}
+		wg.Wait()
+	}
+}
+
+func (s *Server) deliverWebhook(client *http.Client, d storage.WebhookDelivery) {
+	ctx := context.Background()
+	log := s.logger.WithFields(logrus.Fields{
+		"webhook_id":  d.WebhookID.String(),
+		"delivery_id": d.ID.String(),
+		"bill_id":     d.BillID.String(),
+		"seq":         d.EventSeq,
+	})
+
+	attempts := d.Attempts + 1
+	var code int
+	wh, err := s.db.GetWebhook(ctx, d.WebhookID)
+	if err == nil {
+		code, err = postWebhook(ctx, client, wh, d)
+		if err == nil {
+			if err := s.db.MarkDeliveryDelivered(ctx, d.ID, attempts, code); err != nil {
+				log.WithError(err).Warn("webhook: persist delivered failed")
+			}
+			log.WithField("attempts", attempts).Debug("webhook: delivered")
+			return
+		}
+	}
+
+	// a load failure counts as an attempt, a deleted webhook has nowhere to go
+	var next *time.Time
+	if attempts < s.configuration.WebhookMaxAttempts && !errors.Is(err, gorm.ErrRecordNotFound) {
+		t := time.Now().UTC().Add(webhookBackoff(attempts))
+		next = &t
+	}
+	var codePtr *int
+	if code != 0 {
+		codePtr = &code
+	}
+	if err := s.db.MarkDeliveryFailed(ctx, d.ID, attempts, codePtr, err.Error(), next); err != nil {
+		log.WithError(err).Warn("webhook: persist failure failed")
+	}
+
+	if next == nil {
+		log.WithError(err).WithField("attempts", attempts).Warn("webhook: retries exhausted -> DEAD")
+	} else {
+		log.WithError(err).WithFields(logrus.Fields{
+			"attempts": attempts,
+			"retry_at": *next,
+		}).Info("webhook: delivery failed, will retry")
+	}
+}
+
+var errWebhookAddr = errors.New("webhook address is not allowed")
+
+// reserved ranges IsGlobalUnicast and IsPrivate let through
+var webhookBlockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// webhookAddrAllowed reports whether a webhook may connect to ip: anything
+// routable on the public internet, nothing on the host, its networks or the
+// cloud metadata endpoints.
+func webhookAddrAllowed(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, p := range webhookBlockedPrefixes {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// newWebhookClient checks the address of every connection after resolution,
+// so a name that later resolves to a private address (DNS rebinding) or a
+// redirect there is refused as well. Proxies would hide the address.
+func newWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil || !webhookAddrAllowed(ap.Addr()) {
+				return fmt.Errorf("%w: %s", errWebhookAddr, address)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// postWebhook sends the event signed as
+// X-Split-Signature: t=<unix>,v1=<hex hmac-sha256(secret, "<unix>.<body>")>;
+// receivers should reject stale timestamps.
+func postWebhook(ctx context.Context, client *http.Client, wh *storage.Webhook, d storage.WebhookDelivery) (int, error) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(wh.Secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(d.Payload)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-split-api-webhooks/1")
+	req.Header.Set("X-Split-Event", d.EventType)
+	req.Header.Set("X-Split-Delivery", d.ID.String())
+	req.Header.Set("X-Split-Timestamp", ts)
+	req.Header.Set("X-Split-Signature", "t="+ts+",v1="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func webhookBackoff(attempt int) time.Duration {
+	d := webhookBackoffBase << (attempt - 1)
+	if d > webhookBackoffMax || d <= 0 {
+		d = webhookBackoffMax
+	}
+	// keep at least half so retries stay spread out
+	return d/2 + time.Duration(rand.Int64N(int64(d/2)+1))
+}
@@ -0,0 +1,84 @@
+package split
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/config"
+	"github.com/Hackathon-Apps/go-split-api/internal/app/storage"
+	"github.com/xssnick/tonutils-go/address"
+)
+
+func TestWebhookAddrAllowed(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"93.184.216.34":        true,
+		"2606:4700::1111":      true,
+		"127.0.0.1":            false,
+		"10.1.2.3":             false,
+		"172.16.0.1":           false,
+		"192.168.1.1":          false,
+		"169.254.169.254":      false,
+		"100.64.0.1":           false,
+		"0.0.0.0":              false,
+		"0.1.2.3":              false,
+		"240.0.0.1":            false,
+		"::1":                  false,
+		"fd00:ec2::254":        false,
+		"fe80::1":              false,
+		"::ffff:127.0.0.1":     false,
+		"64:ff9b::a9fe:a9fe":   false,
+		"ff02::1":              false,
+		"::ffff:93.184.216.34": true,
+	} {
+		if got := webhookAddrAllowed(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("webhookAddrAllowed(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+// The check runs on the resolved address, whatever name the url carries.
+func TestWebhookClientRefusesLoopback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, "http://localhost:"+port, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newWebhookClient(time.Second).Do(req)
+	if !errors.Is(err, errWebhookAddr) {
+		t.Fatalf("err = %v, want %v", err, errWebhookAddr)
+	}
+}
+
+// The creator header alone does not open a bill's webhooks.
+func TestCanManageBillWebhooksNeedsProof(t *testing.T) {
+	s := &Server{wsTokenKey: []byte("secret"), configuration: config.NewConfiguration()}
+	creator := address.MustParseAddr("UQDQbRJs32yYxOy-ZscoZ9Tlj_pH6D0jeS7a8U5oSkzkicwR")
+	bill := &storage.Bill{CreatorAddress: creator.String()}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/webhooks", nil)
+	r.Header.Set("Sender-Address", creator.String())
+	if s.canManageBillWebhooks(r, bill, "") {
+		t.Fatal("header alone accepted")
+	}
+
+	token, err := s.issueWalletToken(creator, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("X-Wallet-Token", token)
+	if !s.canManageBillWebhooks(r, bill, "") {
+		t.Fatal("proven creator refused")
+	}
+}
@@ -0,0 +1,190 @@
+package split
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/storage"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+var errInvalidWsToken = errors.New("invalid or expired subscription token")
+
+// wsClaims is what a subscription token grants: the events of one bill, or
+// with an empty Bill the user channel of Wallet.
+type wsClaims struct {
+	Bill   string `json:"b,omitempty"`
+	Wallet string `json:"w"`
+	Exp    int64  `json:"exp"`
+}
+
+// wsTokenKey returns the HMAC key for subscription tokens. Without a
+// configured secret a random one is used, which only works for a single
+// instance.
+func wsTokenKey(secret string, log *logrus.Logger) []byte {
+	if secret != "" {
+		return []byte(secret)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	log.Warn("ws: ws_token_secret not set, tokens are valid on this instance only")
+	return key
+}
+
+func (s *Server) issueWsToken(c wsClaims) (string, error) {
+	return signClaims(s.wsTokenKey, c)
+}
+
+// signClaims encodes c as <base64 json>.<base64 hmac-sha256>.
+func signClaims(key []byte, c any) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(mac.Sum(nil)), nil
+}
+
+// openClaims checks the signature of a signClaims token and decodes it into c.
+func openClaims(key []byte, token string, c any) bool {
+	payloadPart, sigPart, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(payloadPart)
+	if err != nil {
+		return false
+	}
+	sig, err := enc.DecodeString(sigPart)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return hmac.Equal(sig, mac.Sum(nil)) && json.Unmarshal(payload, c) == nil
+}
+
+// wsTokenFromRequest verifies the token sent as ?token= (browsers cannot set
+// headers on an upgrade or an EventSource) or as a bearer token.
+func (s *Server) wsTokenFromRequest(r *http.Request) (wsClaims, error) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	return s.verifyWsToken(token)
+}
+
+func (s *Server) verifyWsToken(token string) (wsClaims, error) {
+	var c wsClaims
+	if !openClaims(s.wsTokenKey, token, &c) || time.Now().Unix() > c.Exp {
+		return c, errInvalidWsToken
+	}
+	return c, nil
+}
+
+// authorizeBillStream checks the subscription token of a bill websocket or
+// event stream request.
+func (s *Server) authorizeBillStream(w http.ResponseWriter, r *http.Request, billID uuid.UUID) bool {
+	c, err := s.wsTokenFromRequest(r)
+	if err != nil || c.Bill != billID.String() {
+		renderErr(w, http.StatusUnauthorized, errInvalidWsToken.Error())
+		return false
+	}
+	return true
+}
+
+// clientIP is the address connection limits are counted against.
+func (s *Server) clientIP(r *http.Request) string {
+	if s.configuration.TrustForwardedFor {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// canFollowBill: the API key the bill was created with, and its creator and
+// contributors once they proved their wallet, may read the bill's events
+// and transactions.
+func (s *Server) canFollowBill(r *http.Request, bill *storage.Bill) bool {
+	if keyID, err := s.apiKeyFromRequest(r); err == nil && keyID != "" && bill.APIKeyID != nil && *bill.APIKeyID == keyID {
+		return true
+	}
+	wallet, err := s.provenWallet(r)
+	if err != nil {
+		return false
+	}
+	if walletKey(wallet) == walletKey(bill.CreatorAddress) {
+		return true
+	}
+	involved, err := s.db.WalletInBill(r.Context(), wallet, bill.ID)
+	return err == nil && involved
+}
+
+// billForParticipant loads the bill of the request and answers 404 or 403
+// when it is missing or the caller may not follow it.
+func (s *Server) billForParticipant(w http.ResponseWriter, r *http.Request, billID uuid.UUID) (*storage.Bill, bool) {
+	bill, err := s.db.GetBill(r.Context(), billID)
+	if err != nil {
+		renderErr(w, http.StatusNotFound, err.Error())
+		return nil, false
+	}
+	if !s.canFollowBill(r, bill) {
+		renderErr(w, http.StatusForbidden, "not a participant of the bill")
+		return nil, false
+	}
+	return bill, true
+}
+
+// handleIssueWsToken hands out a short-lived token for a bill stream the
+// caller takes part in, or for the caller's user channel when no bill is
+// given. Both need a proven wallet or, for a bill, the bill's API key.
+func (s *Server) handleIssueWsToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var claims wsClaims
+		if billID, err := uuidFromVars(mux.Vars(r), "id"); err == nil {
+			if _, ok := s.billForParticipant(w, r, billID); !ok {
+				return
+			}
+			claims.Bill = billID.String()
+		} else {
+			wallet, err := s.provenWallet(r)
+			if err != nil {
+				renderErr(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+			claims.Wallet = wallet
+		}
+
+		expires := time.Now().Add(time.Duration(s.configuration.WsTokenTTLSeconds) * time.Second).UTC()
+		claims.Exp = expires.Unix()
+		token, err := s.issueWsToken(claims)
+		if err != nil {
+			renderErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		renderJSON(w, wsTokenResponse{Token: token, ExpiresAt: expires})
+	}
+}
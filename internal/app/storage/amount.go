@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// TonDecimals is the number of decimal places between TON and nanoton.
+const TonDecimals = 9
+
+var errInvalidAmount = errors.New("invalid amount")
+
+// maxExactFloat is 2^53, above it float64 no longer holds every integer.
+const maxExactFloat = 1 << 53
+
+// Amount is an integer quantity in the smallest token units (nanoton for TON).
+// It is stored as Postgres numeric or SQLite text and serialized to JSON as a
+// string. The zero value is 0; an Amount is never mutated once built.
+type Amount struct {
+	i *big.Int
+}
+
+func NewAmount(v int64) Amount {
+	return Amount{i: big.NewInt(v)}
+}
+
+func AmountFromBig(v *big.Int) Amount {
+	if v == nil {
+		return Amount{}
+	}
+	return Amount{i: new(big.Int).Set(v)}
+}
+
+// ParseNano parses an integer amount in the smallest units, e.g. "1500000000".
+func ParseNano(s string) (Amount, error) {
+	s = strings.TrimSpace(s)
+	v, ok := new(big.Int).SetString(s, 10)
+	if !ok || s == "" || s[0] == '+' {
+		return Amount{}, fmt.Errorf("%w: %q", errInvalidAmount, s)
+	}
+	return Amount{i: v}, nil
+}
+
+// ParseAmount accepts either raw nanoton ("1500000000") or a human TON
+// decimal ("1.5"). The decimal point decides: "1" is 1 nanoton, "1.0" is
+// 1 TON.
+func ParseAmount(s string) (Amount, error) {
+	return ParseAmountDecimals(s, TonDecimals)
+}
+
+// ParseAmountDecimals is ParseAmount for a token with the given number of
+// decimals. Strings without a decimal point are taken as raw units.
+func ParseAmountDecimals(s string, decimals int) (Amount, error) {
+	s = strings.TrimSpace(s)
+	whole, frac, isDecimal := strings.Cut(s, ".")
+	if !isDecimal {
+		return ParseNano(s)
+	}
+	if strings.ContainsAny(frac, "+-") {
+		return Amount{}, fmt.Errorf("%w: %q", errInvalidAmount, s)
+	}
+	if len(frac) > decimals {
+		return Amount{}, fmt.Errorf("%w: %q has more than %d decimals", errInvalidAmount, s, decimals)
+	}
+	if whole == "" || whole == "-" {
+		whole += "0"
+	}
+	return ParseNano(whole + frac + strings.Repeat("0", decimals-len(frac)))
+}
+
+func (a Amount) big() *big.Int {
+	if a.i == nil {
+		return new(big.Int)
+	}
+	return a.i
+}
+
+// BigInt returns a copy of the underlying value.
+func (a Amount) BigInt() *big.Int {
+	return new(big.Int).Set(a.big())
+}
+
+func (a Amount) Add(b Amount) Amount {
+	return Amount{i: new(big.Int).Add(a.big(), b.big())}
+}
+
+func (a Amount) Sub(b Amount) Amount {
+	return Amount{i: new(big.Int).Sub(a.big(), b.big())}
+}
+
+func (a Amount) Cmp(b Amount) int {
+	return a.big().Cmp(b.big())
+}
+
+func (a Amount) Sign() int {
+	return a.big().Sign()
+}
+
+func (a Amount) IsZero() bool {
+	return a.Sign() == 0
+}
+
+// String returns the raw integer in the smallest units.
+func (a Amount) String() string {
+	return a.big().String()
+}
+
+// Decimal formats the amount with the given number of decimals, e.g. "1.5".
+func (a Amount) Decimal(decimals int) string {
+	v := a.big()
+	neg := v.Sign() < 0
+	digits := new(big.Int).Abs(v).String()
+	if len(digits) <= decimals {
+		digits = strings.Repeat("0", decimals-len(digits)+1) + digits
+	}
+	whole, frac := digits[:len(digits)-decimals], strings.TrimRight(digits[len(digits)-decimals:], "0")
+	out := whole
+	if frac != "" {
+		out += "." + frac
+	}
+	if neg {
+		out = "-" + out
+	}
+	return out
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+// UnmarshalJSON accepts a quoted raw or decimal amount as well as a bare JSON
+// number in raw units, which older clients send.
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		*a = Amount{}
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		v, err := ParseAmount(s)
+		if err != nil {
+			return err
+		}
+		*a = v
+		return nil
+	}
+	v, err := ParseNano(string(data))
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+func (a Amount) Value() (driver.Value, error) {
+	return a.String(), nil
+}
+
+func (a *Amount) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*a = Amount{}
+		return nil
+	case int64:
+		*a = NewAmount(v)
+		return nil
+	case float64:
+		// a REAL is only taken when it is certainly the integer it shows
+		if v != math.Trunc(v) || math.Abs(v) > maxExactFloat {
+			return fmt.Errorf("storage: %w: %v is not an exact integer", errInvalidAmount, v)
+		}
+		*a = NewAmount(int64(v))
+		return nil
+	case []byte:
+		return a.scanString(string(v))
+	case string:
+		return a.scanString(v)
+	default:
+		return fmt.Errorf("storage: cannot scan %T into Amount", src)
+	}
+}
+
+func (a *Amount) scanString(s string) error {
+	// numeric columns may come back as "100" or "100.000"
+	if whole, frac, ok := strings.Cut(s, "."); ok && strings.Trim(frac, "0") == "" {
+		s = whole
+	}
+	v, err := ParseNano(s)
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+func (Amount) GormDataType() string {
+	return "numeric(78,0)"
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// BillEvent is one entry of the per-bill event log behind the websocket feed.
+// Seq is allocated from bills.event_seq, so it has no gaps until pruning.
+type BillEvent struct {
+	BillID    uuid.UUID       `gorm:"type:uuid;primaryKey"`
+	Seq       uint64          `gorm:"primaryKey"`
+	Type      string          `gorm:"type:varchar(32);not null"`
+	Version   int             `gorm:"not null"`
+	Payload   json.RawMessage `gorm:"type:jsonb;not null"`
+	CreatedAt time.Time       `gorm:"autoCreateTime"`
+}
+
+// AppendBillEvent assigns the next seq of the bill and stores the event in
+// the same DB transaction.
+func (s *Storage) AppendBillEvent(ctx context.Context, billID uuid.UUID, typ string, version int, payload json.RawMessage) (*BillEvent, error) {
+	ev := &BillEvent{
+		BillID:  billID,
+		Type:    typ,
+		Version: version,
+		Payload: payload,
+	}
+
+	err := s.conn.WithContext(ctx).Transaction(func(db *gorm.DB) error {
+		var bill Bill
+		if err := db.Model(&bill).
+			Clauses(clause.Returning{Columns: []clause.Column{{Name: "event_seq"}}}).
+			Where("id = ?", billID).
+			UpdateColumn("event_seq", gorm.Expr("event_seq + 1")).Error; err != nil {
+			return err
+		}
+		ev.Seq = bill.EventSeq
+		return db.Create(ev).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
+
+// ListBillEvents returns up to limit events of the bill with seq above
+// afterSeq, oldest first.
+func (s *Storage) ListBillEvents(ctx context.Context, billID uuid.UUID, afterSeq uint64, limit int) ([]BillEvent, error) {
+	var events []BillEvent
+	if err := s.conn.WithContext(ctx).
+		Where("bill_id = ? AND seq > ?", billID, afterSeq).
+		Order("seq ASC").
+		Limit(limit).
+		Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (s *Storage) PruneBillEvents(ctx context.Context, before time.Time) (int64, error) {
+	res := s.conn.WithContext(ctx).
+		Where("created_at < ?", before.UTC()).
+		Delete(&BillEvent{})
+	return res.RowsAffected, res.Error
+}
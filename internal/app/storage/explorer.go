@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/url"
+
+	"gorm.io/gorm"
+)
+
+var explorerTxURL = "https://tonviewer.com/transaction/"
+
+// explorerURL links a toncenter transaction hash (base64) to the block explorer,
+// which expects the hash in hex.
+func explorerURL(hash string) string {
+	if hash == "" || explorerTxURL == "" {
+		return ""
+	}
+	if raw, err := base64.StdEncoding.DecodeString(hash); err == nil {
+		return explorerTxURL + hex.EncodeToString(raw)
+	}
+	if raw, err := base64.URLEncoding.DecodeString(hash); err == nil {
+		return explorerTxURL + hex.EncodeToString(raw)
+	}
+	return explorerTxURL + url.PathEscape(hash)
+}
+
+func (t *Transaction) AfterFind(_ *gorm.DB) error {
+	if t.TxHash != nil {
+		t.ExplorerURL = explorerURL(*t.TxHash)
+	}
+	return nil
+}
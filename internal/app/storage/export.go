@@ -0,0 +1,333 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrImportNotEmpty = errors.New("import needs an empty database")
+
+// dumpLine is one line of an export: a row of table, parents before children.
+type dumpLine struct {
+	Table string          `json:"table"`
+	Row   json.RawMessage `json:"row"`
+}
+
+// The record types carry the columns the API hides from JSON; the models
+// convert to them directly.
+type billRecord struct {
+	ID                 uuid.UUID     `json:"id"`
+	Goal               Amount        `json:"goal"`
+	Collected          Amount        `json:"collected"`
+	CreatorAddress     string        `json:"creator_address"`
+	DestinationAddress string        `json:"destination_address"`
+	CreatedAt          time.Time     `json:"created_at"`
+	EndedAt            time.Time     `json:"ended_at"`
+	Status             BillStatus    `json:"status"`
+	Transactions       []Transaction `json:"-"`
+	ProxyWallet        string        `json:"proxy_wallet"`
+	StateInitHash      string        `json:"state_init_hash"`
+	IndexedLT          uint64        `json:"indexed_lt"`
+	EventSeq           uint64        `json:"event_seq"`
+	APIKeyID           *string       `json:"api_key_id"`
+	Version            uint64        `json:"version"`
+}
+
+type ledgerEntryRecord struct {
+	ID        string          `json:"id"`
+	BillID    uuid.UUID       `json:"bill_id"`
+	Kind      EntryKind       `json:"kind"`
+	TxID      *uuid.UUID      `json:"tx_id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Postings  []LedgerPosting `json:"-"`
+}
+
+type ledgerPostingRecord struct {
+	EntryID string `json:"entry_id"`
+	Account string `json:"account"`
+	Amount  Amount `json:"amount"`
+}
+
+type billEventRecord struct {
+	BillID    uuid.UUID       `json:"bill_id"`
+	Seq       uint64          `json:"seq"`
+	Type      string          `json:"type"`
+	Version   int             `json:"version"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+type webhookRecord struct {
+	ID        uuid.UUID  `json:"id"`
+	APIKeyID  *string    `json:"api_key_id"`
+	BillID    *uuid.UUID `json:"bill_id"`
+	URL       string     `json:"url"`
+	Secret    string     `json:"secret"`
+	Events    string     `json:"events"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type webhookDeliveryRecord struct {
+	ID             uuid.UUID       `json:"id"`
+	WebhookID      uuid.UUID       `json:"webhook_id"`
+	BillID         uuid.UUID       `json:"bill_id"`
+	EventSeq       uint64          `json:"event_seq"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         DeliveryStatus  `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	LastStatusCode *int            `json:"last_status_code"`
+	LastError      *string         `json:"last_error"`
+	DeliveredAt    *time.Time      `json:"delivered_at"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+}
+
+type dumpTable struct {
+	name  string
+	model any
+	order string
+	// record scans the current row into its exported form
+	record func(db *gorm.DB, rows *sql.Rows) (any, error)
+	// load decodes an exported row into a model ready to insert
+	load func(row json.RawMessage) (any, error)
+}
+
+// dumpTables lists what export and import move, in insert order. Idempotency
+// keys are left out, they only matter for minutes.
+var dumpTables = []dumpTable{
+	{
+		name: "bills", model: &Bill{}, order: "created_at, id",
+		record: func(db *gorm.DB, rows *sql.Rows) (any, error) {
+			var b Bill
+			err := db.ScanRows(rows, &b)
+			return billRecord(b), err
+		},
+		load: func(row json.RawMessage) (any, error) {
+			var r billRecord
+			err := json.Unmarshal(row, &r)
+			b := Bill(r)
+			return &b, err
+		},
+	},
+	{
+		name: "transactions", model: &Transaction{}, order: "created_at, id",
+		record: func(db *gorm.DB, rows *sql.Rows) (any, error) {
+			var t Transaction
+			err := db.ScanRows(rows, &t)
+			return t, err
+		},
+		load: func(row json.RawMessage) (any, error) {
+			var t Transaction
+			err := json.Unmarshal(row, &t)
+			return &t, err
+		},
+	},
+	{
+		name: "ledger_entries", model: &LedgerEntry{}, order: "created_at, id",
+		record: func(db *gorm.DB, rows *sql.Rows) (any, error) {
+			var e LedgerEntry
+			err := db.ScanRows(rows, &e)
+			return ledgerEntryRecord(e), err
+		},
+		load: func(row json.RawMessage) (any, error) {
+			var r ledgerEntryRecord
+			err := json.Unmarshal(row, &r)
+			e := LedgerEntry(r)
+			return &e, err
+		},
+	},
+	{
+		name: "ledger_postings", model: &LedgerPosting{}, order: "entry_id, account",
+		record: func(db *gorm.DB, rows *sql.Rows) (any, error) {
+			var p LedgerPosting
+			err := db.ScanRows(rows, &p)
+			return ledgerPostingRecord(p), err
+		},
+		load: func(row json.RawMessage) (any, error) {
+			var r ledgerPostingRecord
+			err := json.Unmarshal(row, &r)
+			p := LedgerPosting(r)
+			return &p, err
+		},
+	},
+	{
+		name: "watch_jobs", model: &WatchJob{}, order: "created_at, tx_id",
+		record: func(db *gorm.DB, rows *sql.Rows) (any, error) {
+			var j WatchJob
+			err := db.ScanRows(rows, &j)
+			return j, err
+		},
+		load: func(row json.RawMessage) (any, error) {
+			var j WatchJob
+			err := json.Unmarshal(row, &j)
+			return &j, err
+		},
+	},
+	{
+		name: "bill_events", model: &BillEvent{}, order: "bill_id, seq",
+		record: func(db *gorm.DB, rows *sql.Rows) (any, error) {
+			var ev BillEvent
+			err := db.ScanRows(rows, &ev)
+			return billEventRecord(ev), err
+		},
+		load: func(row json.RawMessage) (any, error) {
+			var r billEventRecord
+			err := json.Unmarshal(row, &r)
+			ev := BillEvent(r)
+			return &ev, err
+		},
+	},
+	{
+		name: "webhooks", model: &Webhook{}, order: "created_at, id",
+		record: func(db *gorm.DB, rows *sql.Rows) (any, error) {
+			var wh Webhook
+			err := db.ScanRows(rows, &wh)
+			return webhookRecord(wh), err
+		},
+		load: func(row json.RawMessage) (any, error) {
+			var r webhookRecord
+			err := json.Unmarshal(row, &r)
+			wh := Webhook(r)
+			return &wh, err
+		},
+	},
+	{
+		name: "webhook_deliveries", model: &WebhookDelivery{}, order: "created_at, id",
+		record: func(db *gorm.DB, rows *sql.Rows) (any, error) {
+			var d WebhookDelivery
+			err := db.ScanRows(rows, &d)
+			return webhookDeliveryRecord(d), err
+		},
+		load: func(row json.RawMessage) (any, error) {
+			var r webhookDeliveryRecord
+			err := json.Unmarshal(row, &r)
+			d := WebhookDelivery(r)
+			return &d, err
+		},
+	},
+	{
+		name: "telegram_subscribers", model: &TelegramSubscriber{}, order: "wallet",
+		record: func(db *gorm.DB, rows *sql.Rows) (any, error) {
+			var sub TelegramSubscriber
+			err := db.ScanRows(rows, &sub)
+			return sub, err
+		},
+		load: func(row json.RawMessage) (any, error) {
+			var sub TelegramSubscriber
+			err := json.Unmarshal(row, &sub)
+			return &sub, err
+		},
+	},
+}
+
+// Export writes every table as JSON lines, one row per line, from a single
+// snapshot. The output loads into either driver with Import.
+func (s *Storage) Export(ctx context.Context, w io.Writer) error {
+	var opts []*sql.TxOptions
+	if s.driver == DriverPostgres {
+		opts = append(opts, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	err := s.conn.WithContext(ctx).Transaction(func(db *gorm.DB) error {
+		for _, t := range dumpTables {
+			n, err := exportTable(db, enc, t)
+			if err != nil {
+				return fmt.Errorf("export %s: %w", t.name, err)
+			}
+			s.log.WithFields(logrus.Fields{"table": t.name, "rows": n}).Info("export: table written")
+		}
+		return nil
+	}, opts...)
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func exportTable(db *gorm.DB, enc *json.Encoder, t dumpTable) (int, error) {
+	rows, err := db.Model(t.model).Order(t.order).Rows()
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		rec, err := t.record(db, rows)
+		if err != nil {
+			return n, err
+		}
+		row, err := json.Marshal(rec)
+		if err != nil {
+			return n, err
+		}
+		if err := enc.Encode(dumpLine{Table: t.name, Row: row}); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+// Import loads an Export into an empty, migrated database in one DB
+// transaction, so a failed import leaves nothing behind.
+func (s *Storage) Import(ctx context.Context, r io.Reader) error {
+	tables := make(map[string]dumpTable, len(dumpTables))
+	for _, t := range dumpTables {
+		tables[t.name] = t
+	}
+
+	return s.conn.WithContext(ctx).Transaction(func(db *gorm.DB) error {
+		var bills int64
+		if err := db.Model(&Bill{}).Count(&bills).Error; err != nil {
+			return err
+		}
+		if bills > 0 {
+			return fmt.Errorf("%w: found %d bills", ErrImportNotEmpty, bills)
+		}
+
+		counts := make(map[string]int, len(dumpTables))
+		dec := json.NewDecoder(bufio.NewReader(r))
+		for line := 1; ; line++ {
+			var l dumpLine
+			if err := dec.Decode(&l); err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				return fmt.Errorf("import line %d: %w", line, err)
+			}
+			t, ok := tables[l.Table]
+			if !ok {
+				return fmt.Errorf("import line %d: unknown table %q", line, l.Table)
+			}
+			row, err := t.load(l.Row)
+			if err != nil {
+				return fmt.Errorf("import line %d: %w", line, err)
+			}
+			if err := db.Omit(clause.Associations).Create(row).Error; err != nil {
+				return fmt.Errorf("import line %d (%s): %w", line, l.Table, err)
+			}
+			counts[l.Table]++
+		}
+
+		for _, t := range dumpTables {
+			s.log.WithFields(logrus.Fields{"table": t.name, "rows": counts[t.name]}).Info("import: table loaded")
+		}
+		return nil
+	})
+}
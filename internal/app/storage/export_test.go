@@ -0,0 +1,30 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/config"
+	"github.com/sirupsen/logrus"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// OpenPostgresDSN connects to the Postgres database at dsn, for tests that
+// take their database from the environment rather than a config.
+func OpenPostgresDSN(dsn string, log *logrus.Logger) (*Storage, error) {
+	conn, err := gorm.Open(postgres.Open(dsn), &gorm.Config{TranslateError: true})
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{configuration: config.NewConfiguration(), conn: conn, driver: DriverPostgres, log: log}, nil
+}
+
+// MigrateUpTo applies the pending migrations up to and including version.
+func (s *Storage) MigrateUpTo(ctx context.Context, version int64) error {
+	p, err := s.migrator()
+	if err != nil {
+		return err
+	}
+	_, err = p.UpTo(ctx, version)
+	return err
+}
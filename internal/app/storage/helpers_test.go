@@ -0,0 +1,90 @@
+package storage_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/config"
+	"github.com/Hackathon-Apps/go-split-api/internal/app/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// postgresDSNEnv names a Postgres database the tests may create schemas in;
+// without it the Postgres tests are skipped.
+const postgresDSNEnv = "SPLIT_TEST_POSTGRES_DSN"
+
+func testLogger() *logrus.Logger {
+	log := logrus.New()
+	log.SetLevel(logrus.WarnLevel)
+	return log
+}
+
+// openSQLite returns an unmigrated store on a fresh file.
+func openSQLite(t *testing.T) *storage.Storage {
+	t.Helper()
+	cfg := config.NewConfiguration()
+	cfg.DbDriver = storage.DriverSQLite
+	cfg.DbPath = filepath.Join(t.TempDir(), "split.db")
+	db, err := storage.Connect(cfg, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeStorage(db) })
+	return db
+}
+
+// openPostgres returns an unmigrated store on a schema of its own in the
+// database from SPLIT_TEST_POSTGRES_DSN, dropped when the test ends.
+func openPostgres(t *testing.T) *storage.Storage {
+	t.Helper()
+	dsn := os.Getenv(postgresDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s not set", postgresDSNEnv)
+	}
+
+	admin, err := storage.OpenPostgresDSN(dsn, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("split_test_%d", time.Now().UnixNano())
+	if err := admin.Conn().Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	sep := " "
+	if strings.Contains(dsn, "://") {
+		sep = "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+	}
+	db, err := storage.OpenPostgresDSN(dsn+sep+"search_path="+schema, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		closeStorage(db)
+		_ = admin.Conn().Exec("DROP SCHEMA " + schema + " CASCADE").Error
+		closeStorage(admin)
+	})
+	return db
+}
+
+func migrated(t *testing.T, db *storage.Storage) *storage.Storage {
+	t.Helper()
+	if err := db.MigrateUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func closeStorage(db *storage.Storage) {
+	if sqlDB, err := db.Conn().DB(); err == nil {
+		_ = sqlDB.Close()
+	}
+}
@@ -0,0 +1,280 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrUnbalancedEntry = errors.New("ledger entry does not balance")
+
+type EntryKind string
+
+const (
+	// EntryContribution: a confirmed contribution, contributor to escrow.
+	EntryContribution EntryKind = "CONTRIBUTION"
+	// EntryDeposit: value a confirmed TRANSFER or REFUND message brought to
+	// the proxy; it does not count towards the goal.
+	EntryDeposit EntryKind = "DEPOSIT"
+	// EntryReversal: a counted contribution bounced or returned, escrow to
+	// contributor.
+	EntryReversal EntryKind = "REVERSAL"
+	// EntryPayout: escrow to the bill destination.
+	EntryPayout EntryKind = "PAYOUT"
+	// EntryFee: escrow to the fee collector.
+	EntryFee EntryKind = "FEE"
+	// EntryRefund: other value the proxy sent back to a depositor.
+	EntryRefund EntryKind = "REFUND"
+)
+
+// collectedKinds are the entries Bill.Collected is projected from.
+var collectedKinds = []EntryKind{EntryContribution, EntryReversal}
+
+// Ledger accounts are named by kind and owner. Wallets are kept in the form
+// they were recorded in, like Transaction.SenderAddress.
+func ContributorAccount(wallet string) string  { return "contributor:" + wallet }
+func EscrowAccount(billID uuid.UUID) string    { return "escrow:" + billID.String() }
+func DestinationAccount(wallet string) string  { return "destination:" + wallet }
+func FeeCollectorAccount(wallet string) string { return "fee:" + wallet }
+
+// LedgerEntry is one balanced journal entry: its postings sum to zero. ID is
+// derived from what caused the entry, so recording it twice is a no-op.
+type LedgerEntry struct {
+	ID        string          `json:"id" gorm:"type:varchar(160);primaryKey"`
+	BillID    uuid.UUID       `json:"bill_id" gorm:"type:uuid;not null"`
+	Kind      EntryKind       `json:"kind" gorm:"type:varchar(16);not null"`
+	TxID      *uuid.UUID      `json:"tx_id,omitempty" gorm:"type:uuid"`
+	CreatedAt time.Time       `json:"created_at" gorm:"autoCreateTime"`
+	Postings  []LedgerPosting `json:"postings" gorm:"foreignKey:EntryID"`
+}
+
+// LedgerPosting moves Amount into Account; negative amounts move value out.
+type LedgerPosting struct {
+	EntryID string `json:"-" gorm:"type:varchar(160);primaryKey"`
+	Account string `json:"account" gorm:"primaryKey"`
+	Amount  Amount `json:"amount" gorm:"not null"`
+}
+
+// NewTransferEntry builds an entry moving amount from one account to another.
+func NewTransferEntry(kind EntryKind, id string, billID uuid.UUID, txID *uuid.UUID, from, to string, amount Amount) LedgerEntry {
+	return LedgerEntry{
+		ID:     id,
+		BillID: billID,
+		Kind:   kind,
+		TxID:   txID,
+		Postings: []LedgerPosting{
+			{EntryID: id, Account: to, Amount: amount},
+			{EntryID: id, Account: from, Amount: NewAmount(0).Sub(amount)},
+		},
+	}
+}
+
+// confirmationEntry credits the escrow of the bill with a confirmed tx.
+func confirmationEntry(tx Transaction) LedgerEntry {
+	kind := EntryContribution
+	if tx.OpType != OpContribute {
+		kind = EntryDeposit
+	}
+	return NewTransferEntry(kind, "confirm:"+tx.ID.String(), tx.BillID, &tx.ID,
+		ContributorAccount(tx.SenderAddress), EscrowAccount(tx.BillID), tx.Credited())
+}
+
+// reversalEntry undoes confirmationEntry for a bounced or returned tx.
+func reversalEntry(tx Transaction) LedgerEntry {
+	kind := EntryReversal
+	if tx.OpType != OpContribute {
+		kind = EntryRefund
+	}
+	return NewTransferEntry(kind, "reverse:"+tx.ID.String(), tx.BillID, &tx.ID,
+		EscrowAccount(tx.BillID), ContributorAccount(tx.SenderAddress), tx.Credited())
+}
+
+func (e LedgerEntry) balanced() bool {
+	if len(e.Postings) < 2 {
+		return false
+	}
+	sum := Amount{}
+	for _, p := range e.Postings {
+		sum = sum.Add(p.Amount)
+	}
+	return sum.IsZero()
+}
+
+// insertEntry stores e and its postings with db, reporting false when an
+// entry with the same ID exists.
+func insertEntry(db *gorm.DB, e *LedgerEntry) (bool, error) {
+	if !e.balanced() {
+		return false, fmt.Errorf("%w: %s", ErrUnbalancedEntry, e.ID)
+	}
+	postings := e.Postings
+	for i := range postings {
+		postings[i].EntryID = e.ID
+	}
+
+	res := db.Omit(clause.Associations).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(e)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return false, res.Error
+	}
+	return true, db.Create(&postings).Error
+}
+
+// collectedProjection is the sum Bill.Collected must equal: what the bill's
+// contributions, net of reversals, put into its escrow.
+func collectedProjection(db *gorm.DB, billID uuid.UUID) *gorm.DB {
+	return db.Session(&gorm.Session{NewDB: true}).
+		Model(&LedgerPosting{}).
+		Select("COALESCE(SUM(ledger_postings.amount), 0)").
+		Joins("JOIN ledger_entries e ON e.id = ledger_postings.entry_id").
+		Where("e.bill_id = ? AND e.kind IN ? AND ledger_postings.account = ?", billID, collectedKinds, EscrowAccount(billID))
+}
+
+// PostLedgerEntry records an entry observed outside the transaction flow,
+// like a payout; false means it was already recorded.
+func (s *Storage) PostLedgerEntry(ctx context.Context, e LedgerEntry) (bool, error) {
+	var inserted bool
+	err := s.conn.WithContext(ctx).Transaction(func(db *gorm.DB) error {
+		var err error
+		inserted, err = insertEntry(db, &e)
+		return err
+	})
+	return inserted, err
+}
+
+func (s *Storage) ListLedgerEntries(ctx context.Context, billID uuid.UUID) ([]LedgerEntry, error) {
+	var entries []LedgerEntry
+	if err := s.conn.WithContext(ctx).
+		Preload("Postings", func(db *gorm.DB) *gorm.DB {
+			return db.Order("CAST(amount AS NUMERIC) DESC")
+		}).
+		Where("bill_id = ?", billID).
+		Order("created_at, id").
+		Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (s *Storage) AccountBalance(ctx context.Context, account string) (Amount, error) {
+	var sum Amount
+	err := s.conn.WithContext(ctx).
+		Model(&LedgerPosting{}).
+		Select("COALESCE(SUM(amount), 0)").
+		Where("account = ?", account).
+		Row().Scan(&sum)
+	return sum, err
+}
+
+// LedgerIssue is an inconsistency found by CheckLedger.
+type LedgerIssue struct {
+	BillID  uuid.UUID  `json:"bill_id"`
+	EntryID string     `json:"entry_id,omitempty"`
+	TxID    *uuid.UUID `json:"tx_id,omitempty"`
+	Problem string     `json:"problem"`
+}
+
+// CheckLedger reports entries that don't balance, bills whose Collected
+// differs from the ledger, confirmed or reversed transactions without their
+// entry and escrows paid out beyond what they received.
+func (s *Storage) CheckLedger(ctx context.Context) ([]LedgerIssue, error) {
+	db := s.conn.WithContext(ctx)
+	var issues []LedgerIssue
+
+	var unbalanced []struct {
+		ID       string
+		BillID   uuid.UUID
+		Sum      Amount
+		Postings int
+	}
+	if err := db.Table("ledger_entries e").
+		Select("e.id, e.bill_id, COALESCE(SUM(p.amount), 0) AS sum, COUNT(p.entry_id) AS postings").
+		Joins("LEFT JOIN ledger_postings p ON p.entry_id = e.id").
+		Group("e.id, e.bill_id").
+		Having("COALESCE(SUM(p.amount), 0) <> 0 OR COUNT(p.entry_id) < 2").
+		Scan(&unbalanced).Error; err != nil {
+		return nil, err
+	}
+	for _, u := range unbalanced {
+		issues = append(issues, LedgerIssue{
+			BillID:  u.BillID,
+			EntryID: u.ID,
+			Problem: fmt.Sprintf("entry sums to %s over %d postings", u.Sum, u.Postings),
+		})
+	}
+
+	var drifted []struct {
+		ID        uuid.UUID
+		Collected Amount
+		Projected Amount
+	}
+	projected := "COALESCE((SELECT SUM(p.amount) FROM ledger_postings p JOIN ledger_entries e ON e.id = p.entry_id" +
+		" WHERE e.bill_id = bills.id AND e.kind IN ? AND p.account = 'escrow:' || bills.id), 0)"
+	if err := db.Model(&Bill{}).
+		Select("id, collected, "+projected+" AS projected", collectedKinds).
+		Where("CAST(collected AS NUMERIC) <> "+projected, collectedKinds).
+		Scan(&drifted).Error; err != nil {
+		return nil, err
+	}
+	for _, d := range drifted {
+		issues = append(issues, LedgerIssue{
+			BillID:  d.ID,
+			Problem: fmt.Sprintf("collected is %s, ledger has %s", d.Collected, d.Projected),
+		})
+	}
+
+	var missing []struct {
+		ID     uuid.UUID
+		BillID uuid.UUID
+		Entry  string
+	}
+	// counted as in 00015: older contributions may lack confirmed_at
+	counted := "(t.confirmed_at IS NOT NULL OR t.status IN ?)"
+	countedStatuses := []TxStatus{StatusSuccess, StatusReturned}
+	if err := db.Raw(`SELECT t.id, t.bill_id, 'confirmation' AS entry FROM transactions t
+		WHERE `+counted+`
+		  AND NOT EXISTS (SELECT 1 FROM ledger_entries e WHERE e.tx_id = t.id AND e.kind IN ?)
+		UNION ALL
+		SELECT t.id, t.bill_id, 'reversal' AS entry FROM transactions t
+		WHERE `+counted+` AND t.reversed_at IS NOT NULL
+		  AND NOT EXISTS (SELECT 1 FROM ledger_entries e WHERE e.tx_id = t.id AND e.kind IN ?)`,
+		countedStatuses, []EntryKind{EntryContribution, EntryDeposit},
+		countedStatuses, []EntryKind{EntryReversal, EntryRefund}).
+		Scan(&missing).Error; err != nil {
+		return nil, err
+	}
+	for _, m := range missing {
+		issues = append(issues, LedgerIssue{
+			BillID:  m.BillID,
+			TxID:    &m.ID,
+			Problem: "no " + m.Entry + " entry for the transaction",
+		})
+	}
+
+	var overdrawn []struct {
+		BillID  uuid.UUID
+		Balance Amount
+	}
+	if err := db.Table("ledger_postings p").
+		Select("e.bill_id, SUM(p.amount) AS balance").
+		Joins("JOIN ledger_entries e ON e.id = p.entry_id").
+		Where("p.account = 'escrow:' || e.bill_id").
+		Group("e.bill_id").
+		Having("SUM(p.amount) < 0").
+		Scan(&overdrawn).Error; err != nil {
+		return nil, err
+	}
+	for _, o := range overdrawn {
+		issues = append(issues, LedgerIssue{
+			BillID:  o.BillID,
+			Problem: fmt.Sprintf("escrow overdrawn to %s", o.Balance),
+		})
+	}
+
+	return issues, nil
+}
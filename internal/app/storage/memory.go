@@ -0,0 +1,1172 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/xssnick/tonutils-go/address"
+	"gorm.io/gorm"
+)
+
+// ended_at column default of an active bill
+const billEndedAtDefault = 10 * time.Minute
+
+type idempotencyID struct {
+	scope, key string
+}
+
+// Memory is an in-process Repository with the semantics of the Postgres
+// Storage: the same status guards, errors and orderings. Nothing survives a
+// restart, it is meant for tests and for running handlers without a database.
+type Memory struct {
+	mu sync.Mutex
+
+	bills       map[uuid.UUID]Bill
+	txs         map[uuid.UUID]Transaction
+	watchJobs   map[uuid.UUID]WatchJob
+	idempotency map[idempotencyID]IdempotencyKey
+	events      map[uuid.UUID][]BillEvent
+	webhooks    map[uuid.UUID]Webhook
+	deliveries  map[uuid.UUID]WebhookDelivery
+	telegram    map[string]TelegramSubscriber
+	ledger      map[string]LedgerEntry
+
+	// insertion order, to keep sorts on equal timestamps stable
+	billOrder     []uuid.UUID
+	txOrder       []uuid.UUID
+	webhookOrder  []uuid.UUID
+	deliveryOrder []uuid.UUID
+	entryOrder    []string
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		bills:       map[uuid.UUID]Bill{},
+		txs:         map[uuid.UUID]Transaction{},
+		watchJobs:   map[uuid.UUID]WatchJob{},
+		idempotency: map[idempotencyID]IdempotencyKey{},
+		events:      map[uuid.UUID][]BillEvent{},
+		webhooks:    map[uuid.UUID]Webhook{},
+		deliveries:  map[uuid.UUID]WebhookDelivery{},
+		telegram:    map[string]TelegramSubscriber{},
+		ledger:      map[string]LedgerEntry{},
+	}
+}
+
+func (m *Memory) CreateBill(_ context.Context, goal Amount, creator, dest, proxyWalletAddress, stateInitHash, apiKeyID string) (*Bill, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UTC()
+	bill := Bill{
+		ID:                 uuid.New(),
+		Goal:               goal,
+		CreatorAddress:     creator,
+		DestinationAddress: dest,
+		CreatedAt:          now,
+		EndedAt:            now.Add(billEndedAtDefault),
+		Status:             StatusActive,
+		ProxyWallet:        proxyWalletAddress,
+		StateInitHash:      stateInitHash,
+		Version:            1,
+	}
+	if apiKeyID != "" {
+		bill.APIKeyID = &apiKeyID
+	}
+
+	m.bills[bill.ID] = bill
+	m.billOrder = append(m.billOrder, bill.ID)
+	return &bill, nil
+}
+
+func (m *Memory) GetBill(_ context.Context, billID uuid.UUID) (*Bill, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	bill, ok := m.bills[billID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &bill, nil
+}
+
+func (m *Memory) GetBillWithTransactions(_ context.Context, billID uuid.UUID) (*Bill, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	bill, ok := m.bills[billID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	bill.Transactions = m.billTxs(billID, func(Transaction) bool { return true })
+	return &bill, nil
+}
+
+func (m *Memory) GetBillWithSuccessTransactions(_ context.Context, billID uuid.UUID) (*Bill, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	bill, ok := m.bills[billID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	txs := m.billTxs(billID, func(tx Transaction) bool { return tx.Status == StatusSuccess })
+	sort.SliceStable(txs, func(i, j int) bool { return txs[i].CreatedAt.After(txs[j].CreatedAt) })
+	bill.Transactions = txs
+	return &bill, nil
+}
+
+func (m *Memory) UpdateBillStatus(_ context.Context, billID uuid.UUID, status BillStatus, version uint64) (*Bill, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	bill, ok := m.bills[billID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	if bill.Version != version {
+		return nil, ErrBillVersionConflict
+	}
+	bill.Status = status
+	bill.EndedAt = time.Now().UTC()
+	bill.Version++
+	m.bills[billID] = bill
+	return &bill, nil
+}
+
+func (m *Memory) SetBillIndexedLT(_ context.Context, billID uuid.UUID, lt uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if bill, ok := m.bills[billID]; ok && bill.IndexedLT < lt {
+		bill.IndexedLT = lt
+		m.bills[billID] = bill
+	}
+	return nil
+}
+
+func (m *Memory) ListBillsByStatus(_ context.Context, statuses ...BillStatus) ([]Bill, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var bills []Bill
+	for _, id := range m.billOrder {
+		bill := m.bills[id]
+		for _, st := range statuses {
+			if bill.Status == st {
+				bills = append(bills, bill)
+				break
+			}
+		}
+	}
+	return bills, nil
+}
+
+func (m *Memory) ListWalletBillIDs(_ context.Context, wallet string, limit int) ([]uuid.UUID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var bills []Bill
+	for _, id := range m.billOrder {
+		if m.walletInBill(wallet, id) {
+			bills = append(bills, m.bills[id])
+		}
+	}
+	sort.SliceStable(bills, func(i, j int) bool { return bills[i].CreatedAt.After(bills[j].CreatedAt) })
+
+	ids := make([]uuid.UUID, 0, len(bills))
+	for _, bill := range bills {
+		if len(ids) == limit {
+			break
+		}
+		ids = append(ids, bill.ID)
+	}
+	return ids, nil
+}
+
+func (m *Memory) WalletInBill(_ context.Context, wallet string, billID uuid.UUID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.walletInBill(wallet, billID), nil
+}
+
+func (m *Memory) walletInBill(wallet string, billID uuid.UUID) bool {
+	bill, ok := m.bills[billID]
+	if !ok {
+		return false
+	}
+	if bill.CreatorAddress == wallet {
+		return true
+	}
+	for _, tx := range m.txs {
+		if tx.BillID == billID && tx.SenderAddress == wallet {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Memory) AddTransaction(_ context.Context, billID uuid.UUID, amount Amount, sender string, op OpType) (*Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.bills[billID]; !ok {
+		return nil, gorm.ErrForeignKeyViolated
+	}
+	tx := Transaction{
+		ID:            uuid.New(),
+		BillID:        billID,
+		Amount:        amount,
+		SenderAddress: sender,
+		CreatedAt:     time.Now().UTC(),
+		OpType:        op,
+		Status:        StatusPending,
+	}
+	m.putTx(tx)
+	return &tx, nil
+}
+
+func (m *Memory) AddConfirmingTransaction(_ context.Context, billID uuid.UUID, sender string, op OpType, ref ChainRef) (*Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.bills[billID]; !ok {
+		return nil, gorm.ErrForeignKeyViolated
+	}
+	if _, ok := m.txByChainRef(ref.Hash, ref.LT); ok {
+		return nil, ErrChainTxReused
+	}
+	tx := Transaction{
+		ID:            uuid.New(),
+		BillID:        billID,
+		Amount:        ref.Amount,
+		SenderAddress: sender,
+		CreatedAt:     time.Now().UTC(),
+		OpType:        op,
+		Status:        StatusConfirming,
+		TxHash:        &ref.Hash,
+		LT:            &ref.LT,
+		RawAmount:     &ref.Amount,
+	}
+	m.putTx(tx)
+
+	tx.ExplorerURL = explorerURL(ref.Hash)
+	return &tx, nil
+}
+
+func (m *Memory) ListPendingTransactions(_ context.Context, billID uuid.UUID) ([]Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.billTxs(billID, func(tx Transaction) bool { return tx.Status == StatusPending }), nil
+}
+
+func (m *Memory) ListTransactions(_ context.Context, billID uuid.UUID, f TxFilter) ([]Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.billTxs(billID, func(tx Transaction) bool {
+		return (f.Status == "" || tx.Status == f.Status) &&
+			(f.OpType == "" || tx.OpType == f.OpType) &&
+			(f.Sender == "" || tx.SenderAddress == f.Sender)
+	}), nil
+}
+
+func (m *Memory) ListTransactionsByStatus(_ context.Context, status TxStatus) ([]Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var txs []Transaction
+	for _, id := range m.txOrder {
+		if tx := m.txs[id]; tx.Status == status {
+			txs = append(txs, withExplorerURL(tx))
+		}
+	}
+	sortTxsByCreated(txs)
+	return txs, nil
+}
+
+func (m *Memory) GetTransaction(_ context.Context, txId uuid.UUID) (*Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx, ok := m.txs[txId]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	tx = withExplorerURL(tx)
+	return &tx, nil
+}
+
+func (m *Memory) GetTransactionByChainRef(_ context.Context, hash string, lt uint64) (*Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx, ok := m.txByChainRef(hash, lt)
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	tx = withExplorerURL(tx)
+	return &tx, nil
+}
+
+func (m *Memory) ChainTxUsed(_ context.Context, hash string, lt uint64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.txByChainRef(hash, lt)
+	return ok, nil
+}
+
+func (m *Memory) FailTransaction(_ context.Context, txID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx, ok := m.txs[txID]
+	if !ok || tx.Status != StatusPending {
+		return ErrTxNotPending
+	}
+	tx.Status = StatusFailed
+	m.txs[txID] = tx
+	return nil
+}
+
+func (m *Memory) ConfirmTransaction(_ context.Context, txID uuid.UUID, ref ChainRef) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx, ok := m.txs[txID]
+	if !ok || tx.Status != StatusPending {
+		return ErrTxNotPending
+	}
+	if used, ok := m.txByChainRef(ref.Hash, ref.LT); ok && used.ID != txID {
+		return ErrChainTxReused
+	}
+
+	tx.Status = StatusConfirming
+	tx.TxHash = &ref.Hash
+	tx.LT = &ref.LT
+	tx.RawAmount = &ref.Amount
+	m.txs[txID] = tx
+	return nil
+}
+
+func (m *Memory) CancelTransaction(_ context.Context, txID uuid.UUID, sender string) (*Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx, ok := m.txs[txID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	if tx.SenderAddress != sender {
+		return nil, ErrTxNotOwned
+	}
+	if tx.Status != StatusPending {
+		return nil, ErrTxNotPending
+	}
+
+	tx.Status = StatusCancelled
+	m.txs[txID] = tx
+	tx = withExplorerURL(tx)
+	return &tx, nil
+}
+
+func (m *Memory) SetTransactionMcSeqno(_ context.Context, txID uuid.UUID, seqno uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if tx, ok := m.txs[txID]; ok && tx.Status == StatusConfirming {
+		tx.McSeqno = &seqno
+		m.txs[txID] = tx
+	}
+	return nil
+}
+
+func (m *Memory) ConfirmContribution(_ context.Context, txID uuid.UUID) (*Confirmation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx, ok := m.txs[txID]
+	if !ok || tx.Status != StatusConfirming {
+		return nil, ErrTxNotConfirming
+	}
+	bill, ok := m.bills[tx.BillID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	now := time.Now().UTC()
+	tx.Status = StatusSuccess
+	tx.ConfirmedAt = &now
+	m.txs[txID] = tx
+
+	out := &Confirmation{PrevStatus: bill.Status}
+	if _, err := m.postEntry(confirmationEntry(tx)); err != nil {
+		return nil, err
+	}
+	bill.Collected = m.collectedProjection(bill.ID)
+	if bill.Status == StatusActive && bill.Collected.Cmp(bill.Goal) >= 0 {
+		bill.Status = StatusDone
+		bill.EndedAt = now
+	}
+	bill.Version++
+	m.bills[bill.ID] = bill
+
+	out.Transaction = withExplorerURL(tx)
+	out.Bill = bill
+	return out, nil
+}
+
+func (m *Memory) BounceTransaction(_ context.Context, txID uuid.UUID, ref ChainRef) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx, ok := m.txs[txID]
+	if !ok || tx.Status != StatusPending {
+		return ErrTxNotPending
+	}
+	if used, ok := m.txByChainRef(ref.Hash, ref.LT); ok && used.ID != txID {
+		return ErrChainTxReused
+	}
+
+	now := time.Now().UTC()
+	tx.Status = StatusBounced
+	tx.TxHash = &ref.Hash
+	tx.LT = &ref.LT
+	tx.RawAmount = &ref.Amount
+	tx.ReversalTxHash = &ref.Hash
+	tx.ReversalLT = &ref.LT
+	tx.ReversedAt = &now
+	m.txs[txID] = tx
+	return nil
+}
+
+func (m *Memory) ReverseContribution(_ context.Context, txID uuid.UUID, status TxStatus, ref ChainRef) (*Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx, ok := m.txs[txID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	if tx.Status != StatusSuccess {
+		return nil, ErrTxNotSuccess
+	}
+
+	now := time.Now().UTC()
+	tx.Status = status
+	tx.ReversalTxHash = &ref.Hash
+	tx.ReversalLT = &ref.LT
+	tx.ReversedAt = &now
+	m.txs[txID] = tx
+
+	if _, err := m.postEntry(reversalEntry(tx)); err != nil {
+		return nil, err
+	}
+	if bill, ok := m.bills[tx.BillID]; ok {
+		bill.Collected = m.collectedProjection(bill.ID)
+		bill.Version++
+		m.bills[bill.ID] = bill
+	}
+
+	tx = withExplorerURL(tx)
+	return &tx, nil
+}
+
+func (m *Memory) GetHistory(_ context.Context, sender string) ([]HistoryItem, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	type entry struct {
+		bill   Bill
+		lastTx time.Time
+	}
+	var entries []entry
+	for _, id := range m.billOrder {
+		var last time.Time
+		found := false
+		for _, tx := range m.txs {
+			if tx.BillID == id && tx.SenderAddress == sender && tx.Status == StatusSuccess {
+				if !found || tx.CreatedAt.After(last) {
+					last = tx.CreatedAt
+				}
+				found = true
+			}
+		}
+		if found {
+			bill := m.bills[id]
+			bill.Transactions = m.billTxs(id, func(Transaction) bool { return true })
+			entries = append(entries, entry{bill: bill, lastTx: last})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].lastTx.After(entries[j].lastTx) })
+
+	senderRaw := address.MustParseAddr(sender).StringRaw()
+	history := make([]HistoryItem, 0, len(entries))
+	for _, e := range entries {
+		history = append(history, historyItem(e.bill, senderRaw))
+	}
+	return history, nil
+}
+
+func (m *Memory) CreateWatchJob(_ context.Context, txID, billID uuid.UUID, deadline time.Time) (*WatchJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.txs[txID]; !ok {
+		return nil, gorm.ErrForeignKeyViolated
+	}
+	if _, ok := m.watchJobs[txID]; ok {
+		return nil, gorm.ErrDuplicatedKey
+	}
+
+	now := time.Now().UTC()
+	job := WatchJob{
+		TxID:      txID,
+		BillID:    billID,
+		Deadline:  deadline.UTC(),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	m.watchJobs[txID] = job
+	return &job, nil
+}
+
+func (m *Memory) GetWatchJob(_ context.Context, txID uuid.UUID) (*WatchJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.watchJobs[txID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &job, nil
+}
+
+func (m *Memory) UpdateWatchJobProgress(_ context.Context, txID uuid.UUID, attempts int, lastLT uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if job, ok := m.watchJobs[txID]; ok {
+		job.Attempts = attempts
+		job.LastLT = lastLT
+		job.UpdatedAt = time.Now().UTC()
+		m.watchJobs[txID] = job
+	}
+	return nil
+}
+
+func (m *Memory) DeleteWatchJob(_ context.Context, txID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.watchJobs, txID)
+	return nil
+}
+
+func (m *Memory) ReserveIdempotencyKey(_ context.Context, scope, key, fingerprint string, ttl time.Duration) (*IdempotencyKey, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UTC()
+	id := idempotencyID{scope, key}
+	if existing, ok := m.idempotency[id]; ok && existing.ExpiresAt.After(now) {
+		return &existing, false, nil
+	}
+
+	rec := IdempotencyKey{
+		Scope:       scope,
+		Key:         key,
+		Fingerprint: fingerprint,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+	}
+	m.idempotency[id] = rec
+	return &rec, true, nil
+}
+
+func (m *Memory) CompleteIdempotencyKey(_ context.Context, scope, key string, statusCode int, response []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := idempotencyID{scope, key}
+	if rec, ok := m.idempotency[id]; ok {
+		rec.StatusCode = statusCode
+		rec.Response = append([]byte(nil), response...)
+		m.idempotency[id] = rec
+	}
+	return nil
+}
+
+func (m *Memory) ReleaseIdempotencyKey(_ context.Context, scope, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := idempotencyID{scope, key}
+	if rec, ok := m.idempotency[id]; ok && rec.StatusCode == 0 {
+		delete(m.idempotency, id)
+	}
+	return nil
+}
+
+func (m *Memory) PurgeExpiredIdempotencyKeys(_ context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UTC()
+	var purged int64
+	for id, rec := range m.idempotency {
+		if !rec.ExpiresAt.After(now) {
+			delete(m.idempotency, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (m *Memory) AppendBillEvent(_ context.Context, billID uuid.UUID, typ string, version int, payload json.RawMessage) (*BillEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	bill, ok := m.bills[billID]
+	if !ok {
+		return nil, gorm.ErrForeignKeyViolated
+	}
+	bill.EventSeq++
+	m.bills[billID] = bill
+
+	ev := BillEvent{
+		BillID:    billID,
+		Seq:       bill.EventSeq,
+		Type:      typ,
+		Version:   version,
+		Payload:   append(json.RawMessage(nil), payload...),
+		CreatedAt: time.Now().UTC(),
+	}
+	m.events[billID] = append(m.events[billID], ev)
+	return &ev, nil
+}
+
+func (m *Memory) GetBillEvent(_ context.Context, billID uuid.UUID, seq uint64) (*BillEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, ev := range m.events[billID] {
+		if ev.Seq == seq {
+			return &ev, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (m *Memory) ListBillEvents(_ context.Context, billID uuid.UUID, afterSeq uint64, limit int) ([]BillEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var events []BillEvent
+	for _, ev := range m.events[billID] {
+		if len(events) == limit {
+			break
+		}
+		if ev.Seq > afterSeq {
+			events = append(events, ev)
+		}
+	}
+	return events, nil
+}
+
+func (m *Memory) PruneBillEvents(_ context.Context, before time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var pruned int64
+	for billID, events := range m.events {
+		kept := events[:0]
+		for _, ev := range events {
+			if ev.CreatedAt.Before(before) {
+				pruned++
+				continue
+			}
+			kept = append(kept, ev)
+		}
+		m.events[billID] = kept
+	}
+	return pruned, nil
+}
+
+func (m *Memory) CreateWebhook(_ context.Context, wh *Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if wh.ID == uuid.Nil {
+		wh.ID = uuid.New()
+	}
+	if _, ok := m.webhooks[wh.ID]; ok {
+		return gorm.ErrDuplicatedKey
+	}
+	if wh.BillID != nil {
+		if _, ok := m.bills[*wh.BillID]; !ok {
+			return gorm.ErrForeignKeyViolated
+		}
+	}
+	if wh.APIKeyID == nil && wh.BillID == nil {
+		return gorm.ErrCheckConstraintViolated
+	}
+
+	wh.CreatedAt = time.Now().UTC()
+	m.webhooks[wh.ID] = *wh
+	m.webhookOrder = append(m.webhookOrder, wh.ID)
+	return nil
+}
+
+func (m *Memory) GetWebhook(_ context.Context, id uuid.UUID) (*Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	wh, ok := m.webhooks[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &wh, nil
+}
+
+func (m *Memory) ListWebhooks(_ context.Context, apiKeyID string, billID *uuid.UUID) ([]Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var hooks []Webhook
+	for _, id := range m.webhookOrder {
+		wh, ok := m.webhooks[id]
+		if !ok {
+			continue
+		}
+		if apiKeyID != "" && (wh.APIKeyID == nil || *wh.APIKeyID != apiKeyID) {
+			continue
+		}
+		if billID != nil && (wh.BillID == nil || *wh.BillID != *billID) {
+			continue
+		}
+		hooks = append(hooks, wh)
+	}
+	return hooks, nil
+}
+
+func (m *Memory) DeleteWebhook(_ context.Context, id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.webhooks, id)
+	for did, d := range m.deliveries {
+		if d.WebhookID == id {
+			delete(m.deliveries, did)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) EnqueueWebhookDeliveries(_ context.Context, ev BillEvent, payload json.RawMessage) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var billKey *string
+	if bill, ok := m.bills[ev.BillID]; ok {
+		billKey = bill.APIKeyID
+	}
+
+	now := time.Now().UTC()
+	queued := 0
+	for _, id := range m.webhookOrder {
+		wh, ok := m.webhooks[id]
+		if !ok || !wh.Wants(ev.Type) {
+			continue
+		}
+		forBill := wh.BillID != nil && *wh.BillID == ev.BillID
+		forKey := wh.APIKeyID != nil && billKey != nil && *wh.APIKeyID == *billKey
+		if !forBill && !forKey {
+			continue
+		}
+		if m.deliveryQueued(wh.ID, ev.BillID, ev.Seq) {
+			continue
+		}
+
+		d := WebhookDelivery{
+			ID:            uuid.New(),
+			WebhookID:     wh.ID,
+			BillID:        ev.BillID,
+			EventSeq:      ev.Seq,
+			EventType:     ev.Type,
+			Payload:       append(json.RawMessage(nil), payload...),
+			Status:        DeliveryPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		}
+		m.deliveries[d.ID] = d
+		m.deliveryOrder = append(m.deliveryOrder, d.ID)
+		queued++
+	}
+	return queued, nil
+}
+
+func (m *Memory) deliveryQueued(webhookID, billID uuid.UUID, seq uint64) bool {
+	for _, d := range m.deliveries {
+		if d.WebhookID == webhookID && d.BillID == billID && d.EventSeq == seq {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Memory) ClaimDueDeliveries(_ context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UTC()
+	var due []WebhookDelivery
+	for _, id := range m.deliveryOrder {
+		d, ok := m.deliveries[id]
+		if ok && d.Status == DeliveryPending && !d.NextAttemptAt.After(now) {
+			due = append(due, d)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].NextAttemptAt.Before(due[j].NextAttemptAt) })
+	if limit >= 0 && len(due) > limit {
+		due = due[:limit]
+	}
+
+	for _, d := range due {
+		d.NextAttemptAt = now.Add(lease)
+		d.UpdatedAt = now
+		m.deliveries[d.ID] = d
+	}
+	return due, nil
+}
+
+func (m *Memory) MarkDeliveryDelivered(_ context.Context, id uuid.UUID, attempts, statusCode int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if d, ok := m.deliveries[id]; ok {
+		now := time.Now().UTC()
+		d.Status = DeliveryDelivered
+		d.Attempts = attempts
+		d.LastStatusCode = &statusCode
+		d.LastError = nil
+		d.DeliveredAt = &now
+		d.UpdatedAt = now
+		m.deliveries[id] = d
+	}
+	return nil
+}
+
+func (m *Memory) MarkDeliveryFailed(_ context.Context, id uuid.UUID, attempts int, statusCode *int, errMsg string, next *time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if d, ok := m.deliveries[id]; ok {
+		d.Attempts = attempts
+		d.LastStatusCode = statusCode
+		d.LastError = &errMsg
+		if next == nil {
+			d.Status = DeliveryDead
+		} else {
+			d.NextAttemptAt = *next
+		}
+		d.UpdatedAt = time.Now().UTC()
+		m.deliveries[id] = d
+	}
+	return nil
+}
+
+func (m *Memory) ListWebhookDeliveries(_ context.Context, webhookID uuid.UUID, status DeliveryStatus, limit int) ([]WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var out []WebhookDelivery
+	for i := len(m.deliveryOrder) - 1; i >= 0; i-- {
+		d, ok := m.deliveries[m.deliveryOrder[i]]
+		if !ok || d.WebhookID != webhookID || (status != "" && d.Status != status) {
+			continue
+		}
+		out = append(out, d)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	if limit >= 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (m *Memory) RedeliverWebhookDelivery(_ context.Context, webhookID, id uuid.UUID) (*WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, ok := m.deliveries[id]
+	if !ok || d.WebhookID != webhookID {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	now := time.Now().UTC()
+	d.Status = DeliveryPending
+	d.Attempts = 0
+	d.NextAttemptAt = now
+	d.DeliveredAt = nil
+	d.UpdatedAt = now
+	m.deliveries[id] = d
+	return &d, nil
+}
+
+func (m *Memory) SetTelegramChatOptOut(_ context.Context, chatID int64, optedOut bool) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int64
+	for wallet, sub := range m.telegram {
+		if sub.ChatID != chatID {
+			continue
+		}
+		sub.OptedOut = optedOut
+		sub.UpdatedAt = time.Now().UTC()
+		m.telegram[wallet] = sub
+		n++
+	}
+	return n, nil
+}
+
+func (m *Memory) UpsertTelegramSubscriber(_ context.Context, sub *TelegramSubscriber) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UTC()
+	sub.UpdatedAt = now
+	if existing, ok := m.telegram[sub.Wallet]; ok {
+		sub.CreatedAt = existing.CreatedAt
+	} else {
+		sub.CreatedAt = now
+	}
+	m.telegram[sub.Wallet] = *sub
+	return nil
+}
+
+func (m *Memory) GetTelegramSubscriber(_ context.Context, wallet string) (*TelegramSubscriber, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sub, ok := m.telegram[wallet]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &sub, nil
+}
+
+func (m *Memory) ListTelegramChats(_ context.Context, wallets []string) ([]TelegramSubscriber, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var subs []TelegramSubscriber
+	for _, w := range wallets {
+		if sub, ok := m.telegram[w]; ok && !sub.OptedOut {
+			subs = append(subs, sub)
+		}
+	}
+	return subs, nil
+}
+
+func (m *Memory) PostLedgerEntry(_ context.Context, e LedgerEntry) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.bills[e.BillID]; !ok {
+		return false, gorm.ErrForeignKeyViolated
+	}
+	return m.postEntry(e)
+}
+
+func (m *Memory) ListLedgerEntries(_ context.Context, billID uuid.UUID) ([]LedgerEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var out []LedgerEntry
+	for _, id := range m.entryOrder {
+		if e := m.ledger[id]; e.BillID == billID {
+			e.Postings = append([]LedgerPosting(nil), e.Postings...)
+			sort.SliceStable(e.Postings, func(i, j int) bool {
+				return e.Postings[i].Amount.Cmp(e.Postings[j].Amount) > 0
+			})
+			out = append(out, e)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].ID < out[j].ID
+		}
+		return out[i].CreatedAt.Before(out[j].CreatedAt)
+	})
+	return out, nil
+}
+
+func (m *Memory) AccountBalance(_ context.Context, account string) (Amount, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sum := Amount{}
+	for _, e := range m.ledger {
+		for _, p := range e.Postings {
+			if p.Account == account {
+				sum = sum.Add(p.Amount)
+			}
+		}
+	}
+	return sum, nil
+}
+
+func (m *Memory) CheckLedger(_ context.Context) ([]LedgerIssue, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var issues []LedgerIssue
+	escrow := map[uuid.UUID]Amount{}
+	for _, id := range m.entryOrder {
+		e := m.ledger[id]
+		if !e.balanced() {
+			sum := Amount{}
+			for _, p := range e.Postings {
+				sum = sum.Add(p.Amount)
+			}
+			issues = append(issues, LedgerIssue{
+				BillID:  e.BillID,
+				EntryID: e.ID,
+				Problem: fmt.Sprintf("entry sums to %s over %d postings", sum, len(e.Postings)),
+			})
+		}
+		for _, p := range e.Postings {
+			if p.Account == EscrowAccount(e.BillID) {
+				escrow[e.BillID] = escrow[e.BillID].Add(p.Amount)
+			}
+		}
+	}
+
+	for _, id := range m.billOrder {
+		bill := m.bills[id]
+		if projected := m.collectedProjection(id); bill.Collected.Cmp(projected) != 0 {
+			issues = append(issues, LedgerIssue{
+				BillID:  id,
+				Problem: fmt.Sprintf("collected is %s, ledger has %s", bill.Collected, projected),
+			})
+		}
+	}
+
+	for _, id := range m.txOrder {
+		tx := m.txs[id]
+		if tx.ConfirmedAt == nil && tx.Status != StatusSuccess && tx.Status != StatusReturned {
+			continue
+		}
+		if !m.txHasEntry(tx.ID, EntryContribution, EntryDeposit) {
+			issues = append(issues, LedgerIssue{BillID: tx.BillID, TxID: &tx.ID, Problem: "no confirmation entry for the transaction"})
+		}
+		if tx.ReversedAt != nil && !m.txHasEntry(tx.ID, EntryReversal, EntryRefund) {
+			issues = append(issues, LedgerIssue{BillID: tx.BillID, TxID: &tx.ID, Problem: "no reversal entry for the transaction"})
+		}
+	}
+
+	for _, id := range m.billOrder {
+		if bal, ok := escrow[id]; ok && bal.Sign() < 0 {
+			issues = append(issues, LedgerIssue{BillID: id, Problem: fmt.Sprintf("escrow overdrawn to %s", bal)})
+		}
+	}
+	return issues, nil
+}
+
+// postEntry is insertEntry for the in-memory journal; m.mu must be held.
+func (m *Memory) postEntry(e LedgerEntry) (bool, error) {
+	if !e.balanced() {
+		return false, fmt.Errorf("%w: %s", ErrUnbalancedEntry, e.ID)
+	}
+	if _, ok := m.ledger[e.ID]; ok {
+		return false, nil
+	}
+	e.CreatedAt = time.Now().UTC()
+	e.Postings = append([]LedgerPosting(nil), e.Postings...)
+	for i := range e.Postings {
+		e.Postings[i].EntryID = e.ID
+	}
+	m.ledger[e.ID] = e
+	m.entryOrder = append(m.entryOrder, e.ID)
+	return true, nil
+}
+
+func (m *Memory) collectedProjection(billID uuid.UUID) Amount {
+	sum := Amount{}
+	escrow := EscrowAccount(billID)
+	for _, e := range m.ledger {
+		if e.BillID != billID || (e.Kind != EntryContribution && e.Kind != EntryReversal) {
+			continue
+		}
+		for _, p := range e.Postings {
+			if p.Account == escrow {
+				sum = sum.Add(p.Amount)
+			}
+		}
+	}
+	return sum
+}
+
+func (m *Memory) txHasEntry(txID uuid.UUID, kinds ...EntryKind) bool {
+	for _, e := range m.ledger {
+		if e.TxID == nil || *e.TxID != txID {
+			continue
+		}
+		for _, k := range kinds {
+			if e.Kind == k {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m *Memory) putTx(tx Transaction) {
+	m.txs[tx.ID] = tx
+	m.txOrder = append(m.txOrder, tx.ID)
+}
+
+// billTxs returns the transactions of the bill that match keep, oldest first.
+func (m *Memory) billTxs(billID uuid.UUID, keep func(Transaction) bool) []Transaction {
+	var txs []Transaction
+	for _, id := range m.txOrder {
+		if tx := m.txs[id]; tx.BillID == billID && keep(tx) {
+			txs = append(txs, withExplorerURL(tx))
+		}
+	}
+	sortTxsByCreated(txs)
+	return txs
+}
+
+func (m *Memory) txByChainRef(hash string, lt uint64) (Transaction, bool) {
+	for _, tx := range m.txs {
+		if tx.TxHash != nil && tx.LT != nil && *tx.TxHash == hash && *tx.LT == lt {
+			return tx, true
+		}
+	}
+	return Transaction{}, false
+}
+
+func sortTxsByCreated(txs []Transaction) {
+	sort.SliceStable(txs, func(i, j int) bool { return txs[i].CreatedAt.Before(txs[j].CreatedAt) })
+}
+
+// withExplorerURL does what the AfterFind hook does for rows read from
+// Postgres.
+func withExplorerURL(tx Transaction) Transaction {
+	if tx.TxHash != nil {
+		tx.ExplorerURL = explorerURL(*tx.TxHash)
+	}
+	return tx
+}
@@ -0,0 +1,15 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/storage"
+	"github.com/Hackathon-Apps/go-split-api/internal/app/storage/storagetest"
+)
+
+func TestMemoryConformance(t *testing.T) {
+	if err := storagetest.Check(context.Background(), storage.NewMemory()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"time"
+
+	"github.com/Hackathon-Apps/go-split-api/db"
+	"github.com/pressly/goose/v3"
+	"github.com/pressly/goose/v3/lock"
+	"github.com/sirupsen/logrus"
+)
+
+var ErrSchemaOutdated = errors.New("database schema is outdated")
+
+// MigrationState is one embedded migration and whether it has been applied.
+type MigrationState struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// migrator builds a goose provider over the embedded migrations of the
+// driver's dialect. On Postgres up and down take an advisory lock, so
+// instances started together with migrate_on_start apply the migrations once.
+func (s *Storage) migrator() (*goose.Provider, error) {
+	sqlDB, err := s.conn.DB()
+	if err != nil {
+		return nil, err
+	}
+	fsys, err := fs.Sub(db.Migrations, path.Join("migrations", s.driver))
+	if err != nil {
+		return nil, err
+	}
+	if s.driver == DriverSQLite {
+		return goose.NewProvider(goose.DialectSQLite3, sqlDB, fsys)
+	}
+	locker, err := lock.NewPostgresSessionLocker()
+	if err != nil {
+		return nil, err
+	}
+	return goose.NewProvider(goose.DialectPostgres, sqlDB, fsys, goose.WithSessionLocker(locker))
+}
+
+// MigrateUp applies every pending migration.
+func (s *Storage) MigrateUp(ctx context.Context) error {
+	p, err := s.migrator()
+	if err != nil {
+		return err
+	}
+	results, err := p.Up(ctx)
+	s.logResults(results)
+	if err != nil {
+		return fmt.Errorf("migrate up: %w", err)
+	}
+	if len(results) == 0 {
+		s.log.Info("migrate: schema is up to date")
+	}
+	return nil
+}
+
+// MigrateDown rolls back the most recent migration.
+func (s *Storage) MigrateDown(ctx context.Context) error {
+	p, err := s.migrator()
+	if err != nil {
+		return err
+	}
+	result, err := p.Down(ctx)
+	if result != nil {
+		s.logResults([]*goose.MigrationResult{result})
+	}
+	if err != nil {
+		return fmt.Errorf("migrate down: %w", err)
+	}
+	return nil
+}
+
+func (s *Storage) MigrationStatus(ctx context.Context) ([]MigrationState, error) {
+	p, err := s.migrator()
+	if err != nil {
+		return nil, err
+	}
+	status, err := p.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]MigrationState, 0, len(status))
+	for _, st := range status {
+		out = append(out, MigrationState{
+			Version:   st.Source.Version,
+			Name:      path.Base(st.Source.Path),
+			Applied:   st.State == goose.StateApplied,
+			AppliedAt: st.AppliedAt,
+		})
+	}
+	return out, nil
+}
+
+// CheckSchema fails with ErrSchemaOutdated when the database is behind the
+// migrations built into the binary. A newer schema is only logged, it is what
+// a rollback of the binary looks like.
+func (s *Storage) CheckSchema(ctx context.Context) error {
+	p, err := s.migrator()
+	if err != nil {
+		return err
+	}
+	current, target, err := p.GetVersions(ctx)
+	if err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+
+	fields := logrus.Fields{"version": current, "expected": target}
+	if current < target {
+		return fmt.Errorf("%w: at version %d, binary expects %d", ErrSchemaOutdated, current, target)
+	}
+	if current > target {
+		s.log.WithFields(fields).Warn("migrate: schema is newer than this binary")
+		return nil
+	}
+	s.log.WithFields(fields).Debug("migrate: schema version ok")
+	return nil
+}
+
+func (s *Storage) logResults(results []*goose.MigrationResult) {
+	for _, r := range results {
+		entry := s.log.WithFields(logrus.Fields{
+			"migration": path.Base(r.Source.Path),
+			"direction": r.Direction,
+			"duration":  r.Duration,
+		})
+		if r.Error != nil {
+			entry.WithError(r.Error).Error("migrate: migration failed")
+			continue
+		}
+		entry.Info("migrate: migration applied")
+	}
+}
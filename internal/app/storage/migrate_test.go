@@ -0,0 +1,98 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/storage"
+	"github.com/google/uuid"
+)
+
+// The ledger backfill must keep every bill total: contributions confirmed
+// before 00004 have no confirmed_at and are known by status only.
+func TestLedgerBackfillKeepsCollected(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t)
+	if err := db.MigrateUpTo(ctx, 14); err != nil {
+		t.Fatal(err)
+	}
+
+	bill := uuid.New()
+	exec(t, db, `INSERT INTO bills (id, goal, collected, creator_address, destination_address, status, proxy_wallet, state_init_hash)
+		VALUES (?, 1000, 160, 'creator', 'destination', 'ACTIVE', 'proxy', 'hash')`, bill)
+	for _, tx := range []struct {
+		status              string
+		amount              int
+		raw                 any
+		confirmed, reversed bool
+	}{
+		{"SUCCESS", 100, nil, false, false}, // confirmed before 00004
+		{"SUCCESS", 50, 60, true, false},    // credited with the chain amount
+		{"RETURNED", 30, nil, false, true},  // counted, then returned
+		{"BOUNCED", 40, 40, false, true},    // bounced while pending
+		{"BOUNCED", 20, 20, true, true},     // counted, then bounced
+		{"PENDING", 70, nil, false, false},
+		{"FAILED", 10, nil, false, false},
+	} {
+		exec(t, db, `INSERT INTO transactions (id, bill_id, amount, raw_amount, sender_address, op_type, status, confirmed_at, reversed_at)
+			VALUES (?, ?, ?, ?, 'sender', 'CONTRIBUTE', ?,
+			        CASE WHEN ? THEN CURRENT_TIMESTAMP END, CASE WHEN ? THEN CURRENT_TIMESTAMP END)`,
+			uuid.New(), bill, tx.amount, tx.raw, tx.status, tx.confirmed, tx.reversed)
+	}
+
+	migrated(t, db)
+	checkBackfill(t, db, bill, 160)
+}
+
+func TestPostgresLedgerBackfillKeepsCollected(t *testing.T) {
+	ctx := context.Background()
+	db := openPostgres(t)
+	if err := db.MigrateUpTo(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	bill := uuid.New()
+	exec(t, db, `INSERT INTO bills (id, goal, collected, creator_address, destination_address, status, proxy_wallet, state_init_hash)
+		VALUES (?, 1000, 160, 'creator', 'destination', 'ACTIVE', 'proxy', 'hash')`, bill)
+	for _, tx := range []struct {
+		status string
+		amount int
+	}{
+		{"SUCCESS", 100},
+		{"SUCCESS", 60},
+		{"PENDING", 70},
+		{"FAILED", 10},
+	} {
+		exec(t, db, `INSERT INTO transactions (id, bill_id, amount, sender_address, op_type, status)
+			VALUES (?, ?, ?, 'sender', 'CONTRIBUTE', ?)`, uuid.New(), bill, tx.amount, tx.status)
+	}
+
+	migrated(t, db)
+	checkBackfill(t, db, bill, 160)
+}
+
+func checkBackfill(t *testing.T, db *storage.Storage, billID uuid.UUID, collected int64) {
+	t.Helper()
+	ctx := context.Background()
+	got, err := db.GetBill(ctx, billID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Collected.Cmp(storage.NewAmount(collected)) != 0 {
+		t.Fatalf("collected %s after the backfill, want %d", got.Collected, collected)
+	}
+	issues, err := db.CheckLedger(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 0 {
+		t.Fatalf("ledger issues after the backfill: %+v", issues)
+	}
+}
+
+func exec(t *testing.T, db *storage.Storage, sql string, args ...any) {
+	t.Helper()
+	if err := db.Conn().Exec(sql, args...).Error; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -18,7 +18,16 @@ const (
 
 	StatusPending TxStatus = "PENDING"
 	StatusFailed  TxStatus = "FAILED"
+	// StatusConfirming: matched on chain, waiting for masterchain finality.
+	StatusConfirming TxStatus = "CONFIRMING"
+	// StatusSuccess is a confirmed transaction posted to the ledger.
 	StatusSuccess TxStatus = "SUCCESS"
+	// StatusBounced: the proxy rejected the value and bounced it to the sender.
+	StatusBounced TxStatus = "BOUNCED"
+	// StatusReturned: the proxy later sent a confirmed contribution back.
+	StatusReturned TxStatus = "RETURNED"
+	// StatusCancelled: the sender abandoned the intent before it was matched.
+	StatusCancelled TxStatus = "CANCELLED"
 )
 
 type OpType string
@@ -29,33 +38,104 @@ const (
 	OpRefund     OpType = "REFUND"
 )
 
+// Bill is a split payment. EndedAt is the scheduled end while the bill is
+// active and the moment it ended afterwards. Collected is projected from the
+// ledger. Version grows with every change of status or Collected; the indexer
+// cursor and event seq don't count.
 type Bill struct {
 	ID                 uuid.UUID     `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
-	Goal               int64         `json:"goal" gorm:"not null"`
-	Collected          int64         `json:"collected" gorm:"not null;default:0"`
-	CreatorAddress     string        `json:"creator_address" gorm:"not null"`
+	Goal               Amount        `json:"goal" gorm:"not null"`
+	Collected          Amount        `json:"collected" gorm:"not null;default:0"`
+	CreatorAddress     string        `json:"creator_address" gorm:"not null;index:bills_creator_idx"`
 	DestinationAddress string        `json:"destination_address" gorm:"not null"`
 	CreatedAt          time.Time     `json:"created_at" gorm:"autoCreateTime"`
-	EndedAt            time.Time     `json:"ended_at" gorm:"autoUpdateTime"`
+	EndedAt            time.Time     `json:"ended_at" gorm:"not null;default:now() + interval '10 minutes'"`
 	Status             BillStatus    `json:"status" gorm:"type:varchar(16);not null"`
 	Transactions       []Transaction `json:"transactions" gorm:"foreignKey:BillID"`
 	ProxyWallet        string        `json:"proxy_wallet" gorm:"not null"`
 	StateInitHash      string        `json:"state_init_hash" gorm:"not null"`
+	IndexedLT          uint64        `json:"-" gorm:"column:indexed_lt;not null;default:0"`
+	EventSeq           uint64        `json:"-" gorm:"column:event_seq;not null;default:0"`
+	APIKeyID           *string       `json:"-" gorm:"column:api_key_id;type:varchar(64)"`
+	Version            uint64        `json:"version" gorm:"not null;default:1"`
 }
 
 type Transaction struct {
-	ID            uuid.UUID `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
-	BillID        uuid.UUID `json:"bill_id" gorm:"type:uuid;index"`
-	Amount        int64     `json:"amount" gorm:"not null"`
-	SenderAddress string    `json:"sender_address" gorm:"not null"`
-	CreatedAt     time.Time `json:"created_at" gorm:"autoCreateTime"`
-	OpType        OpType    `json:"op_type" gorm:"type:varchar(32);not null"`
-	Status        TxStatus  `json:"status" gorm:"type:varchar(32);not null"`
+	ID            uuid.UUID  `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	BillID        uuid.UUID  `json:"bill_id" gorm:"type:uuid;index"`
+	Amount        Amount     `json:"amount" gorm:"not null"`
+	SenderAddress string     `json:"sender_address" gorm:"not null;index:transactions_sender_idx"`
+	CreatedAt     time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	OpType        OpType     `json:"op_type" gorm:"type:varchar(32);not null"`
+	Status        TxStatus   `json:"status" gorm:"type:varchar(32);not null"`
+	TxHash        *string    `json:"tx_hash,omitempty" gorm:"column:tx_hash;type:varchar(64);uniqueIndex:transactions_chain_tx_uidx"`
+	LT            *uint64    `json:"lt,omitempty" gorm:"column:lt;uniqueIndex:transactions_chain_tx_uidx"`
+	RawAmount     *Amount    `json:"raw_amount,omitempty"`
+	ConfirmedAt   *time.Time `json:"confirmed_at,omitempty"`
+	McSeqno       *uint32    `json:"mc_seqno,omitempty" gorm:"column:mc_seqno"`
+	ExplorerURL   string     `json:"explorer_url,omitempty" gorm:"-"`
+
+	ReversalTxHash *string    `json:"reversal_tx_hash,omitempty" gorm:"column:reversal_tx_hash;type:varchar(64)"`
+	ReversalLT     *uint64    `json:"reversal_lt,omitempty" gorm:"column:reversal_lt"`
+	ReversedAt     *time.Time `json:"reversed_at,omitempty"`
+}
+
+// Credited is the value the contribution adds to Bill.Collected: the amount
+// seen on chain when known, the requested amount otherwise.
+func (t Transaction) Credited() Amount {
+	if t.RawAmount != nil {
+		return *t.RawAmount
+	}
+	return t.Amount
+}
+
+// Confirmation is the committed state after ConfirmContribution. PrevStatus
+// is the bill status before the contribution was credited.
+type Confirmation struct {
+	Transaction Transaction
+	Bill        Bill
+	PrevStatus  BillStatus
+}
+
+// ChainRef identifies the on-chain transaction that backs a contribution.
+type ChainRef struct {
+	Hash   string
+	LT     uint64
+	Amount Amount
+}
+
+// TxFilter narrows ListTransactions; zero fields match everything.
+type TxFilter struct {
+	Status TxStatus
+	OpType OpType
+	Sender string
+}
+
+type WatchJob struct {
+	TxID      uuid.UUID `json:"tx_id" gorm:"type:uuid;primaryKey"`
+	BillID    uuid.UUID `json:"bill_id" gorm:"type:uuid;not null"`
+	Deadline  time.Time `json:"deadline" gorm:"not null"`
+	Attempts  int       `json:"attempts" gorm:"not null;default:0"`
+	LastLT    uint64    `json:"last_lt" gorm:"column:last_lt;not null;default:0"`
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// IdempotencyKey stores the outcome of a client request replayed under the
+// same Idempotency-Key. StatusCode 0 means the first request is in flight.
+type IdempotencyKey struct {
+	Scope       string    `gorm:"primaryKey"`
+	Key         string    `gorm:"primaryKey"`
+	Fingerprint string    `gorm:"type:varchar(64);not null"`
+	StatusCode  int       `gorm:"not null;default:0"`
+	Response    []byte    `gorm:"type:bytea"`
+	CreatedAt   time.Time `gorm:"autoCreateTime"`
+	ExpiresAt   time.Time `gorm:"not null"`
 }
 
 type HistoryItem struct {
 	ID                 uuid.UUID `json:"id"`
-	Amount             int64     `json:"amount"`
+	Amount             Amount    `json:"amount"`
 	DestinationAddress string    `json:"destination_address"`
 	Status             string    `json:"status"`
 	CreatedAt          time.Time `json:"created_at"`
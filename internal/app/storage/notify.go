@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+const billEventsChannel = "bill_events"
+
+// BillEventNotice announces a stored bill event to other API instances; the
+// event itself is read back from bill_events, notifications are size-limited.
+type BillEventNotice struct {
+	Instance string    `json:"instance"`
+	BillID   uuid.UUID `json:"bill_id"`
+	Seq      uint64    `json:"seq"`
+}
+
+func (s *Storage) GetBillEvent(ctx context.Context, billID uuid.UUID, seq uint64) (*BillEvent, error) {
+	var ev BillEvent
+	if err := s.conn.WithContext(ctx).
+		First(&ev, "bill_id = ? AND seq = ?", billID, seq).Error; err != nil {
+		return nil, err
+	}
+	return &ev, nil
+}
+
+func (s *Storage) NotifyBillEvent(ctx context.Context, n BillEventNotice) error {
+	if s.driver != DriverPostgres {
+		return ErrNoEventBus
+	}
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	return s.conn.WithContext(ctx).
+		Exec("SELECT pg_notify(?, ?)", billEventsChannel, string(payload)).
+		Error
+}
+
+// ListenBillEvents holds a dedicated connection subscribed to bill event
+// notices and calls fn for each of them. It blocks until ctx is done or the
+// connection fails.
+func (s *Storage) ListenBillEvents(ctx context.Context, fn func(BillEventNotice)) error {
+	if s.driver != DriverPostgres {
+		return ErrNoEventBus
+	}
+	sqlDB, err := s.conn.DB()
+	if err != nil {
+		return err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(dc any) error {
+		sc, ok := dc.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("listen: unexpected driver conn %T", dc)
+		}
+		pc := sc.Conn()
+		if _, err := pc.Exec(ctx, "LISTEN "+billEventsChannel); err != nil {
+			return errors.Join(err, driver.ErrBadConn)
+		}
+
+		for {
+			n, err := pc.WaitForNotification(ctx)
+			if err != nil {
+				// a connection left in LISTEN must not go back to the pool
+				return errors.Join(err, driver.ErrBadConn)
+			}
+			var notice BillEventNotice
+			if err := json.Unmarshal([]byte(n.Payload), &notice); err != nil {
+				s.log.WithError(err).WithField("payload", n.Payload).Warn("listen: bad bill event notice")
+				continue
+			}
+			fn(notice)
+		}
+	})
+}
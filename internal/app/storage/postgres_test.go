@@ -0,0 +1,15 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/storage/storagetest"
+)
+
+func TestPostgresConformance(t *testing.T) {
+	db := migrated(t, openPostgres(t))
+	if err := storagetest.Check(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// BillRepository stores bills. Lookups of a missing bill fail with
+// gorm.ErrRecordNotFound. Status updates are conditional on Bill.Version.
+type BillRepository interface {
+	CreateBill(ctx context.Context, goal Amount, creator, dest, proxyWalletAddress, stateInitHash, apiKeyID string) (*Bill, error)
+	GetBill(ctx context.Context, billID uuid.UUID) (*Bill, error)
+	GetBillWithTransactions(ctx context.Context, billID uuid.UUID) (*Bill, error)
+	GetBillWithSuccessTransactions(ctx context.Context, billID uuid.UUID) (*Bill, error)
+	UpdateBillStatus(ctx context.Context, billID uuid.UUID, status BillStatus, version uint64) (*Bill, error)
+	SetBillIndexedLT(ctx context.Context, billID uuid.UUID, lt uint64) error
+	ListBillsByStatus(ctx context.Context, statuses ...BillStatus) ([]Bill, error)
+	ListWalletBillIDs(ctx context.Context, wallet string, limit int) ([]uuid.UUID, error)
+	WalletInBill(ctx context.Context, wallet string, billID uuid.UUID) (bool, error)
+}
+
+// TransactionRepository stores the transactions of bills and moves them
+// through their statuses.
+type TransactionRepository interface {
+	AddTransaction(ctx context.Context, billID uuid.UUID, amount Amount, sender string, op OpType) (*Transaction, error)
+	AddConfirmingTransaction(ctx context.Context, billID uuid.UUID, sender string, op OpType, ref ChainRef) (*Transaction, error)
+	ListPendingTransactions(ctx context.Context, billID uuid.UUID) ([]Transaction, error)
+	ListTransactions(ctx context.Context, billID uuid.UUID, f TxFilter) ([]Transaction, error)
+	ListTransactionsByStatus(ctx context.Context, status TxStatus) ([]Transaction, error)
+	GetTransaction(ctx context.Context, txId uuid.UUID) (*Transaction, error)
+	GetTransactionByChainRef(ctx context.Context, hash string, lt uint64) (*Transaction, error)
+	ChainTxUsed(ctx context.Context, hash string, lt uint64) (bool, error)
+	FailTransaction(ctx context.Context, txID uuid.UUID) error
+	ConfirmTransaction(ctx context.Context, txID uuid.UUID, ref ChainRef) error
+	CancelTransaction(ctx context.Context, txID uuid.UUID, sender string) (*Transaction, error)
+	SetTransactionMcSeqno(ctx context.Context, txID uuid.UUID, seqno uint32) error
+	ConfirmContribution(ctx context.Context, txID uuid.UUID) (*Confirmation, error)
+	BounceTransaction(ctx context.Context, txID uuid.UUID, ref ChainRef) error
+	ReverseContribution(ctx context.Context, txID uuid.UUID, status TxStatus, ref ChainRef) (*Transaction, error)
+}
+
+type HistoryQuery interface {
+	GetHistory(ctx context.Context, sender string) ([]HistoryItem, error)
+}
+
+type WatchJobRepository interface {
+	CreateWatchJob(ctx context.Context, txID, billID uuid.UUID, deadline time.Time) (*WatchJob, error)
+	GetWatchJob(ctx context.Context, txID uuid.UUID) (*WatchJob, error)
+	UpdateWatchJobProgress(ctx context.Context, txID uuid.UUID, attempts int, lastLT uint64) error
+	DeleteWatchJob(ctx context.Context, txID uuid.UUID) error
+}
+
+type IdempotencyRepository interface {
+	ReserveIdempotencyKey(ctx context.Context, scope, key, fingerprint string, ttl time.Duration) (*IdempotencyKey, bool, error)
+	CompleteIdempotencyKey(ctx context.Context, scope, key string, statusCode int, response []byte) error
+	ReleaseIdempotencyKey(ctx context.Context, scope, key string) error
+	PurgeExpiredIdempotencyKeys(ctx context.Context) (int64, error)
+}
+
+type EventRepository interface {
+	AppendBillEvent(ctx context.Context, billID uuid.UUID, typ string, version int, payload json.RawMessage) (*BillEvent, error)
+	GetBillEvent(ctx context.Context, billID uuid.UUID, seq uint64) (*BillEvent, error)
+	ListBillEvents(ctx context.Context, billID uuid.UUID, afterSeq uint64, limit int) ([]BillEvent, error)
+	PruneBillEvents(ctx context.Context, before time.Time) (int64, error)
+}
+
+type WebhookRepository interface {
+	CreateWebhook(ctx context.Context, wh *Webhook) error
+	GetWebhook(ctx context.Context, id uuid.UUID) (*Webhook, error)
+	ListWebhooks(ctx context.Context, apiKeyID string, billID *uuid.UUID) ([]Webhook, error)
+	DeleteWebhook(ctx context.Context, id uuid.UUID) error
+	EnqueueWebhookDeliveries(ctx context.Context, ev BillEvent, payload json.RawMessage) (int, error)
+	ClaimDueDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error)
+	MarkDeliveryDelivered(ctx context.Context, id uuid.UUID, attempts, statusCode int) error
+	MarkDeliveryFailed(ctx context.Context, id uuid.UUID, attempts int, statusCode *int, errMsg string, next *time.Time) error
+	ListWebhookDeliveries(ctx context.Context, webhookID uuid.UUID, status DeliveryStatus, limit int) ([]WebhookDelivery, error)
+	RedeliverWebhookDelivery(ctx context.Context, webhookID, id uuid.UUID) (*WebhookDelivery, error)
+}
+
+type TelegramRepository interface {
+	UpsertTelegramSubscriber(ctx context.Context, sub *TelegramSubscriber) error
+	GetTelegramSubscriber(ctx context.Context, wallet string) (*TelegramSubscriber, error)
+	SetTelegramChatOptOut(ctx context.Context, chatID int64, optedOut bool) (int64, error)
+	ListTelegramChats(ctx context.Context, wallets []string) ([]TelegramSubscriber, error)
+}
+
+// LedgerRepository keeps the double-entry journal of value moving through
+// bill proxies. Confirmations and reversals post their entries themselves.
+type LedgerRepository interface {
+	PostLedgerEntry(ctx context.Context, e LedgerEntry) (bool, error)
+	ListLedgerEntries(ctx context.Context, billID uuid.UUID) ([]LedgerEntry, error)
+	AccountBalance(ctx context.Context, account string) (Amount, error)
+	CheckLedger(ctx context.Context) ([]LedgerIssue, error)
+}
+
+// Repository is everything the API server keeps in storage. Storage and
+// Memory implement it with the same semantics, see storagetest.
+type Repository interface {
+	BillRepository
+	TransactionRepository
+	HistoryQuery
+	WatchJobRepository
+	IdempotencyRepository
+	EventRepository
+	WebhookRepository
+	TelegramRepository
+	LedgerRepository
+}
+
+// EventBus fans bill events out to other API instances. Only the Postgres
+// storage provides it.
+type EventBus interface {
+	NotifyBillEvent(ctx context.Context, n BillEventNotice) error
+	ListenBillEvents(ctx context.Context, fn func(BillEventNotice)) error
+}
+
+var (
+	_ Repository = (*Storage)(nil)
+	_ EventBus   = (*Storage)(nil)
+	_ Repository = (*Memory)(nil)
+)
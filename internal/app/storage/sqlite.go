@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/config"
+	gosqlite "github.com/glebarez/go-sqlite"
+	"github.com/glebarez/sqlite"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+var ErrNoEventBus = errors.New("bill event fan-out needs the postgres driver")
+
+// openSQLite opens the database file at db_path. SQLite stores times as text,
+// so everything is written in UTC to keep comparisons in queries correct; the
+// query methods pass UTC times already, utcTimes covers inserted rows.
+// Writers are serialized on a single connection; row locks taken for Postgres
+// are dropped by the dialect.
+func openSQLite(cfg *config.Configuration, log *logrus.Logger) (*gorm.DB, error) {
+	dsn := cfg.DbPath + "?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)"
+
+	conn, err := gorm.Open(sqliteDialector{&sqlite.Dialector{DSN: dsn}}, &gorm.Config{
+		TranslateError: true,
+		NowFunc:        func() time.Time { return time.Now().UTC() },
+	})
+	if err != nil {
+		log.WithError(err).Error("gorm open failed")
+		return nil, err
+	}
+
+	if err := conn.Callback().Create().Before("gorm:create").Register("split:utc_times", utcTimes); err != nil {
+		return nil, err
+	}
+
+	sqlDB, err := conn.DB()
+	if err != nil {
+		log.WithError(err).Error("get sql DB failed")
+		return nil, err
+	}
+	sqlDB.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := sqlDB.PingContext(ctx); err != nil {
+		log.WithError(err).Error("sqlite open failed")
+		return nil, err
+	}
+
+	log.WithField("path", cfg.DbPath).Info("opened SQLite database")
+	return conn, nil
+}
+
+// sqliteDialector also reports CHECK violations as
+// gorm.ErrCheckConstraintViolated, as the Postgres dialect does.
+type sqliteDialector struct {
+	*sqlite.Dialector
+}
+
+func (d sqliteDialector) Translate(err error) error {
+	var serr *gosqlite.Error
+	if errors.As(err, &serr) && serr.Code() == sqlite3.SQLITE_CONSTRAINT_CHECK {
+		return gorm.ErrCheckConstraintViolated
+	}
+	return d.Dialector.Translate(err)
+}
+
+// utcTimes converts the time fields of the rows being created to UTC.
+func utcTimes(db *gorm.DB) {
+	if db.Statement.Schema == nil {
+		return
+	}
+	ctx := db.Statement.Context
+	toUTC := func(rv reflect.Value) {
+		for _, f := range db.Statement.Schema.Fields {
+			v, zero := f.ValueOf(ctx, rv)
+			if zero {
+				continue
+			}
+			var err error
+			switch t := v.(type) {
+			case time.Time:
+				err = f.Set(ctx, rv, t.UTC())
+			case *time.Time:
+				err = f.Set(ctx, rv, t.UTC())
+			}
+			if err != nil {
+				_ = db.AddError(err)
+			}
+		}
+	}
+
+	rv := db.Statement.ReflectValue
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			toUTC(reflect.Indirect(rv.Index(i)))
+		}
+	case reflect.Struct:
+		toUTC(rv)
+	}
+}
@@ -0,0 +1,15 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/storage/storagetest"
+)
+
+func TestSQLiteConformance(t *testing.T) {
+	db := migrated(t, openSQLite(t))
+	if err := storagetest.Check(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+}
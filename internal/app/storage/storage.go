@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -11,23 +12,66 @@ import (
 	"github.com/xssnick/tonutils-go/address"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrChainTxReused   = errors.New("chain transaction already used")
+	ErrTxNotPending    = errors.New("transaction is not pending")
+	ErrTxNotSuccess    = errors.New("transaction is not confirmed")
+	ErrTxNotConfirming = errors.New("transaction is not confirming")
+	ErrTxNotOwned      = errors.New("transaction belongs to another sender")
+	// ErrBillVersionConflict: the bill was written since the caller read it.
+	ErrBillVersionConflict = errors.New("bill was modified concurrently")
+)
+
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
 )
 
 type Storage struct {
 	configuration *config.Configuration
 	conn          *gorm.DB
+	driver        string
 	log           *logrus.Logger
 }
 
+// Connect opens the database selected by db_driver.
 func Connect(cfg *config.Configuration, log *logrus.Logger) (*Storage, error) {
-	storage := &Storage{configuration: cfg, log: log}
+	storage := &Storage{configuration: cfg, driver: cfg.DbDriver, log: log}
+
+	var (
+		conn *gorm.DB
+		err  error
+	)
+	switch cfg.DbDriver {
+	case DriverPostgres:
+		conn, err = openPostgres(cfg, log)
+	case DriverSQLite:
+		if cfg.EventFanout == "postgres" {
+			return nil, fmt.Errorf("event_fanout %q needs db_driver %q", cfg.EventFanout, DriverPostgres)
+		}
+		conn, err = openSQLite(cfg, log)
+	default:
+		return nil, fmt.Errorf("unknown db_driver %q", cfg.DbDriver)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	storage.conn = conn
+	explorerTxURL = cfg.ExplorerTxURL
+	return storage, nil
+}
 
+func openPostgres(cfg *config.Configuration, log *logrus.Logger) (*gorm.DB, error) {
 	dsn := fmt.Sprintf(
 		"host=%s user=%s password=%s dbname=%s port=%d sslmode=disable TimeZone=UTC connect_timeout=5",
 		cfg.DbHost, cfg.DbUser, cfg.DbPass, cfg.DbName, cfg.DbPort,
 	)
 
-	conn, err := gorm.Open(postgres.Open(dsn))
+	conn, err := gorm.Open(postgres.Open(dsn), &gorm.Config{TranslateError: true})
 	if err != nil {
 		log.WithError(err).Error("gorm open failed")
 		return nil, err
@@ -55,18 +99,19 @@ func Connect(cfg *config.Configuration, log *logrus.Logger) (*Storage, error) {
 		}
 	}
 
-	storage.conn = conn
 	log.WithFields(logrus.Fields{
 		"host": cfg.DbHost, "port": cfg.DbPort, "user": cfg.DbUser, "db": cfg.DbName,
 	}).Info("connected to PostgreSQL")
-	return storage, nil
+	return conn, nil
 }
 
 func (s *Storage) Conn() *gorm.DB {
 	return s.conn
 }
 
-func (s *Storage) CreateBill(ctx context.Context, goal int64, creator, dest, proxyWalletAddress, stateInitHash string) (*Bill, error) {
+// CreateBill stores a new active bill. apiKeyID is set when a merchant
+// created the bill with an API key, empty otherwise.
+func (s *Storage) CreateBill(ctx context.Context, goal Amount, creator, dest, proxyWalletAddress, stateInitHash, apiKeyID string) (*Bill, error) {
 	bill := &Bill{
 		ID:                 uuid.New(),
 		Goal:               goal,
@@ -75,6 +120,10 @@ func (s *Storage) CreateBill(ctx context.Context, goal int64, creator, dest, pro
 		Status:             StatusActive,
 		ProxyWallet:        proxyWalletAddress,
 		StateInitHash:      stateInitHash,
+		Version:            1,
+	}
+	if apiKeyID != "" {
+		bill.APIKeyID = &apiKeyID
 	}
 
 	if err := s.conn.WithContext(ctx).Create(bill).Error; err != nil {
@@ -84,7 +133,7 @@ func (s *Storage) CreateBill(ctx context.Context, goal int64, creator, dest, pro
 	return bill, nil
 }
 
-func (s *Storage) AddTransaction(ctx context.Context, billID uuid.UUID, amount int64, sender string, op OpType) (*Transaction, error) {
+func (s *Storage) AddTransaction(ctx context.Context, billID uuid.UUID, amount Amount, sender string, op OpType) (*Transaction, error) {
 	tx := &Transaction{
 		ID:            uuid.New(),
 		BillID:        billID,
@@ -101,6 +150,63 @@ func (s *Storage) AddTransaction(ctx context.Context, billID uuid.UUID, amount i
 	return tx, nil
 }
 
+// AddConfirmingTransaction records a contribution observed on chain without a
+// prior pending intent. It starts CONFIRMING, see ConfirmContribution.
+func (s *Storage) AddConfirmingTransaction(ctx context.Context, billID uuid.UUID, sender string, op OpType, ref ChainRef) (*Transaction, error) {
+	tx := &Transaction{
+		ID:            uuid.New(),
+		BillID:        billID,
+		Amount:        ref.Amount,
+		SenderAddress: sender,
+		OpType:        op,
+		Status:        StatusConfirming,
+		TxHash:        &ref.Hash,
+		LT:            &ref.LT,
+		RawAmount:     &ref.Amount,
+	}
+
+	err := s.conn.WithContext(ctx).Create(tx).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return nil, ErrChainTxReused
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tx.ExplorerURL = explorerURL(ref.Hash)
+	return tx, nil
+}
+
+func (s *Storage) ListPendingTransactions(ctx context.Context, billID uuid.UUID) ([]Transaction, error) {
+	var txs []Transaction
+	if err := s.conn.WithContext(ctx).
+		Where("bill_id = ? AND status = ?", billID, StatusPending).
+		Order("created_at ASC").
+		Find(&txs).Error; err != nil {
+		return nil, err
+	}
+	return txs, nil
+}
+
+func (s *Storage) ListTransactions(ctx context.Context, billID uuid.UUID, f TxFilter) ([]Transaction, error) {
+	q := s.conn.WithContext(ctx).Where("bill_id = ?", billID)
+	if f.Status != "" {
+		q = q.Where("status = ?", f.Status)
+	}
+	if f.OpType != "" {
+		q = q.Where("op_type = ?", f.OpType)
+	}
+	if f.Sender != "" {
+		q = q.Where("sender_address = ?", f.Sender)
+	}
+
+	var txs []Transaction
+	if err := q.Order("created_at ASC").Find(&txs).Error; err != nil {
+		return nil, err
+	}
+	return txs, nil
+}
+
 func (s *Storage) GetTransaction(ctx context.Context, txId uuid.UUID) (*Transaction, error) {
 	var tx Transaction
 	if err := s.conn.WithContext(ctx).
@@ -110,27 +216,241 @@ func (s *Storage) GetTransaction(ctx context.Context, txId uuid.UUID) (*Transact
 	return &tx, nil
 }
 
-func (s *Storage) UpdateTransaction(ctx context.Context, txId uuid.UUID, status TxStatus) error {
+// FailTransaction closes a pending transaction no chain transaction matched
+// in time. Anything that moved it on meanwhile, a match on another instance
+// or a cancel, wins: the call then fails with ErrTxNotPending.
+func (s *Storage) FailTransaction(ctx context.Context, txID uuid.UUID) error {
+	res := s.conn.WithContext(ctx).
+		Model(&Transaction{}).
+		Where("id = ? AND status = ?", txID, StatusPending).
+		Update("status", StatusFailed)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrTxNotPending
+	}
+	return nil
+}
+
+// ConfirmTransaction moves a pending transaction to CONFIRMING and binds it to
+// the chain transaction in ref. A chain transaction can back one contribution
+// only.
+func (s *Storage) ConfirmTransaction(ctx context.Context, txID uuid.UUID, ref ChainRef) error {
+	res := s.conn.WithContext(ctx).
+		Model(&Transaction{}).
+		Where("id = ? AND status = ?", txID, StatusPending).
+		Updates(map[string]interface{}{
+			"status":     StatusConfirming,
+			"tx_hash":    ref.Hash,
+			"lt":         ref.LT,
+			"raw_amount": ref.Amount,
+		})
+	if errors.Is(res.Error, gorm.ErrDuplicatedKey) {
+		return ErrChainTxReused
+	}
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrTxNotPending
+	}
+	return nil
+}
+
+// CancelTransaction moves a pending transaction of sender to CANCELLED.
+func (s *Storage) CancelTransaction(ctx context.Context, txID uuid.UUID, sender string) (*Transaction, error) {
+	var tx Transaction
+	if err := s.conn.WithContext(ctx).First(&tx, "id = ?", txID).Error; err != nil {
+		return nil, err
+	}
+	if tx.SenderAddress != sender {
+		return nil, ErrTxNotOwned
+	}
+
+	res := s.conn.WithContext(ctx).
+		Model(&Transaction{}).
+		Where("id = ? AND status = ?", txID, StatusPending).
+		Update("status", StatusCancelled)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrTxNotPending
+	}
+
+	tx.Status = StatusCancelled
+	return &tx, nil
+}
+
+func (s *Storage) SetTransactionMcSeqno(ctx context.Context, txID uuid.UUID, seqno uint32) error {
 	return s.conn.WithContext(ctx).
 		Model(&Transaction{}).
-		Where("id = ?", txId).
-		Update("status", status).
+		Where("id = ? AND status = ?", txID, StatusConfirming).
+		Update("mc_seqno", seqno).
 		Error
 }
 
-func (s *Storage) IncreaseBillCollected(ctx context.Context, billID uuid.UUID, amount int64) error {
-	var bill Bill
+// ConfirmContribution makes a CONFIRMING contribution SUCCESS once its chain
+// transaction is deep enough in the masterchain, posts it to the ledger and
+// projects the bill total from there, in one DB transaction. An active bill
+// that reaches its goal becomes DONE.
+func (s *Storage) ConfirmContribution(ctx context.Context, txID uuid.UUID) (*Confirmation, error) {
+	var out Confirmation
+	err := s.conn.WithContext(ctx).Transaction(func(db *gorm.DB) error {
+		now := time.Now().UTC()
+		res := db.Model(&out.Transaction).
+			Clauses(clause.Returning{}).
+			Where("id = ? AND status = ?", txID, StatusConfirming).
+			Updates(map[string]interface{}{
+				"status":       StatusSuccess,
+				"confirmed_at": now,
+			})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrTxNotConfirming
+		}
+
+		// the row lock keeps a concurrent confirmation from reporting the
+		// same status change
+		var prev Bill
+		if err := db.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("status").
+			Take(&prev, "id = ?", out.Transaction.BillID).Error; err != nil {
+			return err
+		}
+		out.PrevStatus = prev.Status
+
+		entry := confirmationEntry(out.Transaction)
+		if _, err := insertEntry(db, &entry); err != nil {
+			return err
+		}
+
+		collected := collectedProjection(db, out.Transaction.BillID)
+		reached := gorm.Expr("status = ? AND (?) >= CAST(goal AS NUMERIC)", StatusActive, collected)
+		return db.Model(&out.Bill).
+			Clauses(clause.Returning{}).
+			Where("id = ?", out.Transaction.BillID).
+			Updates(map[string]interface{}{
+				"collected": collected,
+				"status":    gorm.Expr("CASE WHEN ? THEN ? ELSE status END", reached, StatusDone),
+				"ended_at":  gorm.Expr("CASE WHEN ? THEN ? ELSE ended_at END", reached, now),
+				"version":   gorm.Expr("version + 1"),
+			}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// BounceTransaction closes a pending transaction whose chain transaction
+// bounced the value straight back; the bill total is untouched.
+func (s *Storage) BounceTransaction(ctx context.Context, txID uuid.UUID, ref ChainRef) error {
+	now := time.Now().UTC()
+	res := s.conn.WithContext(ctx).
+		Model(&Transaction{}).
+		Where("id = ? AND status = ?", txID, StatusPending).
+		Updates(map[string]interface{}{
+			"status":           StatusBounced,
+			"tx_hash":          ref.Hash,
+			"lt":               ref.LT,
+			"raw_amount":       ref.Amount,
+			"reversal_tx_hash": ref.Hash,
+			"reversal_lt":      ref.LT,
+			"reversed_at":      now,
+		})
+	if errors.Is(res.Error, gorm.ErrDuplicatedKey) {
+		return ErrChainTxReused
+	}
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrTxNotPending
+	}
+	return nil
+}
+
+// ReverseContribution moves a confirmed contribution to BOUNCED or RETURNED,
+// posts the reversal and projects the bill total again, in one DB
+// transaction. ref is the chain transaction that carried the value back.
+func (s *Storage) ReverseContribution(ctx context.Context, txID uuid.UUID, status TxStatus, ref ChainRef) (*Transaction, error) {
+	var out Transaction
+	err := s.conn.WithContext(ctx).Transaction(func(db *gorm.DB) error {
+		if err := db.First(&out, "id = ?", txID).Error; err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		res := db.Model(&Transaction{}).
+			Where("id = ? AND status = ?", txID, StatusSuccess).
+			Updates(map[string]interface{}{
+				"status":           status,
+				"reversal_tx_hash": ref.Hash,
+				"reversal_lt":      ref.LT,
+				"reversed_at":      now,
+			})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrTxNotSuccess
+		}
+
+		out.Status = status
+		out.ReversalTxHash = &ref.Hash
+		out.ReversalLT = &ref.LT
+		out.ReversedAt = &now
+
+		entry := reversalEntry(out)
+		if _, err := insertEntry(db, &entry); err != nil {
+			return err
+		}
+
+		return db.Model(&Bill{}).
+			Where("id = ?", out.BillID).
+			Updates(map[string]interface{}{
+				"collected": collectedProjection(db, out.BillID),
+				"version":   gorm.Expr("version + 1"),
+			}).
+			Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (s *Storage) GetTransactionByChainRef(ctx context.Context, hash string, lt uint64) (*Transaction, error) {
+	var tx Transaction
 	if err := s.conn.WithContext(ctx).
-		First(&bill, "id = ?", billID).Error; err != nil {
-		return err
+		First(&tx, "tx_hash = ? AND lt = ?", hash, lt).Error; err != nil {
+		return nil, err
 	}
-	bill.Collected += amount
+	return &tx, nil
+}
 
-	if bill.Collected >= bill.Goal {
-		bill.Status = StatusDone
+func (s *Storage) ChainTxUsed(ctx context.Context, hash string, lt uint64) (bool, error) {
+	var count int64
+	if err := s.conn.WithContext(ctx).
+		Model(&Transaction{}).
+		Where("tx_hash = ? AND lt = ?", hash, lt).
+		Count(&count).Error; err != nil {
+		return false, err
 	}
+	return count > 0, nil
+}
 
-	return s.conn.WithContext(ctx).Save(&bill).Error
+func (s *Storage) GetBill(ctx context.Context, billID uuid.UUID) (*Bill, error) {
+	var bill Bill
+	if err := s.conn.WithContext(ctx).
+		First(&bill, "id = ?", billID).Error; err != nil {
+		return nil, err
+	}
+	return &bill, nil
 }
 
 func (s *Storage) GetBillWithTransactions(ctx context.Context, billID uuid.UUID) (*Bill, error) {
@@ -157,14 +477,37 @@ func (s *Storage) GetBillWithSuccessTransactions(ctx context.Context, billID uui
 	return &bill, nil
 }
 
-func (s *Storage) UpdateBillStatus(ctx context.Context, billID uuid.UUID, status BillStatus) error {
-	return s.conn.WithContext(ctx).
-		Model(&Bill{}).
-		Where("id = ?", billID).
+// UpdateBillStatus ends the bill with status if it is still at version and
+// returns it as updated. A bill written since fails with
+// ErrBillVersionConflict.
+func (s *Storage) UpdateBillStatus(ctx context.Context, billID uuid.UUID, status BillStatus, version uint64) (*Bill, error) {
+	var bill Bill
+	res := s.conn.WithContext(ctx).
+		Model(&bill).
+		Clauses(clause.Returning{}).
+		Where("id = ? AND version = ?", billID, version).
 		Updates(map[string]interface{}{
 			"status":   status,
 			"ended_at": time.Now().UTC(),
-		}).
+			"version":  gorm.Expr("version + 1"),
+		})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		if _, err := s.GetBill(ctx, billID); err != nil {
+			return nil, err
+		}
+		return nil, ErrBillVersionConflict
+	}
+	return &bill, nil
+}
+
+func (s *Storage) SetBillIndexedLT(ctx context.Context, billID uuid.UUID, lt uint64) error {
+	return s.conn.WithContext(ctx).
+		Model(&Bill{}).
+		Where("id = ? AND indexed_lt < ?", billID, lt).
+		Update("indexed_lt", lt).
 		Error
 }
 
@@ -183,6 +526,89 @@ func (s *Storage) ListBillsByStatus(ctx context.Context, statuses ...BillStatus)
 	return bills, nil
 }
 
+func (s *Storage) ListTransactionsByStatus(ctx context.Context, status TxStatus) ([]Transaction, error) {
+	var txs []Transaction
+	if err := s.conn.WithContext(ctx).
+		Where("status = ?", status).
+		Order("created_at ASC").
+		Find(&txs).Error; err != nil {
+		return nil, err
+	}
+	return txs, nil
+}
+
+func (s *Storage) CreateWatchJob(ctx context.Context, txID, billID uuid.UUID, deadline time.Time) (*WatchJob, error) {
+	job := &WatchJob{
+		TxID:     txID,
+		BillID:   billID,
+		Deadline: deadline.UTC(),
+	}
+
+	if err := s.conn.WithContext(ctx).Create(job).Error; err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+func (s *Storage) GetWatchJob(ctx context.Context, txID uuid.UUID) (*WatchJob, error) {
+	var job WatchJob
+	if err := s.conn.WithContext(ctx).
+		First(&job, "tx_id = ?", txID).Error; err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (s *Storage) UpdateWatchJobProgress(ctx context.Context, txID uuid.UUID, attempts int, lastLT uint64) error {
+	return s.conn.WithContext(ctx).
+		Model(&WatchJob{}).
+		Where("tx_id = ?", txID).
+		Updates(map[string]interface{}{
+			"attempts":   attempts,
+			"last_lt":    lastLT,
+			"updated_at": time.Now().UTC(),
+		}).
+		Error
+}
+
+func (s *Storage) DeleteWatchJob(ctx context.Context, txID uuid.UUID) error {
+	return s.conn.WithContext(ctx).
+		Where("tx_id = ?", txID).
+		Delete(&WatchJob{}).
+		Error
+}
+
+// ListWalletBillIDs returns the most recent bills the wallet created or sent a
+// transaction to.
+func (s *Storage) ListWalletBillIDs(ctx context.Context, wallet string, limit int) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	if err := s.conn.WithContext(ctx).
+		Model(&Bill{}).
+		Where("creator_address = ? OR id IN (?)", wallet,
+			s.conn.Model(&Transaction{}).Select("bill_id").Where("sender_address = ?", wallet)).
+		Order("created_at DESC").
+		Limit(limit).
+		Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// WalletInBill reports whether the wallet created the bill or sent a
+// transaction to it.
+func (s *Storage) WalletInBill(ctx context.Context, wallet string, billID uuid.UUID) (bool, error) {
+	var count int64
+	if err := s.conn.WithContext(ctx).
+		Model(&Bill{}).
+		Where("id = ? AND (creator_address = ? OR id IN (?))", billID, wallet,
+			s.conn.Model(&Transaction{}).Select("bill_id").Where("sender_address = ?", wallet)).
+		Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
 func (s *Storage) GetHistory(ctx context.Context, sender string) ([]HistoryItem, error) {
 	var bills []Bill
 
@@ -200,22 +626,94 @@ func (s *Storage) GetHistory(ctx context.Context, sender string) ([]HistoryItem,
 	senderRaw := address.MustParseAddr(sender).StringRaw()
 	history := make([]HistoryItem, 0, len(bills))
 	for _, bill := range bills {
-		txAmount := int64(0)
-		for _, tx := range bill.Transactions {
-			txSenderRaw := address.MustParseAddr(tx.SenderAddress).StringRaw()
-			if senderRaw == txSenderRaw {
-				txAmount += tx.Amount
-			}
+		history = append(history, historyItem(bill, senderRaw))
+	}
+
+	return history, nil
+}
+
+// historyItem sums what senderRaw sent to bill, whose transactions are loaded.
+func historyItem(bill Bill, senderRaw string) HistoryItem {
+	txAmount := Amount{}
+	for _, tx := range bill.Transactions {
+		txSenderRaw := address.MustParseAddr(tx.SenderAddress).StringRaw()
+		if senderRaw == txSenderRaw {
+			txAmount = txAmount.Add(tx.Amount)
 		}
+	}
 
-		history = append(history, HistoryItem{
-			ID:                 bill.ID,
-			Amount:             txAmount,
-			DestinationAddress: bill.DestinationAddress,
-			Status:             string(bill.Status),
-			CreatedAt:          bill.CreatedAt,
-		})
+	return HistoryItem{
+		ID:                 bill.ID,
+		Amount:             txAmount,
+		DestinationAddress: bill.DestinationAddress,
+		Status:             string(bill.Status),
+		CreatedAt:          bill.CreatedAt,
 	}
+}
 
-	return history, nil
+// ReserveIdempotencyKey claims (scope, key) for a new request. When the key is
+// already taken it returns the stored record and false; expired records are
+// replaced.
+func (s *Storage) ReserveIdempotencyKey(ctx context.Context, scope, key, fingerprint string, ttl time.Duration) (*IdempotencyKey, bool, error) {
+	now := time.Now().UTC()
+	rec := &IdempotencyKey{
+		Scope:       scope,
+		Key:         key,
+		Fingerprint: fingerprint,
+		ExpiresAt:   now.Add(ttl),
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		err := s.conn.WithContext(ctx).Create(rec).Error
+		if err == nil {
+			return rec, true, nil
+		}
+		if !errors.Is(err, gorm.ErrDuplicatedKey) {
+			return nil, false, err
+		}
+
+		var existing IdempotencyKey
+		if err := s.conn.WithContext(ctx).
+			First(&existing, "scope = ? AND key = ?", scope, key).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				continue
+			}
+			return nil, false, err
+		}
+		if existing.ExpiresAt.After(now) {
+			return &existing, false, nil
+		}
+		if err := s.conn.WithContext(ctx).
+			Where("scope = ? AND key = ? AND expires_at <= ?", scope, key, now).
+			Delete(&IdempotencyKey{}).Error; err != nil {
+			return nil, false, err
+		}
+	}
+
+	return nil, false, errors.New("idempotency key contention")
+}
+
+func (s *Storage) CompleteIdempotencyKey(ctx context.Context, scope, key string, statusCode int, response []byte) error {
+	return s.conn.WithContext(ctx).
+		Model(&IdempotencyKey{}).
+		Where("scope = ? AND key = ?", scope, key).
+		Updates(map[string]interface{}{
+			"status_code": statusCode,
+			"response":    response,
+		}).
+		Error
+}
+
+func (s *Storage) ReleaseIdempotencyKey(ctx context.Context, scope, key string) error {
+	return s.conn.WithContext(ctx).
+		Where("scope = ? AND key = ? AND status_code = 0", scope, key).
+		Delete(&IdempotencyKey{}).
+		Error
+}
+
+func (s *Storage) PurgeExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	res := s.conn.WithContext(ctx).
+		Where("expires_at <= ?", time.Now().UTC()).
+		Delete(&IdempotencyKey{})
+	return res.RowsAffected, res.Error
 }
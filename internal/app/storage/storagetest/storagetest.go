@@ -0,0 +1,857 @@
+// Package storagetest holds the conformance suite every storage.Repository
+// has to pass, so the in-memory store keeps the semantics of the Postgres
+// one. Run it from a test against storage.NewMemory() and against a Storage
+// connected to a migrated database:
+//
+//	if err := storagetest.Check(ctx, storage.NewMemory()); err != nil {
+//		t.Fatal(err)
+//	}
+package storagetest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/Hackathon-Apps/go-split-api/internal/app/storage"
+	"github.com/google/uuid"
+	"github.com/xssnick/tonutils-go/address"
+	"gorm.io/gorm"
+)
+
+type testCase struct {
+	name string
+	run  func(ctx context.Context, repo storage.Repository) error
+}
+
+var cases = []testCase{
+	{"bills", checkBills},
+	{"amounts", checkAmounts},
+	{"transaction lifecycle", checkTxLifecycle},
+	{"cancel", checkCancel},
+	{"bounce and chain refs", checkBounce},
+	{"transaction filters", checkTxFilters},
+	{"history", checkHistory},
+	{"watch jobs", checkWatchJobs},
+	{"idempotency keys", checkIdempotency},
+	{"bill events", checkEvents},
+	{"webhooks", checkWebhooks},
+	{"telegram", checkTelegram},
+	{"ledger", checkLedger},
+}
+
+// Check runs every case against repo and returns the failures joined. Cases
+// use fresh bills and wallets, so repo may already hold data; claiming due
+// webhook deliveries does touch everything that is due.
+func Check(ctx context.Context, repo storage.Repository) error {
+	var errs []error
+	for _, c := range cases {
+		if err := c.run(ctx, repo); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// wallet returns a random user-friendly address.
+func wallet() string {
+	data := make([]byte, 32)
+	_, _ = rand.Read(data)
+	return address.NewAddress(0, 0, data).String()
+}
+
+func newBill(ctx context.Context, repo storage.Repository, goal int64) (*storage.Bill, error) {
+	return repo.CreateBill(ctx, storage.NewAmount(goal), wallet(), wallet(), wallet(), uuid.NewString(), "")
+}
+
+func chainRef(amount int64) storage.ChainRef {
+	return storage.ChainRef{Hash: uuid.NewString(), LT: uint64(time.Now().UnixNano()), Amount: storage.NewAmount(amount)}
+}
+
+func wantErr(op string, err, target error) error {
+	if !errors.Is(err, target) {
+		return fmt.Errorf("%s: got error %v, want %v", op, err, target)
+	}
+	return nil
+}
+
+func checkBills(ctx context.Context, repo storage.Repository) error {
+	bill, err := newBill(ctx, repo, 100)
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	if bill.Status != storage.StatusActive || !bill.Collected.IsZero() || bill.ID == uuid.Nil {
+		return fmt.Errorf("create: got %+v", bill)
+	}
+
+	got, err := repo.GetBill(ctx, bill.ID)
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+	if got.Goal.Cmp(storage.NewAmount(100)) != 0 || got.CreatorAddress != bill.CreatorAddress {
+		return fmt.Errorf("get: got %+v", got)
+	}
+	if !got.EndedAt.After(got.CreatedAt) {
+		return fmt.Errorf("active bill ends at %v, created %v", got.EndedAt, got.CreatedAt)
+	}
+	_, err = repo.GetBill(ctx, uuid.New())
+	if err := wantErr("get missing", err, gorm.ErrRecordNotFound); err != nil {
+		return err
+	}
+
+	if err := repo.SetBillIndexedLT(ctx, bill.ID, 50); err != nil {
+		return err
+	}
+	if err := repo.SetBillIndexedLT(ctx, bill.ID, 10); err != nil {
+		return err
+	}
+	if got, _ := repo.GetBill(ctx, bill.ID); got.IndexedLT != 50 {
+		return fmt.Errorf("indexed lt went back to %d", got.IndexedLT)
+	}
+
+	active, err := repo.ListBillsByStatus(ctx, storage.StatusActive)
+	if err != nil {
+		return err
+	}
+	if !containsBill(active, bill.ID) {
+		return errors.New("active bill missing from ListBillsByStatus")
+	}
+	if none, _ := repo.ListBillsByStatus(ctx); len(none) != 0 {
+		return errors.New("ListBillsByStatus without statuses returned bills")
+	}
+
+	if bill.Version != 1 {
+		return fmt.Errorf("new bill at version %d", bill.Version)
+	}
+	updated, err := repo.UpdateBillStatus(ctx, bill.ID, storage.StatusTimeout, bill.Version)
+	if err != nil {
+		return err
+	}
+	if updated.Status != storage.StatusTimeout || updated.Version != 2 {
+		return fmt.Errorf("update: got status %s at version %d", updated.Status, updated.Version)
+	}
+	got, _ = repo.GetBill(ctx, bill.ID)
+	if got.Status != storage.StatusTimeout || got.EndedAt.After(time.Now().Add(time.Minute)) {
+		return fmt.Errorf("after timeout got status %s, ended %v", got.Status, got.EndedAt)
+	}
+	_, err = repo.UpdateBillStatus(ctx, bill.ID, storage.StatusDone, bill.Version)
+	if err := wantErr("stale update", err, storage.ErrBillVersionConflict); err != nil {
+		return err
+	}
+	_, err = repo.UpdateBillStatus(ctx, uuid.New(), storage.StatusDone, 1)
+	if err := wantErr("update missing", err, gorm.ErrRecordNotFound); err != nil {
+		return err
+	}
+
+	// a creator and a contributor both see the bill, newest first
+	older, err := newBill(ctx, repo, 100)
+	if err != nil {
+		return err
+	}
+	newer, err := repo.CreateBill(ctx, storage.NewAmount(5), wallet(), wallet(), wallet(), uuid.NewString(), "")
+	if err != nil {
+		return err
+	}
+	if _, err := repo.AddTransaction(ctx, newer.ID, storage.NewAmount(1), older.CreatorAddress, storage.OpContribute); err != nil {
+		return err
+	}
+	ids, err := repo.ListWalletBillIDs(ctx, older.CreatorAddress, 10)
+	if err != nil {
+		return err
+	}
+	if len(ids) != 2 || ids[0] != newer.ID || ids[1] != older.ID {
+		return fmt.Errorf("wallet bills: got %v, want [%s %s]", ids, newer.ID, older.ID)
+	}
+	if ids, _ := repo.ListWalletBillIDs(ctx, older.CreatorAddress, 1); len(ids) != 1 {
+		return fmt.Errorf("wallet bills ignore the limit: %v", ids)
+	}
+	if in, _ := repo.WalletInBill(ctx, older.CreatorAddress, newer.ID); !in {
+		return errors.New("contributor not in bill")
+	}
+	if in, _ := repo.WalletInBill(ctx, wallet(), newer.ID); in {
+		return errors.New("stranger in bill")
+	}
+	return nil
+}
+
+// Amounts beyond int64 come back exact, and goals compare as numbers.
+func checkAmounts(ctx context.Context, repo storage.Repository) error {
+	huge, _ := new(big.Int).SetString("1267650600228229401496703205377", 10) // 2^100+1
+	goal := storage.AmountFromBig(huge)
+	bill, err := repo.CreateBill(ctx, goal, wallet(), wallet(), wallet(), uuid.NewString(), "")
+	if err != nil {
+		return err
+	}
+	if got, err := repo.GetBill(ctx, bill.ID); err != nil || got.Goal.Cmp(goal) != 0 {
+		return fmt.Errorf("goal 2^100+1: got %v, %v", got, err)
+	}
+	tx, err := repo.AddTransaction(ctx, bill.ID, goal, wallet(), storage.OpContribute)
+	if err != nil {
+		return err
+	}
+	if got, err := repo.GetTransaction(ctx, tx.ID); err != nil || got.Amount.Cmp(goal) != 0 {
+		return fmt.Errorf("amount 2^100+1: got %v, %v", got, err)
+	}
+
+	small, err := newBill(ctx, repo, 10)
+	if err != nil {
+		return err
+	}
+	nine, err := repo.AddConfirmingTransaction(ctx, small.ID, wallet(), storage.OpContribute, chainRef(9))
+	if err != nil {
+		return err
+	}
+	c, err := repo.ConfirmContribution(ctx, nine.ID)
+	if err != nil {
+		return err
+	}
+	if c.Bill.Status != storage.StatusActive || c.Bill.Collected.Cmp(storage.NewAmount(9)) != 0 {
+		return fmt.Errorf("9 of 10: collected %s, status %s", c.Bill.Collected, c.Bill.Status)
+	}
+	return nil
+}
+
+func containsBill(bills []storage.Bill, id uuid.UUID) bool {
+	for _, b := range bills {
+		if b.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func checkTxLifecycle(ctx context.Context, repo storage.Repository) error {
+	bill, err := newBill(ctx, repo, 100)
+	if err != nil {
+		return err
+	}
+	if _, err := repo.AddTransaction(ctx, uuid.New(), storage.NewAmount(1), wallet(), storage.OpContribute); err == nil {
+		return errors.New("transaction added to a missing bill")
+	}
+
+	first, err := repo.AddTransaction(ctx, bill.ID, storage.NewAmount(60), wallet(), storage.OpContribute)
+	if err != nil {
+		return err
+	}
+	if first.Status != storage.StatusPending {
+		return fmt.Errorf("new transaction is %s", first.Status)
+	}
+	pending, err := repo.ListPendingTransactions(ctx, bill.ID)
+	if err != nil || len(pending) != 1 || pending[0].ID != first.ID {
+		return fmt.Errorf("pending: got %v, %v", pending, err)
+	}
+
+	ref := chainRef(70)
+	if err := repo.ConfirmTransaction(ctx, first.ID, ref); err != nil {
+		return fmt.Errorf("confirm: %w", err)
+	}
+	if err := wantErr("confirm twice", repo.ConfirmTransaction(ctx, first.ID, chainRef(1)), storage.ErrTxNotPending); err != nil {
+		return err
+	}
+	if used, _ := repo.ChainTxUsed(ctx, ref.Hash, ref.LT); !used {
+		return errors.New("chain tx not marked used")
+	}
+	byRef, err := repo.GetTransactionByChainRef(ctx, ref.Hash, ref.LT)
+	if err != nil || byRef.ID != first.ID || byRef.Status != storage.StatusConfirming {
+		return fmt.Errorf("by chain ref: got %v, %v", byRef, err)
+	}
+	if byRef.ExplorerURL == "" {
+		return errors.New("explorer url not set")
+	}
+	if err := repo.SetTransactionMcSeqno(ctx, first.ID, 42); err != nil {
+		return err
+	}
+	if got, _ := repo.GetTransaction(ctx, first.ID); got.McSeqno == nil || *got.McSeqno != 42 {
+		return errors.New("mc seqno not stored")
+	}
+
+	// credited with the on-chain amount, 70 of 100
+	c, err := repo.ConfirmContribution(ctx, first.ID)
+	if err != nil {
+		return fmt.Errorf("confirm contribution: %w", err)
+	}
+	if c.Transaction.Status != storage.StatusSuccess || c.Transaction.ConfirmedAt == nil {
+		return fmt.Errorf("confirmed tx: %+v", c.Transaction)
+	}
+	if c.Bill.Collected.Cmp(storage.NewAmount(70)) != 0 || c.Bill.Status != storage.StatusActive || c.PrevStatus != storage.StatusActive {
+		return fmt.Errorf("after first contribution: collected %s, status %s, prev %s", c.Bill.Collected, c.Bill.Status, c.PrevStatus)
+	}
+	_, err = repo.ConfirmContribution(ctx, first.ID)
+	if err := wantErr("confirm contribution twice", err, storage.ErrTxNotConfirming); err != nil {
+		return err
+	}
+
+	second, err := repo.AddConfirmingTransaction(ctx, bill.ID, wallet(), storage.OpContribute, chainRef(30))
+	if err != nil {
+		return err
+	}
+	c, err = repo.ConfirmContribution(ctx, second.ID)
+	if err != nil {
+		return err
+	}
+	if c.Bill.Status != storage.StatusDone || c.PrevStatus != storage.StatusActive || c.Bill.Collected.Cmp(storage.NewAmount(100)) != 0 {
+		return fmt.Errorf("goal reached: collected %s, status %s, prev %s", c.Bill.Collected, c.Bill.Status, c.PrevStatus)
+	}
+	if c.Bill.Version != 3 {
+		return fmt.Errorf("bill at version %d after two contributions, want 3", c.Bill.Version)
+	}
+
+	reversed, err := repo.ReverseContribution(ctx, first.ID, storage.StatusReturned, chainRef(70))
+	if err != nil {
+		return fmt.Errorf("reverse: %w", err)
+	}
+	if reversed.Status != storage.StatusReturned || reversed.ReversedAt == nil {
+		return fmt.Errorf("reversed tx: %+v", reversed)
+	}
+	if got, _ := repo.GetBill(ctx, bill.ID); got.Collected.Cmp(storage.NewAmount(30)) != 0 || got.Version != 4 {
+		return fmt.Errorf("after reversal collected %s at version %d, want 30 at 4", got.Collected, got.Version)
+	}
+	_, err = repo.ReverseContribution(ctx, first.ID, storage.StatusReturned, chainRef(70))
+	return wantErr("reverse twice", err, storage.ErrTxNotSuccess)
+}
+
+func checkCancel(ctx context.Context, repo storage.Repository) error {
+	bill, err := newBill(ctx, repo, 100)
+	if err != nil {
+		return err
+	}
+	sender := wallet()
+	tx, err := repo.AddTransaction(ctx, bill.ID, storage.NewAmount(10), sender, storage.OpContribute)
+	if err != nil {
+		return err
+	}
+
+	_, err = repo.CancelTransaction(ctx, tx.ID, wallet())
+	if err := wantErr("cancel foreign", err, storage.ErrTxNotOwned); err != nil {
+		return err
+	}
+	cancelled, err := repo.CancelTransaction(ctx, tx.ID, sender)
+	if err != nil {
+		return err
+	}
+	if cancelled.Status != storage.StatusCancelled {
+		return fmt.Errorf("cancelled tx is %s", cancelled.Status)
+	}
+	_, err = repo.CancelTransaction(ctx, tx.ID, sender)
+	if err := wantErr("cancel twice", err, storage.ErrTxNotPending); err != nil {
+		return err
+	}
+	// a watcher timing out late must not overwrite the cancel
+	if err := wantErr("fail cancelled", repo.FailTransaction(ctx, tx.ID), storage.ErrTxNotPending); err != nil {
+		return err
+	}
+	if got, _ := repo.GetTransaction(ctx, tx.ID); got.Status != storage.StatusCancelled {
+		return fmt.Errorf("cancelled tx is %s after a timeout", got.Status)
+	}
+	_, err = repo.CancelTransaction(ctx, uuid.New(), sender)
+	return wantErr("cancel missing", err, gorm.ErrRecordNotFound)
+}
+
+func checkBounce(ctx context.Context, repo storage.Repository) error {
+	bill, err := newBill(ctx, repo, 100)
+	if err != nil {
+		return err
+	}
+	tx, err := repo.AddTransaction(ctx, bill.ID, storage.NewAmount(10), wallet(), storage.OpContribute)
+	if err != nil {
+		return err
+	}
+
+	ref := chainRef(10)
+	if err := repo.BounceTransaction(ctx, tx.ID, ref); err != nil {
+		return fmt.Errorf("bounce: %w", err)
+	}
+	got, err := repo.GetTransaction(ctx, tx.ID)
+	if err != nil {
+		return err
+	}
+	if got.Status != storage.StatusBounced || got.ReversalTxHash == nil || *got.ReversalTxHash != ref.Hash {
+		return fmt.Errorf("bounced tx: %+v", got)
+	}
+	if err := wantErr("bounce twice", repo.BounceTransaction(ctx, tx.ID, chainRef(1)), storage.ErrTxNotPending); err != nil {
+		return err
+	}
+
+	// a chain transaction backs one contribution only
+	other, err := repo.AddTransaction(ctx, bill.ID, storage.NewAmount(10), wallet(), storage.OpContribute)
+	if err != nil {
+		return err
+	}
+	if err := wantErr("confirm reused ref", repo.ConfirmTransaction(ctx, other.ID, ref), storage.ErrChainTxReused); err != nil {
+		return err
+	}
+	_, err = repo.AddConfirmingTransaction(ctx, bill.ID, wallet(), storage.OpContribute, ref)
+	return wantErr("add with reused ref", err, storage.ErrChainTxReused)
+}
+
+func checkTxFilters(ctx context.Context, repo storage.Repository) error {
+	bill, err := newBill(ctx, repo, 100)
+	if err != nil {
+		return err
+	}
+	alice, bob := wallet(), wallet()
+	a, err := repo.AddTransaction(ctx, bill.ID, storage.NewAmount(1), alice, storage.OpContribute)
+	if err != nil {
+		return err
+	}
+	b, err := repo.AddTransaction(ctx, bill.ID, storage.NewAmount(2), bob, storage.OpRefund)
+	if err != nil {
+		return err
+	}
+	if err := repo.FailTransaction(ctx, b.ID); err != nil {
+		return err
+	}
+
+	for _, tc := range []struct {
+		filter storage.TxFilter
+		want   []uuid.UUID
+	}{
+		{storage.TxFilter{}, []uuid.UUID{a.ID, b.ID}},
+		{storage.TxFilter{Status: storage.StatusFailed}, []uuid.UUID{b.ID}},
+		{storage.TxFilter{OpType: storage.OpContribute}, []uuid.UUID{a.ID}},
+		{storage.TxFilter{Sender: bob}, []uuid.UUID{b.ID}},
+		{storage.TxFilter{Sender: alice, Status: storage.StatusFailed}, nil},
+	} {
+		txs, err := repo.ListTransactions(ctx, bill.ID, tc.filter)
+		if err != nil {
+			return err
+		}
+		if len(txs) != len(tc.want) {
+			return fmt.Errorf("filter %+v: got %d transactions, want %d", tc.filter, len(txs), len(tc.want))
+		}
+		for i := range txs {
+			if txs[i].ID != tc.want[i] {
+				return fmt.Errorf("filter %+v: got %s at %d, want %s", tc.filter, txs[i].ID, i, tc.want[i])
+			}
+		}
+	}
+
+	failed, err := repo.ListTransactionsByStatus(ctx, storage.StatusFailed)
+	if err != nil {
+		return err
+	}
+	for _, tx := range failed {
+		if tx.ID == b.ID {
+			return nil
+		}
+	}
+	return errors.New("failed transaction missing from ListTransactionsByStatus")
+}
+
+func checkHistory(ctx context.Context, repo storage.Repository) error {
+	sender := wallet()
+	var bills []*storage.Bill
+	for i := 0; i < 2; i++ {
+		bill, err := newBill(ctx, repo, 100)
+		if err != nil {
+			return err
+		}
+		tx, err := repo.AddConfirmingTransaction(ctx, bill.ID, sender, storage.OpContribute, chainRef(int64(10*(i+1))))
+		if err != nil {
+			return err
+		}
+		if _, err := repo.ConfirmContribution(ctx, tx.ID); err != nil {
+			return err
+		}
+		bills = append(bills, bill)
+	}
+	// a pending intent alone does not put a bill in the history
+	pendingOnly, err := newBill(ctx, repo, 100)
+	if err != nil {
+		return err
+	}
+	if _, err := repo.AddTransaction(ctx, pendingOnly.ID, storage.NewAmount(5), sender, storage.OpContribute); err != nil {
+		return err
+	}
+
+	history, err := repo.GetHistory(ctx, sender)
+	if err != nil {
+		return err
+	}
+	if len(history) != 2 || history[0].ID != bills[1].ID || history[1].ID != bills[0].ID {
+		return fmt.Errorf("history: got %+v", history)
+	}
+	if history[0].Amount.Cmp(storage.NewAmount(20)) != 0 {
+		return fmt.Errorf("history amount %s, want 20", history[0].Amount)
+	}
+	return nil
+}
+
+func checkWatchJobs(ctx context.Context, repo storage.Repository) error {
+	bill, err := newBill(ctx, repo, 100)
+	if err != nil {
+		return err
+	}
+	tx, err := repo.AddTransaction(ctx, bill.ID, storage.NewAmount(1), wallet(), storage.OpContribute)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(time.Hour)
+	if _, err := repo.CreateWatchJob(ctx, tx.ID, bill.ID, deadline); err != nil {
+		return err
+	}
+	_, err = repo.CreateWatchJob(ctx, tx.ID, bill.ID, deadline)
+	if err := wantErr("create twice", err, gorm.ErrDuplicatedKey); err != nil {
+		return err
+	}
+	if err := repo.UpdateWatchJobProgress(ctx, tx.ID, 3, 99); err != nil {
+		return err
+	}
+	job, err := repo.GetWatchJob(ctx, tx.ID)
+	if err != nil {
+		return err
+	}
+	if job.Attempts != 3 || job.LastLT != 99 || job.BillID != bill.ID {
+		return fmt.Errorf("job: %+v", job)
+	}
+	if err := repo.DeleteWatchJob(ctx, tx.ID); err != nil {
+		return err
+	}
+	_, err = repo.GetWatchJob(ctx, tx.ID)
+	return wantErr("get deleted", err, gorm.ErrRecordNotFound)
+}
+
+func checkIdempotency(ctx context.Context, repo storage.Repository) error {
+	scope, key := wallet(), uuid.NewString()
+
+	rec, fresh, err := repo.ReserveIdempotencyKey(ctx, scope, key, "fp", time.Hour)
+	if err != nil || !fresh || rec.StatusCode != 0 {
+		return fmt.Errorf("reserve: got %+v, %v, %v", rec, fresh, err)
+	}
+	rec, fresh, err = repo.ReserveIdempotencyKey(ctx, scope, key, "other", time.Hour)
+	if err != nil || fresh || rec.Fingerprint != "fp" {
+		return fmt.Errorf("reserve taken: got %+v, %v, %v", rec, fresh, err)
+	}
+
+	if err := repo.CompleteIdempotencyKey(ctx, scope, key, 201, []byte(`{"ok":true}`)); err != nil {
+		return err
+	}
+	// completed keys are not released
+	if err := repo.ReleaseIdempotencyKey(ctx, scope, key); err != nil {
+		return err
+	}
+	rec, fresh, err = repo.ReserveIdempotencyKey(ctx, scope, key, "fp", time.Hour)
+	if err != nil || fresh || rec.StatusCode != 201 || string(rec.Response) != `{"ok":true}` {
+		return fmt.Errorf("replay: got %+v, %v, %v", rec, fresh, err)
+	}
+
+	// in-flight keys are
+	inflight := uuid.NewString()
+	if _, _, err := repo.ReserveIdempotencyKey(ctx, scope, inflight, "fp", time.Hour); err != nil {
+		return err
+	}
+	if err := repo.ReleaseIdempotencyKey(ctx, scope, inflight); err != nil {
+		return err
+	}
+	if _, fresh, err := repo.ReserveIdempotencyKey(ctx, scope, inflight, "fp", time.Hour); err != nil || !fresh {
+		return fmt.Errorf("reserve released: fresh %v, %v", fresh, err)
+	}
+
+	// expired keys are replaced and purged
+	expired := uuid.NewString()
+	if _, _, err := repo.ReserveIdempotencyKey(ctx, scope, expired, "old", -time.Second); err != nil {
+		return err
+	}
+	rec, fresh, err = repo.ReserveIdempotencyKey(ctx, scope, expired, "new", -time.Second)
+	if err != nil || !fresh || rec.Fingerprint != "new" {
+		return fmt.Errorf("reserve expired: got %+v, %v, %v", rec, fresh, err)
+	}
+	purged, err := repo.PurgeExpiredIdempotencyKeys(ctx)
+	if err != nil || purged < 1 {
+		return fmt.Errorf("purge: %d, %v", purged, err)
+	}
+	return nil
+}
+
+func checkEvents(ctx context.Context, repo storage.Repository) error {
+	bill, err := newBill(ctx, repo, 100)
+	if err != nil {
+		return err
+	}
+	if _, err := repo.AppendBillEvent(ctx, uuid.New(), "tx.pending", 1, json.RawMessage(`{}`)); err == nil {
+		return errors.New("event appended to a missing bill")
+	}
+
+	for i := 1; i <= 3; i++ {
+		ev, err := repo.AppendBillEvent(ctx, bill.ID, "tx.pending", 1, json.RawMessage(fmt.Sprintf(`{"n":%d}`, i)))
+		if err != nil {
+			return err
+		}
+		if ev.Seq != uint64(i) {
+			return fmt.Errorf("event %d got seq %d", i, ev.Seq)
+		}
+	}
+
+	events, err := repo.ListBillEvents(ctx, bill.ID, 1, 10)
+	if err != nil {
+		return err
+	}
+	if len(events) != 2 || events[0].Seq != 2 || events[1].Seq != 3 {
+		return fmt.Errorf("list after 1: %+v", events)
+	}
+	if events, _ := repo.ListBillEvents(ctx, bill.ID, 0, 1); len(events) != 1 || events[0].Seq != 1 {
+		return fmt.Errorf("list with limit: %+v", events)
+	}
+
+	ev, err := repo.GetBillEvent(ctx, bill.ID, 2)
+	if err != nil {
+		return err
+	}
+	var payload struct{ N int }
+	if err := json.Unmarshal(ev.Payload, &payload); err != nil || payload.N != 2 || ev.Type != "tx.pending" || ev.Version != 1 {
+		return fmt.Errorf("get: %+v", ev)
+	}
+	_, err = repo.GetBillEvent(ctx, bill.ID, 9)
+	if err := wantErr("get missing", err, gorm.ErrRecordNotFound); err != nil {
+		return err
+	}
+
+	// only events older than the cutoff go
+	if _, err := repo.PruneBillEvents(ctx, time.Now().Add(-time.Hour)); err != nil {
+		return err
+	}
+	if events, _ := repo.ListBillEvents(ctx, bill.ID, 0, 10); len(events) != 3 {
+		return fmt.Errorf("prune removed recent events, %d left", len(events))
+	}
+	return nil
+}
+
+func checkWebhooks(ctx context.Context, repo storage.Repository) error {
+	keyID := uuid.NewString()[:16]
+	bill, err := repo.CreateBill(ctx, storage.NewAmount(100), wallet(), wallet(), wallet(), uuid.NewString(), keyID)
+	if err != nil {
+		return err
+	}
+
+	byKey := &storage.Webhook{APIKeyID: &keyID, URL: "https://example.com/key", Secret: "s"}
+	byBill := &storage.Webhook{BillID: &bill.ID, URL: "https://example.com/bill", Secret: "s", Events: "bill.status_changed"}
+	for _, wh := range []*storage.Webhook{byKey, byBill} {
+		if err := repo.CreateWebhook(ctx, wh); err != nil {
+			return fmt.Errorf("create: %w", err)
+		}
+	}
+	if err := repo.CreateWebhook(ctx, &storage.Webhook{URL: "https://example.com", Secret: "s"}); err == nil {
+		return errors.New("webhook without key or bill created")
+	}
+	if hooks, _ := repo.ListWebhooks(ctx, keyID, nil); len(hooks) != 1 || hooks[0].ID != byKey.ID {
+		return fmt.Errorf("list by key: %+v", hooks)
+	}
+	if hooks, _ := repo.ListWebhooks(ctx, "", &bill.ID); len(hooks) != 1 || hooks[0].ID != byBill.ID {
+		return fmt.Errorf("list by bill: %+v", hooks)
+	}
+
+	ev, err := repo.AppendBillEvent(ctx, bill.ID, "tx.pending", 1, json.RawMessage(`{}`))
+	if err != nil {
+		return err
+	}
+	// the bill webhook only wants status changes
+	if n, err := repo.EnqueueWebhookDeliveries(ctx, *ev, ev.Payload); err != nil || n != 1 {
+		return fmt.Errorf("enqueue: %d, %v", n, err)
+	}
+	if n, err := repo.EnqueueWebhookDeliveries(ctx, *ev, ev.Payload); err != nil || n != 0 {
+		return fmt.Errorf("enqueue twice: %d, %v", n, err)
+	}
+
+	claimed, err := repo.ClaimDueDeliveries(ctx, 1000, time.Minute)
+	if err != nil {
+		return err
+	}
+	var d *storage.WebhookDelivery
+	for i := range claimed {
+		if claimed[i].WebhookID == byKey.ID {
+			d = &claimed[i]
+		}
+	}
+	if d == nil || d.EventSeq != ev.Seq || d.Status != storage.DeliveryPending {
+		return fmt.Errorf("claim: got %+v", d)
+	}
+	for _, again := range claimAll(ctx, repo) {
+		if again.ID == d.ID {
+			return errors.New("leased delivery claimed again")
+		}
+	}
+
+	code := 500
+	if err := repo.MarkDeliveryFailed(ctx, d.ID, 8, &code, "boom", nil); err != nil {
+		return err
+	}
+	dead, err := repo.ListWebhookDeliveries(ctx, byKey.ID, storage.DeliveryDead, 10)
+	if err != nil || len(dead) != 1 || dead[0].Attempts != 8 || dead[0].LastError == nil {
+		return fmt.Errorf("dead letters: %+v, %v", dead, err)
+	}
+
+	again, err := repo.RedeliverWebhookDelivery(ctx, byKey.ID, d.ID)
+	if err != nil || again.Status != storage.DeliveryPending || again.Attempts != 0 {
+		return fmt.Errorf("redeliver: %+v, %v", again, err)
+	}
+	_, err = repo.RedeliverWebhookDelivery(ctx, byBill.ID, d.ID)
+	if err := wantErr("redeliver foreign", err, gorm.ErrRecordNotFound); err != nil {
+		return err
+	}
+	if err := repo.MarkDeliveryDelivered(ctx, d.ID, 1, 200); err != nil {
+		return err
+	}
+	done, _ := repo.ListWebhookDeliveries(ctx, byKey.ID, "", 10)
+	if len(done) != 1 || done[0].Status != storage.DeliveryDelivered || done[0].DeliveredAt == nil || done[0].LastError != nil {
+		return fmt.Errorf("delivered: %+v", done)
+	}
+
+	if err := repo.DeleteWebhook(ctx, byKey.ID); err != nil {
+		return err
+	}
+	_, err = repo.GetWebhook(ctx, byKey.ID)
+	if err := wantErr("get deleted", err, gorm.ErrRecordNotFound); err != nil {
+		return err
+	}
+	if left, _ := repo.ListWebhookDeliveries(ctx, byKey.ID, "", 10); len(left) != 0 {
+		return errors.New("deliveries outlived their webhook")
+	}
+	return nil
+}
+
+func claimAll(ctx context.Context, repo storage.Repository) []storage.WebhookDelivery {
+	out, _ := repo.ClaimDueDeliveries(ctx, 1000, time.Minute)
+	return out
+}
+
+func checkTelegram(ctx context.Context, repo storage.Repository) error {
+	on, off := uuid.NewString(), uuid.NewString()
+	if err := repo.UpsertTelegramSubscriber(ctx, &storage.TelegramSubscriber{Wallet: on, ChatID: 1}); err != nil {
+		return err
+	}
+	if err := repo.UpsertTelegramSubscriber(ctx, &storage.TelegramSubscriber{Wallet: off, ChatID: 2}); err != nil {
+		return err
+	}
+	if err := repo.UpsertTelegramSubscriber(ctx, &storage.TelegramSubscriber{Wallet: off, ChatID: 3, OptedOut: true}); err != nil {
+		return err
+	}
+
+	sub, err := repo.GetTelegramSubscriber(ctx, off)
+	if err != nil || sub.ChatID != 3 || !sub.OptedOut {
+		return fmt.Errorf("get after upsert: %+v, %v", sub, err)
+	}
+	chats, err := repo.ListTelegramChats(ctx, []string{on, off, uuid.NewString()})
+	if err != nil || len(chats) != 1 || chats[0].Wallet != on {
+		return fmt.Errorf("chats: %+v, %v", chats, err)
+	}
+	_, err = repo.GetTelegramSubscriber(ctx, uuid.NewString())
+	if err := wantErr("get missing", err, gorm.ErrRecordNotFound); err != nil {
+		return err
+	}
+
+	// a chat switches all its wallets at once
+	chat := time.Now().UnixNano()
+	second := uuid.NewString()
+	for _, w := range []string{on, second} {
+		if err := repo.UpsertTelegramSubscriber(ctx, &storage.TelegramSubscriber{Wallet: w, ChatID: chat}); err != nil {
+			return err
+		}
+	}
+	if n, err := repo.SetTelegramChatOptOut(ctx, chat, true); err != nil || n != 2 {
+		return fmt.Errorf("opt out chat: %d, %v", n, err)
+	}
+	if chats, _ := repo.ListTelegramChats(ctx, []string{on, second}); len(chats) != 0 {
+		return fmt.Errorf("opted out chat still listed: %+v", chats)
+	}
+	if n, err := repo.SetTelegramChatOptOut(ctx, chat, false); err != nil || n != 2 {
+		return fmt.Errorf("opt in chat: %d, %v", n, err)
+	}
+	if chats, _ := repo.ListTelegramChats(ctx, []string{on, second}); len(chats) != 2 {
+		return fmt.Errorf("opted in chat: %+v", chats)
+	}
+	return nil
+}
+
+func checkLedger(ctx context.Context, repo storage.Repository) error {
+	bill, err := newBill(ctx, repo, 100)
+	if err != nil {
+		return err
+	}
+	sender := wallet()
+	escrow, contributor := storage.EscrowAccount(bill.ID), storage.ContributorAccount(sender)
+
+	tx, err := repo.AddConfirmingTransaction(ctx, bill.ID, sender, storage.OpContribute, chainRef(70))
+	if err != nil {
+		return err
+	}
+	if _, err := repo.ConfirmContribution(ctx, tx.ID); err != nil {
+		return err
+	}
+	// value sent with another op is journaled but not collected
+	deposit, err := repo.AddConfirmingTransaction(ctx, bill.ID, wallet(), storage.OpTransfer, chainRef(5))
+	if err != nil {
+		return err
+	}
+	c, err := repo.ConfirmContribution(ctx, deposit.ID)
+	if err != nil {
+		return err
+	}
+	if c.Bill.Collected.Cmp(storage.NewAmount(70)) != 0 {
+		return fmt.Errorf("collected %s after a transfer, want 70", c.Bill.Collected)
+	}
+
+	entries, err := repo.ListLedgerEntries(ctx, bill.ID)
+	if err != nil {
+		return err
+	}
+	if len(entries) != 2 || entries[0].Kind != storage.EntryContribution || entries[1].Kind != storage.EntryDeposit {
+		return fmt.Errorf("entries after confirming: %+v", entries)
+	}
+	if p := entries[0].Postings; len(p) != 2 || p[0].Account != escrow || p[1].Account != contributor {
+		return fmt.Errorf("contribution postings: %+v", p)
+	}
+	if got, _ := repo.AccountBalance(ctx, escrow); got.Cmp(storage.NewAmount(75)) != 0 {
+		return fmt.Errorf("escrow holds %s, want 75", got)
+	}
+	if got, _ := repo.AccountBalance(ctx, contributor); got.Cmp(storage.NewAmount(-70)) != 0 {
+		return fmt.Errorf("contributor at %s, want -70", got)
+	}
+
+	payout := storage.NewTransferEntry(storage.EntryPayout, "out:"+uuid.NewString(), bill.ID, nil,
+		escrow, storage.DestinationAccount(bill.DestinationAddress), storage.NewAmount(60))
+	if inserted, err := repo.PostLedgerEntry(ctx, payout); err != nil || !inserted {
+		return fmt.Errorf("post payout: %v, %v", inserted, err)
+	}
+	if inserted, err := repo.PostLedgerEntry(ctx, payout); err != nil || inserted {
+		return fmt.Errorf("post payout twice: %v, %v", inserted, err)
+	}
+	unbalanced := payout
+	unbalanced.ID = "out:" + uuid.NewString()
+	unbalanced.Postings = unbalanced.Postings[:1]
+	_, err = repo.PostLedgerEntry(ctx, unbalanced)
+	if err := wantErr("post unbalanced", err, storage.ErrUnbalancedEntry); err != nil {
+		return err
+	}
+
+	if _, err := repo.ReverseContribution(ctx, tx.ID, storage.StatusReturned, chainRef(70)); err != nil {
+		return err
+	}
+	got, err := repo.GetBill(ctx, bill.ID)
+	if err != nil {
+		return err
+	}
+	if !got.Collected.IsZero() {
+		return fmt.Errorf("collected %s after the reversal, want 0", got.Collected)
+	}
+
+	// with the contribution returned the payout overdraws the escrow
+	issues, err := repo.CheckLedger(ctx)
+	if err != nil {
+		return err
+	}
+	var found []storage.LedgerIssue
+	for _, issue := range issues {
+		if issue.BillID == bill.ID {
+			found = append(found, issue)
+		}
+	}
+	if len(found) != 1 || found[0].Problem != "escrow overdrawn to -55" {
+		return fmt.Errorf("issues: %+v", found)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// TelegramSubscriber links a wallet, in raw form, to the Telegram chat that
+// receives its notifications.
+type TelegramSubscriber struct {
+	Wallet    string    `json:"wallet" gorm:"primaryKey"`
+	ChatID    int64     `json:"chat_id" gorm:"not null"`
+	OptedOut  bool      `json:"opted_out" gorm:"not null;default:false"`
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+func (s *Storage) UpsertTelegramSubscriber(ctx context.Context, sub *TelegramSubscriber) error {
+	return s.conn.WithContext(ctx).
+		Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "wallet"}},
+			DoUpdates: clause.AssignmentColumns([]string{"chat_id", "opted_out", "updated_at"}),
+		}).
+		Create(sub).
+		Error
+}
+
+func (s *Storage) GetTelegramSubscriber(ctx context.Context, wallet string) (*TelegramSubscriber, error) {
+	var sub TelegramSubscriber
+	if err := s.conn.WithContext(ctx).First(&sub, "wallet = ?", wallet).Error; err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// SetTelegramChatOptOut sets the opt-out flag of every wallet linked to
+// chatID and returns how many there are.
+func (s *Storage) SetTelegramChatOptOut(ctx context.Context, chatID int64, optedOut bool) (int64, error) {
+	res := s.conn.WithContext(ctx).
+		Model(&TelegramSubscriber{}).
+		Where("chat_id = ?", chatID).
+		Updates(map[string]interface{}{"opted_out": optedOut, "updated_at": time.Now().UTC()})
+	return res.RowsAffected, res.Error
+}
+
+// ListTelegramChats returns the subscribers among wallets that did not opt
+// out.
+func (s *Storage) ListTelegramChats(ctx context.Context, wallets []string) ([]TelegramSubscriber, error) {
+	var subs []TelegramSubscriber
+	if len(wallets) == 0 {
+		return subs, nil
+	}
+	if err := s.conn.WithContext(ctx).
+		Where("wallet IN ? AND NOT opted_out", wallets).
+		Find(&subs).Error; err != nil {
+		return nil, err
+	}
+	return subs, nil
+}
@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "PENDING"
+	DeliveryDelivered DeliveryStatus = "DELIVERED"
+	// DeliveryDead: retries are exhausted, only a manual redelivery sends it again.
+	DeliveryDead DeliveryStatus = "DEAD"
+)
+
+// Webhook receives the lifecycle events of one bill, or of every bill created
+// with an API key.
+type Webhook struct {
+	ID        uuid.UUID  `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	APIKeyID  *string    `json:"api_key_id,omitempty" gorm:"column:api_key_id;type:varchar(64)"`
+	BillID    *uuid.UUID `json:"bill_id,omitempty" gorm:"type:uuid"`
+	URL       string     `json:"url" gorm:"not null"`
+	Secret    string     `json:"-" gorm:"type:varchar(64);not null"`
+	Events    string     `json:"events" gorm:"not null;default:''"`
+	CreatedAt time.Time  `json:"created_at" gorm:"autoCreateTime"`
+}
+
+// Wants reports whether the webhook subscribed to events of type typ; an
+// empty list means all of them.
+func (w Webhook) Wants(typ string) bool {
+	if w.Events == "" {
+		return true
+	}
+	for _, e := range strings.Split(w.Events, ",") {
+		if strings.TrimSpace(e) == typ {
+			return true
+		}
+	}
+	return false
+}
+
+type WebhookDelivery struct {
+	ID             uuid.UUID       `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	WebhookID      uuid.UUID       `json:"webhook_id" gorm:"type:uuid;not null"`
+	BillID         uuid.UUID       `json:"bill_id" gorm:"type:uuid;not null"`
+	EventSeq       uint64          `json:"event_seq" gorm:"not null"`
+	EventType      string          `json:"event_type" gorm:"type:varchar(32);not null"`
+	Payload        json.RawMessage `json:"-" gorm:"type:jsonb;not null"`
+	Status         DeliveryStatus  `json:"status" gorm:"type:varchar(16);not null"`
+	Attempts       int             `json:"attempts" gorm:"not null;default:0"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	LastStatusCode *int            `json:"last_status_code,omitempty"`
+	LastError      *string         `json:"last_error,omitempty"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+	CreatedAt      time.Time       `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt      time.Time       `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+func (s *Storage) CreateWebhook(ctx context.Context, wh *Webhook) error {
+	if wh.ID == uuid.Nil {
+		wh.ID = uuid.New()
+	}
+	return s.conn.WithContext(ctx).Create(wh).Error
+}
+
+func (s *Storage) GetWebhook(ctx context.Context, id uuid.UUID) (*Webhook, error) {
+	var wh Webhook
+	if err := s.conn.WithContext(ctx).First(&wh, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &wh, nil
+}
+
+// ListWebhooks returns the webhooks of an API key or of a bill.
+func (s *Storage) ListWebhooks(ctx context.Context, apiKeyID string, billID *uuid.UUID) ([]Webhook, error) {
+	q := s.conn.WithContext(ctx)
+	if apiKeyID != "" {
+		q = q.Where("api_key_id = ?", apiKeyID)
+	}
+	if billID != nil {
+		q = q.Where("bill_id = ?", *billID)
+	}
+
+	var hooks []Webhook
+	if err := q.Order("created_at ASC").Find(&hooks).Error; err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+func (s *Storage) DeleteWebhook(ctx context.Context, id uuid.UUID) error {
+	return s.conn.WithContext(ctx).Delete(&Webhook{}, "id = ?", id).Error
+}
+
+// EnqueueWebhookDeliveries queues ev for every webhook of its bill or of the
+// API key the bill was created with. Enqueuing the same event twice is a
+// no-op.
+func (s *Storage) EnqueueWebhookDeliveries(ctx context.Context, ev BillEvent, payload json.RawMessage) (int, error) {
+	var hooks []Webhook
+	if err := s.conn.WithContext(ctx).
+		Where("bill_id = ? OR api_key_id = (?)", ev.BillID,
+			s.conn.Model(&Bill{}).Select("api_key_id").Where("id = ?", ev.BillID)).
+		Find(&hooks).Error; err != nil {
+		return 0, err
+	}
+
+	var deliveries []WebhookDelivery
+	for _, wh := range hooks {
+		if !wh.Wants(ev.Type) {
+			continue
+		}
+		deliveries = append(deliveries, WebhookDelivery{
+			ID:            uuid.New(),
+			WebhookID:     wh.ID,
+			BillID:        ev.BillID,
+			EventSeq:      ev.Seq,
+			EventType:     ev.Type,
+			Payload:       payload,
+			Status:        DeliveryPending,
+			NextAttemptAt: time.Now().UTC(),
+		})
+	}
+	if len(deliveries) == 0 {
+		return 0, nil
+	}
+
+	res := s.conn.WithContext(ctx).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&deliveries)
+	return int(res.RowsAffected), res.Error
+}
+
+// ClaimDueDeliveries picks pending deliveries whose time has come and pushes
+// their next attempt out by lease, so concurrent dispatchers on other
+// instances skip them while this one is sending.
+func (s *Storage) ClaimDueDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	var out []WebhookDelivery
+	err := s.conn.WithContext(ctx).Transaction(func(db *gorm.DB) error {
+		now := time.Now().UTC()
+		if err := db.
+			Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", DeliveryPending, now).
+			Order("next_attempt_at ASC").
+			Limit(limit).
+			Find(&out).Error; err != nil {
+			return err
+		}
+		if len(out) == 0 {
+			return nil
+		}
+
+		ids := make([]uuid.UUID, 0, len(out))
+		for _, d := range out {
+			ids = append(ids, d.ID)
+		}
+		return db.Model(&WebhookDelivery{}).
+			Where("id IN ?", ids).
+			Update("next_attempt_at", now.Add(lease)).
+			Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (s *Storage) MarkDeliveryDelivered(ctx context.Context, id uuid.UUID, attempts, statusCode int) error {
+	return s.conn.WithContext(ctx).
+		Model(&WebhookDelivery{}).
+		Where("id = ?", id).
+		Updates(map[string]interface{}{
+			"status":           DeliveryDelivered,
+			"attempts":         attempts,
+			"last_status_code": statusCode,
+			"last_error":       nil,
+			"delivered_at":     time.Now().UTC(),
+		}).
+		Error
+}
+
+// MarkDeliveryFailed records a failed attempt. A nil next means retries are
+// exhausted and the delivery goes to the dead-letter state.
+func (s *Storage) MarkDeliveryFailed(ctx context.Context, id uuid.UUID, attempts int, statusCode *int, errMsg string, next *time.Time) error {
+	updates := map[string]interface{}{
+		"attempts":         attempts,
+		"last_status_code": statusCode,
+		"last_error":       errMsg,
+	}
+	if next == nil {
+		updates["status"] = DeliveryDead
+	} else {
+		updates["next_attempt_at"] = next.UTC()
+	}
+	return s.conn.WithContext(ctx).
+		Model(&WebhookDelivery{}).
+		Where("id = ?", id).
+		Updates(updates).
+		Error
+}
+
+func (s *Storage) ListWebhookDeliveries(ctx context.Context, webhookID uuid.UUID, status DeliveryStatus, limit int) ([]WebhookDelivery, error) {
+	q := s.conn.WithContext(ctx).Where("webhook_id = ?", webhookID)
+	if status != "" {
+		q = q.Where("status = ?", status)
+	}
+
+	var out []WebhookDelivery
+	if err := q.Order("created_at DESC").Limit(limit).Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RedeliverWebhookDelivery queues a delivery again right away with a fresh
+// retry budget, whatever state it ended in.
+func (s *Storage) RedeliverWebhookDelivery(ctx context.Context, webhookID, id uuid.UUID) (*WebhookDelivery, error) {
+	res := s.conn.WithContext(ctx).
+		Model(&WebhookDelivery{}).
+		Where("id = ? AND webhook_id = ?", id, webhookID).
+		Updates(map[string]interface{}{
+			"status":          DeliveryPending,
+			"attempts":        0,
+			"next_attempt_at": time.Now().UTC(),
+			"delivered_at":    nil,
+		})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	var d WebhookDelivery
+	if err := s.conn.WithContext(ctx).First(&d, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
@@ -0,0 +1,85 @@
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Client sends messages through the Telegram Bot API. BaseURL is
+// configurable so a local fake Bot API server can stand in for
+// api.telegram.org.
+type Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+func NewClient(baseURL, token string) *Client {
+	return &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		token:   token,
+		http:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Error is a Bot API error response. RetryAfter is set when the bot is being
+// throttled.
+type Error struct {
+	Code        int
+	Description string
+	RetryAfter  time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("telegram: %d %s", e.Code, e.Description)
+}
+
+type apiResponse struct {
+	Ok          bool   `json:"ok"`
+	ErrorCode   int    `json:"error_code"`
+	Description string `json:"description"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+func (c *Client) SendMessage(ctx context.Context, chatID int64, text string) error {
+	body, err := json.Marshal(map[string]any{
+		"chat_id":                  chatID,
+		"text":                     text,
+		"disable_web_page_preview": true,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/bot"+c.token+"/sendMessage", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var out apiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return fmt.Errorf("telegram: decode response (status %d): %w", resp.StatusCode, err)
+	}
+	if !out.Ok {
+		return &Error{
+			Code:        out.ErrorCode,
+			Description: out.Description,
+			RetryAfter:  time.Duration(out.Parameters.RetryAfter) * time.Second,
+		}
+	}
+	return nil
+}
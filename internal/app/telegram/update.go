@@ -0,0 +1,31 @@
+package telegram
+
+import "strings"
+
+// Update is the part of a Bot API update the bot acts on: private text
+// messages.
+type Update struct {
+	UpdateID int64    `json:"update_id"`
+	Message  *Message `json:"message,omitempty"`
+}
+
+type Message struct {
+	Text string `json:"text"`
+	Chat Chat   `json:"chat"`
+}
+
+type Chat struct {
+	ID   int64  `json:"id"`
+	Type string `json:"type"`
+}
+
+// Command splits a "/cmd arg" message; "/cmd@bot" addresses a command to a
+// bot in a group and is reported as "/cmd".
+func (m *Message) Command() (cmd, arg string) {
+	if !strings.HasPrefix(m.Text, "/") {
+		return "", ""
+	}
+	cmd, arg, _ = strings.Cut(strings.TrimSpace(m.Text), " ")
+	cmd, _, _ = strings.Cut(cmd, "@")
+	return cmd, strings.TrimSpace(arg)
+}